@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/utils"
+	"github.com/pkg/errors"
+)
+
+// bakeOptions are the options of the bake file, applied to every target
+type bakeOptions struct {
+	buildArgs keyValues
+	platforms values
+	cacheFrom values
+	cacheTo   values
+}
+
+// bakeFile is a buildx bake definition in the JSON format, see
+// https://docs.docker.com/build/bake/reference/
+type bakeFile struct {
+	Group  map[string]bakeGroup  `json:"group"`
+	Target map[string]bakeTarget `json:"target"`
+}
+
+type bakeGroup struct {
+	Targets []string `json:"targets"`
+}
+
+type bakeTarget struct {
+	Context    string            `json:"context"`
+	Dockerfile string            `json:"dockerfile"`
+	Args       map[string]string `json:"args"`
+	Tags       []string          `json:"tags,omitempty"`
+	Platforms  []string          `json:"platforms,omitempty"`
+	CacheFrom  []string          `json:"cache-from,omitempty"`
+	CacheTo    []string          `json:"cache-to,omitempty"`
+}
+
+// bakeCommand prints a buildx bake file with a bake target per target of a pyproject.toml file
+func bakeCommand(flags *flag.FlagSet) func() int {
+	options := bakeOptions{buildArgs: keyValues{}}
+	flags.Var(options.buildArgs, "build-arg", "build argument as key=value, the value is read from the environment when omitted (repeatable)")
+	flags.Var(&options.platforms, "platform", "platform of the images, e.g. linux/amd64 (repeatable)")
+	flags.Var(&options.cacheFrom, "cache-from", "cache source of the targets, where {target} is replaced by the name of the target, e.g. type=registry,ref=registry.example.com/cache:{target} (repeatable)")
+	flags.Var(&options.cacheTo, "cache-to", "cache destination of the targets, where {target} is replaced by the name of the target, e.g. type=registry,ref=registry.example.com/cache:{target},mode=max (repeatable)")
+	return func() int {
+		if err := printBake(filenames(flags)[0], options, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// printBake writes the bake file of the targets of a pyproject.toml file, in the JSON format.
+// Each bake target builds the image of a target from the directory of the pyproject.toml file,
+// where the file is expected to be written, and is tagged with the image of the target.
+// All the targets belong to the default group, so that docker buildx bake builds them all.
+func printBake(filename string, options bakeOptions, out io.Writer) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	targets, err := config.Targets(data)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.Errorf("no target declared in %s", filename)
+	}
+	revision := gitRevision(filepath.Dir(filename), options.buildArgs)
+	bake := bakeFile{Group: map[string]bakeGroup{"default": {}}, Target: map[string]bakeTarget{}}
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		c, err := loadConfig(filename, generateOptions{app: target, buildArgs: options.buildArgs})
+		if err != nil {
+			return errors.Wrapf(err, "target %s", target)
+		}
+		bt := bakeTarget{
+			Context:    ".",
+			Dockerfile: filepath.Base(filename),
+			Args:       utils.Union(options.buildArgs, map[string]string{"microb_target": target}),
+			Platforms:  options.platforms,
+		}
+		if c.Image != "" {
+			image, err := config.ImageName(c, revision)
+			if err != nil {
+				return errors.Wrapf(err, "target %s", target)
+			}
+			bt.Tags = []string{image}
+		}
+		for _, cache := range options.cacheFrom {
+			bt.CacheFrom = append(bt.CacheFrom, strings.ReplaceAll(cache, "{target}", target))
+		}
+		for _, cache := range options.cacheTo {
+			bt.CacheTo = append(bt.CacheTo, strings.ReplaceAll(cache, "{target}", target))
+		}
+		name := bakeTargetName(target)
+		if _, ok := bake.Target[name]; ok {
+			return errors.Errorf("targets named %s conflict in the bake file", name)
+		}
+		bake.Target[name] = bt
+		names = append(names, name)
+	}
+	bake.Group["default"] = bakeGroup{Targets: names}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(bake)
+}
+
+// bakeTargetName returns the name of the bake target of a target, since bake only accepts
+// letters, digits, dashes and underscores in target names
+func bakeTargetName(target string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, target)
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+	microbllb "github.com/charbonats/microbuild/v1/llb"
+	"github.com/charbonats/microbuild/v1/utils"
+	"github.com/containerd/console"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/moby/buildkit/client"
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer"
+	"github.com/moby/buildkit/frontend/gateway/grpcclient"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// buildOptions are the options of the local builds
+type buildOptions struct {
+	generateOptions
+	addr        string
+	tags        values
+	push        bool
+	load        bool
+	debug       bool
+	metadata    string
+	useBuildctl bool
+	secrets     values
+	ssh         values
+	outputs     values
+	allTargets  bool
+	cacheFrom   values
+	cacheTo     values
+	github      bool
+	gitlab      bool
+	// Registry credentials overriding the docker configuration, by registry hostname
+	credentials map[string]types.AuthConfig
+}
+
+// addFlags adds the flags of the options to the flag set of the build command
+func (o *buildOptions) addFlags(flags *flag.FlagSet) {
+	o.generateOptions.addFlags(flags, true)
+	flags.StringVar(&o.addr, "addr", os.Getenv("BUILDKIT_HOST"), "address of buildkit, e.g. docker-container://buildx_buildkit_default0, the buildkit of the Docker daemon is used by default")
+	flags.Var(&o.tags, "tag", "reference of the image, e.g. registry.example.com/app:1.0, implies --load unless --push is set (repeatable)")
+	flags.BoolVar(&o.push, "push", false, "push the image to the registries of its references, using the credentials of the docker configuration")
+	flags.BoolVar(&o.load, "load", false, "load the image into the Docker daemon")
+	flags.BoolVar(&o.debug, "debug-on-failure", false, "open an interactive shell in the failing RUN instruction")
+	flags.StringVar(&o.metadata, "metadata-file", "", "file where the metadata of the build is written as JSON")
+	flags.BoolVar(&o.useBuildctl, "buildctl", false, "build the generated LLB using buildctl instead of connecting to buildkit")
+	flags.Var(&o.secrets, "secret", "secret forwarded to the build, e.g. id=netrc,src=$HOME/.netrc (repeatable)")
+	flags.Var(&o.ssh, "ssh", "ssh agent socket or keys forwarded to the build, e.g. default (repeatable)")
+	flags.Var(&o.outputs, "output", "output of the build, e.g. type=docker,name=example:latest (repeatable)")
+	flags.BoolVar(&o.allTargets, "all-targets", false, "build all the targets concurrently in a single build, the result holding the image of each target under its name")
+	flags.Var(&o.cacheFrom, "cache-from", "cache imported by the build, e.g. type=registry,ref=registry.example.com/cache or type=gha (repeatable)")
+	flags.Var(&o.cacheTo, "cache-to", "cache exported by the build, e.g. type=registry,ref=registry.example.com/cache,mode=max or type=gha,mode=max (repeatable)")
+	flags.BoolVar(&o.gitlab, "gitlab", false, "build in GitLab CI: push to the registry of the project using the job token, tagged with the commit and the branch, with a registry cache per target")
+	flags.BoolVar(&o.github, "github-output", false, "append the digest and the tags of the image to the $GITHUB_OUTPUT file of GitHub Actions")
+}
+
+// buildCommand builds the image. When run by buildkit as a frontend, it connects to buildkit
+// and builds the image using the build options of buildkit. Otherwise, the image of a target
+// is built by the buildkit of the Docker daemon, by the buildkit given by -addr or by buildctl.
+func buildCommand(flags *flag.FlagSet) func() int {
+	var options buildOptions
+	options.addFlags(flags)
+	return func() int {
+		if flags.NFlag() == 0 && flags.NArg() == 0 && os.Getenv("BUILDKIT_SESSION_ID") != "" {
+			if err := grpcclient.RunFromEnvironment(appcontext.Context(), microbllb.Build); err != nil {
+				log.Print(err)
+				return 1
+			}
+			return 0
+		}
+		if options.allTargets && (options.app != "" || len(options.tags) > 0 || options.push || options.load || options.metadata != "" || options.github || options.gitlab || options.useBuildctl) {
+			fmt.Fprintln(os.Stderr, "--all-targets can not be used with --app, --tag, --push, --load, --metadata-file, --github-output, --gitlab or --buildctl, which apply to a single image")
+			return 2
+		}
+		if options.gitlab && options.useBuildctl {
+			fmt.Fprintln(os.Stderr, "--gitlab can not be used with --buildctl, which reads the credentials of the docker configuration")
+			return 2
+		}
+		if options.github && os.Getenv("GITHUB_OUTPUT") == "" {
+			fmt.Fprintln(os.Stderr, "--github-output requires the GITHUB_OUTPUT environment variable, set by GitHub Actions")
+			return 2
+		}
+		filename := filenames(flags)[0]
+		if options.gitlab {
+			if err := applyGitlab(filename, &options); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		if options.push && len(options.tags) == 0 {
+			// The image of the target is used as tag
+			tag, err := imageTag(filename, options)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			if tag == "" {
+				fmt.Fprintln(os.Stderr, "--push requires at least one --tag, or an image configured for the target")
+				return 2
+			}
+			options.tags = append(options.tags, tag)
+		}
+		if options.push && options.load {
+			fmt.Fprintln(os.Stderr, "--push and --load can not be combined, a single output is supported")
+			return 2
+		}
+		if options.debug && options.useBuildctl {
+			fmt.Fprintln(os.Stderr, "--debug-on-failure can not be used with --buildctl")
+			return 2
+		}
+		if (options.metadata != "" || options.github) && options.useBuildctl {
+			fmt.Fprintln(os.Stderr, "--metadata-file and --github-output can not be used with --buildctl")
+			return 2
+		}
+		if len(options.tags) > 0 && !options.push {
+			options.load = true
+		}
+		var err error
+		if options.useBuildctl {
+			err = buildWithBuildctl(filename, options)
+		} else {
+			err = buildWithClient(appcontext.Context(), filename, options)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// Build arguments commonly provided by CI systems holding the git revision, as read by the frontend
+var revisionBuildArgs = []string{"git_commit", "github_sha", "ci_commit_sha"}
+
+// imageTag returns the name of the image configured for the target, which tags the image pushed
+// without --tag
+func imageTag(filename string, options buildOptions) (string, error) {
+	c, err := loadConfig(filename, options.generateOptions)
+	if err != nil {
+		return "", err
+	}
+	return config.ImageName(c, gitRevision(filepath.Dir(filename), options.buildArgs))
+}
+
+// gitRevision returns the git revision used to name images, read from the build arguments,
+// or from the git repository of a directory. It is empty when the revision is unknown.
+func gitRevision(dir string, buildArgs map[string]string) string {
+	for _, name := range revisionBuildArgs {
+		for k, v := range buildArgs {
+			if strings.ToLower(k) == name && v != "" {
+				return v
+			}
+		}
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// buildWithBuildctl builds the LLB generated for a target using buildctl, which provides
+// the secrets and the ssh agent. The directory of the pyproject.toml file is the build context.
+func buildWithBuildctl(filename string, options buildOptions) error {
+	// References are quoted since they are separated by commas
+	name := fmt.Sprintf("\"name=%s\"", strings.Join(options.tags, ","))
+	if options.push {
+		options.outputs = append(options.outputs, "type=image,"+name+",push=true")
+	} else if options.load && len(options.tags) > 0 {
+		options.outputs = append(options.outputs, "type=docker,"+name)
+	} else if options.load {
+		options.outputs = append(options.outputs, "type=docker")
+	}
+	args := []string{"build", "--local", "context=" + filepath.Dir(filename)}
+	for _, secret := range options.secrets {
+		args = append(args, "--secret", secret)
+	}
+	for _, agent := range options.ssh {
+		args = append(args, "--ssh", agent)
+	}
+	for _, output := range options.outputs {
+		args = append(args, "--output", output)
+	}
+	imports, exports, err := parseCaches(filename, options)
+	if err != nil {
+		return err
+	}
+	for _, cache := range imports {
+		args = append(args, "--import-cache", formatCache(cache))
+	}
+	for _, cache := range exports {
+		args = append(args, "--export-cache", formatCache(cache))
+	}
+	var definition bytes.Buffer
+	if err := printLlb(filename, options.generateOptions, &definition); err != nil {
+		return err
+	}
+	buildctl := exec.Command("buildctl", args...)
+	buildctl.Stdin = &definition
+	buildctl.Stdout = os.Stdout
+	buildctl.Stderr = os.Stderr
+	if !options.load {
+		return errors.Wrap(buildctl.Run(), "running buildctl")
+	}
+	loader, err := dockerLoad(nil)
+	if err != nil {
+		return err
+	}
+	buildctl.Stdout = loader
+	if err := buildctl.Run(); err != nil {
+		loader.Close()
+		return errors.Wrap(err, "running buildctl")
+	}
+	return loader.Close()
+}
+
+// buildWithClient builds the image of a target by running the frontend in process against
+// buildkit, so that only Docker is required. The directory of the pyproject.toml file is
+// the build context.
+func buildWithClient(ctx context.Context, filename string, options buildOptions) error {
+	c, docker, err := newBuildkitClient(ctx, options.addr)
+	if err != nil {
+		return errors.Wrap(err, "connecting to buildkit")
+	}
+	defer c.Close()
+	attachables, err := sessionAttachables(options.secrets, options.ssh, options.credentials)
+	if err != nil {
+		return err
+	}
+	exports, err := parseOutputs(options.outputs)
+	if err != nil {
+		return err
+	}
+	if options.push || options.load {
+		exports = append(exports, imageExport(options, docker))
+	}
+	if len(exports) > 1 {
+		return errors.New("only a single output is supported, use either --output, --push or --load")
+	}
+	// The configuration is resolved from the same files as the frontend
+	cfg, err := loadConfig(filename, options.generateOptions)
+	if err != nil {
+		return err
+	}
+	exports = withExporterAttrs(exports, microbllb.ExporterAttrs(cfg))
+	cacheImports, cacheExports, err := parseCaches(filename, options)
+	if err != nil {
+		return err
+	}
+	cacheExports = append(cacheExports, microbllb.CacheExports(cfg, options.buildArgs)...)
+	dir := filepath.Dir(filename)
+	// The exporter attributes and the cache exports of the configuration are applied here
+	attrs := map[string]string{"filename": filepath.Base(filename), microbllb.ClientExportsKey: "true"}
+	if options.app != "" {
+		attrs["build-arg:microb_target"] = options.app
+	}
+	if options.templatesDir != "" {
+		// Templates are read from the build context by the frontend
+		templatesDir, err := filepath.Rel(dir, options.templatesDir)
+		if err != nil {
+			return errors.Wrap(err, "locating templates")
+		}
+		attrs["build-arg:microb_templates_dir"] = filepath.ToSlash(templatesDir)
+	}
+	if options.allTargets {
+		attrs["all-targets"] = "true"
+	}
+	for k, v := range options.buildArgs {
+		attrs["build-arg:"+k] = v
+	}
+	for k, v := range options.labels {
+		attrs["label:"+k] = v
+	}
+	buildFunc := microbllb.Build
+	if options.debug {
+		attrs["debug-on-failure"] = "true"
+		shell := &microbllb.DebugShell{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+		if terminal, err := console.ConsoleFromFile(os.Stdin); err == nil {
+			shell.Console = terminal
+		}
+		buildFunc = microbllb.BuildWithDebugShell(shell)
+	}
+	solveOpt := client.SolveOpt{
+		Exports:       exports,
+		LocalDirs:     map[string]string{"context": dir, "dockerfile": dir},
+		FrontendAttrs: attrs,
+		Session:       attachables,
+		CacheImports:  cacheImports,
+		CacheExports:  cacheExports,
+	}
+	configs := map[string]platformMetadata{}
+	buildFunc = recordImageConfigs(buildFunc, configs)
+	ch := make(chan *client.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+	var response *client.SolveResponse
+	eg.Go(func() error {
+		var err error
+		response, err = c.Build(ctx, solveOpt, "microb", buildFunc, ch)
+		return err
+	})
+	eg.Go(func() error {
+		_, err := progressui.DisplaySolveStatus(context.TODO(), "", nil, os.Stderr, ch)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if options.metadata == "" && !options.github {
+		return nil
+	}
+	if options.metadata != "" {
+		if err := writeMetadata(options.metadata, cfg, options.tags, response.ExporterResponse, configs); err != nil {
+			return errors.Wrap(err, "writing metadata file")
+		}
+	}
+	if options.github {
+		return errors.Wrap(writeGithubOutput(os.Getenv("GITHUB_OUTPUT"), cfg, options.tags, response.ExporterResponse), "writing GitHub output")
+	}
+	return nil
+}
+
+// imageExport returns the export of the image named with the references given by --tag,
+// which is either pushed to its registries or loaded into the Docker daemon. Unless the
+// buildkit of the Docker daemon is used, the image is loaded by streaming a docker
+// tarball into docker load.
+func imageExport(options buildOptions, docker bool) client.ExportEntry {
+	attrs := map[string]string{}
+	if len(options.tags) > 0 {
+		attrs["name"] = strings.Join(options.tags, ",")
+	}
+	if options.push {
+		attrs["push"] = "true"
+	}
+	switch {
+	case docker:
+		// The Docker daemon stores the image directly
+		return client.ExportEntry{Type: "moby", Attrs: attrs}
+	case options.push:
+		return client.ExportEntry{Type: client.ExporterImage, Attrs: attrs}
+	default:
+		return client.ExportEntry{Type: client.ExporterDocker, Attrs: attrs, Output: dockerLoad}
+	}
+}
+
+// withExporterAttrs adds the exporter attributes requested by the configuration to the exports
+// of images, unless they are set by the output
+func withExporterAttrs(exports []client.ExportEntry, attrs map[string]string) []client.ExportEntry {
+	for _, export := range exports {
+		switch export.Type {
+		case client.ExporterImage, client.ExporterDocker, client.ExporterOCI, "moby":
+			for k, v := range attrs {
+				if _, ok := export.Attrs[k]; !ok {
+					export.Attrs[k] = v
+				}
+			}
+		}
+	}
+	return exports
+}
+
+// newBuildkitClient connects to buildkit at the given address, or to the buildkit embedded
+// in the Docker daemon when the address is empty. It returns whether the Docker daemon is used.
+func newBuildkitClient(ctx context.Context, addr string) (*client.Client, bool, error) {
+	if addr != "" {
+		c, err := client.New(ctx, addr)
+		return c, false, err
+	}
+	docker, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := client.New(ctx, "",
+		client.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return docker.DialHijack(ctx, "/grpc", "h2c", nil)
+		}),
+		client.WithSessionDialer(func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+			return docker.DialHijack(ctx, "/session", proto, meta)
+		}),
+	)
+	return c, true, err
+}
+
+// sessionAttachables returns the secrets, the ssh agents and the registry credentials provided
+// to the build. Registry credentials are read from the docker configuration, which includes
+// credential helpers, unless they are given for the registry.
+// Secrets use the format of docker build, e.g. id=netrc,src=$HOME/.netrc or id=token,env=TOKEN,
+// and ssh agents are either default or id=path[,path].
+func sessionAttachables(secrets []string, ssh []string, credentials map[string]types.AuthConfig) ([]session.Attachable, error) {
+	sources := make([]secretsprovider.Source, 0, len(secrets))
+	for _, secret := range secrets {
+		source, err := parseSecret(secret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid secret %s", secret)
+		}
+		sources = append(sources, source)
+	}
+	store, err := secretsprovider.NewStore(sources)
+	if err != nil {
+		return nil, err
+	}
+	docker := dockerconfig.LoadDefaultConfigFile(os.Stderr)
+	if len(credentials) > 0 {
+		// Credential stores take precedence over the credentials of the configuration
+		docker.CredentialsStore = ""
+	}
+	for registry, auth := range credentials {
+		delete(docker.CredentialHelpers, registry)
+		auth.ServerAddress = registry
+		docker.AuthConfigs[registry] = auth
+	}
+	attachables := []session.Attachable{
+		secretsprovider.NewSecretProvider(store),
+		authprovider.NewDockerAuthProvider(docker),
+	}
+	if len(ssh) == 0 {
+		return attachables, nil
+	}
+	configs := make([]sshprovider.AgentConfig, 0, len(ssh))
+	for _, agent := range ssh {
+		id, paths, ok := strings.Cut(agent, "=")
+		config := sshprovider.AgentConfig{ID: id}
+		if ok {
+			config.Paths = strings.Split(paths, ",")
+		}
+		configs = append(configs, config)
+	}
+	provider, err := sshprovider.NewSSHAgentProvider(configs)
+	if err != nil {
+		return nil, err
+	}
+	return append(attachables, provider), nil
+}
+
+// parseSecret parses a secret using the format of docker build
+func parseSecret(secret string) (secretsprovider.Source, error) {
+	var source secretsprovider.Source
+	fields, err := csv.NewReader(strings.NewReader(secret)).Read()
+	if err != nil {
+		return source, err
+	}
+	kind := "file"
+	for _, field := range fields {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return source, errors.Errorf("invalid key-value pair %s", field)
+		}
+		switch strings.ToLower(k) {
+		case "type":
+			kind = v
+		case "id":
+			source.ID = v
+		case "src", "source":
+			source.FilePath = v
+		case "env":
+			source.Env = v
+		default:
+			return source, errors.Errorf("unknown key %s", k)
+		}
+	}
+	switch kind {
+	case "file":
+	case "env":
+		if source.Env == "" {
+			source.Env, source.FilePath = source.FilePath, ""
+		}
+	default:
+		return source, errors.Errorf("unknown secret type %s", kind)
+	}
+	return source, nil
+}
+
+// parseOutputs parses the outputs of the build using the format of docker build,
+// e.g. type=oci,dest=image.tar. Tarballs without destination are written to stdout.
+// The oci and docker outputs are written as an OCI layout directory when tar=false.
+func parseOutputs(outputs []string) ([]client.ExportEntry, error) {
+	var exports []client.ExportEntry
+	for _, output := range outputs {
+		fields, err := csv.NewReader(strings.NewReader(output)).Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid output %s", output)
+		}
+		export := client.ExportEntry{Attrs: map[string]string{}}
+		for _, field := range fields {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, errors.Errorf("invalid key-value pair %s in output %s", field, output)
+			}
+			if k == "type" {
+				export.Type = v
+			} else {
+				export.Attrs[k] = v
+			}
+		}
+		dest := export.Attrs["dest"]
+		delete(export.Attrs, "dest")
+		switch export.Type {
+		case "":
+			return nil, errors.Errorf("missing type in output %s", output)
+		case client.ExporterLocal:
+			if dest == "" {
+				return nil, errors.Errorf("missing dest in output %s", output)
+			}
+			export.OutputDir = dest
+		case client.ExporterDocker, client.ExporterOCI:
+			if export.Attrs["tar"] != "false" {
+				export.Output = outputFile(dest)
+			} else if dest == "" {
+				return nil, errors.Errorf("missing dest in output %s", output)
+			} else {
+				export.OutputDir = dest
+			}
+		case client.ExporterTar:
+			export.Output = outputFile(dest)
+		}
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+// parseCaches parses the caches imported and exported by the build using the format of docker
+// build, e.g. type=registry,ref=registry.example.com/cache, where a bare reference is a registry
+// cache. The GitHub Actions cache (type=gha) reads its url and token from the ACTIONS_CACHE_URL
+// and ACTIONS_RUNTIME_TOKEN environment variables, and is scoped by target unless scope is set.
+func parseCaches(filename string, options buildOptions) ([]client.CacheOptionsEntry, []client.CacheOptionsEntry, error) {
+	var scope string
+	parse := func(caches []string) ([]client.CacheOptionsEntry, error) {
+		entries := make([]client.CacheOptionsEntry, 0, len(caches))
+		for _, cache := range caches {
+			fields, err := csv.NewReader(strings.NewReader(cache)).Read()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid cache %s", cache)
+			}
+			if len(fields) == 1 && !strings.Contains(fields[0], "=") {
+				fields = []string{"type=registry", "ref=" + fields[0]}
+			}
+			entry := client.CacheOptionsEntry{Attrs: map[string]string{}}
+			for _, field := range fields {
+				k, v, ok := strings.Cut(field, "=")
+				if !ok {
+					return nil, errors.Errorf("invalid key-value pair %s in cache %s", field, cache)
+				}
+				if k == "type" {
+					entry.Type = v
+				} else {
+					entry.Attrs[k] = v
+				}
+			}
+			switch entry.Type {
+			case "":
+				return nil, errors.Errorf("missing type in cache %s", cache)
+			case "gha":
+				for k, env := range map[string]string{"url": "ACTIONS_CACHE_URL", "token": "ACTIONS_RUNTIME_TOKEN"} {
+					if entry.Attrs[k] == "" {
+						entry.Attrs[k] = os.Getenv(env)
+					}
+					if entry.Attrs[k] == "" {
+						return nil, errors.Errorf("missing %s in cache %s, the %s environment variable is not set", k, cache, env)
+					}
+				}
+				if entry.Attrs["scope"] == "" {
+					if scope == "" {
+						scope = "microb"
+						if !options.allTargets {
+							c, err := loadConfig(filename, options.generateOptions)
+							if err != nil {
+								return nil, err
+							}
+							scope += "-" + c.Target
+						}
+					}
+					entry.Attrs["scope"] = scope
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+	imports, err := parse(options.cacheFrom)
+	if err != nil {
+		return nil, nil, err
+	}
+	exports, err := parse(options.cacheTo)
+	return imports, exports, err
+}
+
+// formatCache formats a cache using the format of buildctl, e.g. type=gha,scope=microb-default
+func formatCache(cache client.CacheOptionsEntry) string {
+	var field strings.Builder
+	w := csv.NewWriter(&field)
+	fields := []string{"type=" + cache.Type}
+	for _, k := range utils.SortedKeys(cache.Attrs) {
+		fields = append(fields, k+"="+cache.Attrs[k])
+	}
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(field.String(), "\n")
+}
+
+// outputFile returns a function opening the destination of a tarball, or stdout
+func outputFile(dest string) func(map[string]string) (io.WriteCloser, error) {
+	return func(map[string]string) (io.WriteCloser, error) {
+		if dest == "" || dest == "-" {
+			if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				return nil, errors.New("refusing to write a tarball to the terminal, set dest or redirect stdout")
+			}
+			return os.Stdout, nil
+		}
+		return os.Create(dest)
+	}
+}
+
+// dockerLoad returns a writer loading the image tarball written to it into the Docker daemon.
+// The image is loaded once the writer is closed.
+func dockerLoad(map[string]string) (io.WriteCloser, error) {
+	load := exec.Command("docker", "load")
+	load.Stdout = os.Stderr
+	load.Stderr = os.Stderr
+	stdin, err := load.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := load.Start(); err != nil {
+		return nil, errors.Wrap(err, "running docker load")
+	}
+	return &commandWriter{WriteCloser: stdin, cmd: load}, nil
+}
+
+// commandWriter writes to the stdin of a command, and waits for the command on close
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *commandWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.cmd.Wait()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+)
+
+// completionCommand prints the completion script of a shell. Target names are completed
+// dynamically using the hidden __targets command.
+func completionCommand(flags *flag.FlagSet) func() int {
+	return func() int {
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return 2
+		}
+		var err error
+		switch shell := flags.Arg(0); shell {
+		case "bash":
+			err = bashCompletion(os.Stdout)
+		case "zsh":
+			err = zshCompletion(os.Stdout)
+		case "fish":
+			err = fishCompletion(os.Stdout)
+		default:
+			err = fmt.Errorf("unknown shell %s, expected bash, zsh or fish", shell)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// targetsCommand prints the targets of a pyproject.toml file, one per line
+func targetsCommand(flags *flag.FlagSet) func() int {
+	return func() int {
+		data, err := os.ReadFile(filenames(flags)[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		targets, err := config.Targets(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, target := range targets {
+			fmt.Println(target)
+		}
+		return 0
+	}
+}
+
+// completedFlag is a flag of a command offered by the completion scripts
+type completedFlag struct {
+	name        string
+	description string
+	// Whether the flag is a boolean flag, which takes no value
+	boolean bool
+}
+
+// completedCommand is a command offered by the completion scripts
+type completedCommand struct {
+	command
+	flags []completedFlag
+	// Whether the command takes pyproject.toml files as positional arguments
+	files bool
+}
+
+// completedCommands returns the visible commands with their flags, sorted by name
+func completedCommands() []completedCommand {
+	var completed []completedCommand
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		flags := c.flagSet()
+		c.setup(flags)
+		cc := completedCommand{command: c, files: strings.Contains(c.usage, "pyproject.toml")}
+		flags.VisitAll(func(f *flag.Flag) {
+			boolean, ok := f.Value.(interface{ IsBoolFlag() bool })
+			cc.flags = append(cc.flags, completedFlag{name: f.Name, description: f.Usage, boolean: ok && boolean.IsBoolFlag()})
+		})
+		completed = append(completed, cc)
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i].name < completed[j].name })
+	return completed
+}
+
+// bashCompletion writes the bash completion script
+func bashCompletion(out io.Writer) error {
+	var script strings.Builder
+	commands := completedCommands()
+	names := make([]string, 0, len(commands))
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	script.WriteString(`# bash completion for microb, load it with: source <(microb completion bash)
+_microb() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "` + strings.Join(names, " ") + `" -- "$cur"))
+		return
+	fi
+	if [ "$prev" = "-app" ] || [ "$prev" = "--app" ]; then
+		local word file=pyproject.toml
+		for word in "${COMP_WORDS[@]}"; do
+			case "$word" in *.toml) file="$word" ;; esac
+		done
+		COMPREPLY=($(compgen -W "$(microb __targets "$file" 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	local flags values
+	case "${COMP_WORDS[1]}" in
+`)
+	for _, c := range commands {
+		var flags, values []string
+		for _, f := range c.flags {
+			flags = append(flags, "--"+f.name)
+			if !f.boolean {
+				values = append(values, "--"+f.name, "-"+f.name)
+			}
+		}
+		fmt.Fprintf(&script, "\t%s) flags=%q values=%q ;;\n", c.name, strings.Join(flags, " "), strings.Join(values, " "))
+	}
+	script.WriteString(`	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	elif [[ " $values " != *" $prev "* ]]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o default -F _microb microb
+`)
+	_, err := io.WriteString(out, script.String())
+	return err
+}
+
+// zshCompletion writes the zsh completion script
+func zshCompletion(out io.Writer) error {
+	var script strings.Builder
+	commands := completedCommands()
+	script.WriteString(`#compdef microb
+# zsh completion for microb, load it with: source <(microb completion zsh)
+
+_microb_targets() {
+	local word file=pyproject.toml
+	for word in $words; do
+		[[ $word == *.toml ]] && file=$word
+	done
+	local -a targets
+	targets=(${(f)"$(microb __targets $file 2>/dev/null)"})
+	_describe 'target' targets
+}
+
+_microb() {
+	local -a commands
+	commands=(
+`)
+	for _, c := range commands {
+		fmt.Fprintf(&script, "\t\t%s\n", shellQuote(c.name+":"+strings.ReplaceAll(c.description, ":", `\:`)))
+	}
+	script.WriteString(`	)
+	if (( CURRENT == 2 )); then
+		_describe 'command' commands
+		return
+	fi
+	case $words[2] in
+`)
+	for _, c := range commands {
+		fmt.Fprintf(&script, "\t%s)\n\t\t_arguments", c.name)
+		for _, f := range c.flags {
+			spec := "--" + f.name + "[" + zshEscape(f.description) + "]"
+			switch {
+			case f.name == "app":
+				spec += ":target:_microb_targets"
+			case !f.boolean:
+				spec += ":" + f.name + ":_default"
+			}
+			fmt.Fprintf(&script, " \\\n\t\t\t%s", shellQuote(spec))
+		}
+		if c.files {
+			fmt.Fprintf(&script, " \\\n\t\t\t%s", shellQuote("*:file:_files -g '*.toml'"))
+		}
+		script.WriteString("\n\t\t;;\n")
+	}
+	script.WriteString(`	esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+	_microb "$@"
+else
+	compdef _microb microb
+fi
+`)
+	_, err := io.WriteString(out, script.String())
+	return err
+}
+
+// zshEscape escapes the brackets of a description of a flag, which delimit it in zsh specs
+func zshEscape(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`).Replace(s)
+}
+
+// shellQuote quotes a word within single quotes, for zsh and fish
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishCompletion writes the fish completion script
+func fishCompletion(out io.Writer) error {
+	var script strings.Builder
+	commands := completedCommands()
+	script.WriteString(`# fish completion for microb, load it with: microb completion fish | source
+
+function __microb_targets
+	set -l file pyproject.toml
+	for word in (commandline -opc)
+		if string match -q -- '*.toml' $word
+			set file $word
+		end
+	end
+	microb __targets $file 2>/dev/null
+end
+
+complete -c microb -f
+`)
+	for _, c := range commands {
+		fmt.Fprintf(&script, "complete -c microb -n __fish_use_subcommand -a %s -d %s\n", c.name, shellQuote(c.description))
+	}
+	for _, c := range commands {
+		condition := shellQuote("__fish_seen_subcommand_from " + c.name)
+		for _, f := range c.flags {
+			fmt.Fprintf(&script, "complete -c microb -n %s -l %s -d %s", condition, f.name, shellQuote(f.description))
+			switch {
+			case f.name == "app":
+				script.WriteString(" -x -a '(__microb_targets)'")
+			case !f.boolean:
+				script.WriteString(" -r")
+			}
+			script.WriteString("\n")
+		}
+		if c.files {
+			fmt.Fprintf(&script, "complete -c microb -n %s -a '(__fish_complete_suffix .toml)'\n", condition)
+		}
+	}
+	_, err := io.WriteString(out, script.String())
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/charbonats/microbuild/v1/utils"
+	"github.com/pkg/errors"
+)
+
+// composeCommand prints a docker-compose.yml file with a service per target of a pyproject.toml file
+func composeCommand(flags *flag.FlagSet) func() int {
+	buildArgs := keyValues{}
+	flags.Var(buildArgs, "build-arg", "build argument as key=value, the value is read from the environment when omitted (repeatable)")
+	return func() int {
+		if err := printCompose(filenames(flags)[0], buildArgs, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// printCompose writes the docker-compose.yml file of the targets of a pyproject.toml file.
+// Each service builds the image of a target from the directory of the pyproject.toml file,
+// where the file is expected to be written, and is named after the target. The image, the
+// exposed ports, the environment and the healthcheck of the target are used by the service.
+// Values are quoted, and dollar signs escaped, so that compose does not interpolate them.
+func printCompose(filename string, buildArgs map[string]string, out io.Writer) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	targets, err := config.Targets(data)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.Errorf("no target declared in %s", filename)
+	}
+	revision := gitRevision(filepath.Dir(filename), buildArgs)
+	var yaml strings.Builder
+	yaml.WriteString("# generated by microb compose\nservices:\n")
+	for _, target := range targets {
+		c, err := loadConfig(filename, generateOptions{app: target, buildArgs: buildArgs})
+		if err != nil {
+			return errors.Wrapf(err, "target %s", target)
+		}
+		fmt.Fprintf(&yaml, "  %s:\n", composeServiceName(target))
+		if c.Image != "" {
+			image, err := config.ImageName(c, revision)
+			if err != nil {
+				return errors.Wrapf(err, "target %s", target)
+			}
+			fmt.Fprintf(&yaml, "    image: %s\n", composeQuote(image))
+		}
+		yaml.WriteString("    build:\n")
+		yaml.WriteString("      context: \".\"\n")
+		fmt.Fprintf(&yaml, "      dockerfile: %s\n", composeQuote(filepath.Base(filename)))
+		yaml.WriteString("      args:\n")
+		args := utils.Union(buildArgs, map[string]string{"microb_target": target})
+		for _, k := range utils.SortedKeys(args) {
+			fmt.Fprintf(&yaml, "        %s: %s\n", k, composeQuote(args[k]))
+		}
+		if len(c.Expose) > 0 {
+			yaml.WriteString("    ports:\n")
+			for _, port := range c.Expose {
+				number, protocol, ok := strings.Cut(port, "/")
+				mapping := number + ":" + number
+				if ok {
+					mapping += "/" + protocol
+				}
+				fmt.Fprintf(&yaml, "      - %s\n", composeQuote(mapping))
+			}
+		}
+		if len(c.Env) > 0 {
+			yaml.WriteString("    environment:\n")
+			for _, k := range utils.SortedKeys(c.Env) {
+				fmt.Fprintf(&yaml, "      %s: %s\n", k, composeQuote(dockerfile.ExpandPlaceholders(c.Env[k], buildArgs)))
+			}
+		}
+		if h := c.Healthcheck; h != nil {
+			yaml.WriteString("    healthcheck:\n")
+			test := []string{composeQuote("CMD")}
+			for _, arg := range h.Command {
+				test = append(test, composeQuote(arg))
+			}
+			fmt.Fprintf(&yaml, "      test: [%s]\n", strings.Join(test, ", "))
+			for _, field := range [][2]string{{"interval", h.Interval}, {"timeout", h.Timeout}, {"start_period", h.StartPeriod}} {
+				if field[1] != "" {
+					fmt.Fprintf(&yaml, "      %s: %s\n", field[0], composeQuote(field[1]))
+				}
+			}
+			if h.Retries > 0 {
+				fmt.Fprintf(&yaml, "      retries: %d\n", h.Retries)
+			}
+		}
+	}
+	_, err = io.WriteString(out, yaml.String())
+	return err
+}
+
+// composeServiceName returns the name of the service of a target, since compose only
+// accepts lowercase letters, digits, dashes and underscores in service names
+func composeServiceName(target string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, target)
+}
+
+// composeQuote quotes a value as a double quoted YAML string, escaping the dollar signs
+// which would be interpolated by compose
+func composeQuote(value string) string {
+	return strconv.Quote(strings.ReplaceAll(value, "$", "$$"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config/types"
+	"github.com/pkg/errors"
+)
+
+// gitlabVariables are the predefined variables of GitLab CI used by --gitlab, see
+// https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+var gitlabVariables = []string{"CI_REGISTRY", "CI_REGISTRY_IMAGE", "CI_JOB_TOKEN", "CI_COMMIT_SHORT_SHA"}
+
+// applyGitlab configures a build running in a GitLab CI job. The image is pushed to the container
+// registry of the project using the job token, unless it is loaded or exported, and is tagged
+// with the short commit sha and the slug of the branch or tag when no --tag is given, e.g.
+// registry.gitlab.com/group/project/api:1a2b3c4d for the target api. Unless caches are given,
+// the cache of the target is imported from and exported to the cache tag of its repository,
+// following the registry cache conventions of GitLab.
+func applyGitlab(filename string, options *buildOptions) error {
+	env := map[string]string{}
+	for _, name := range gitlabVariables {
+		if env[name] = os.Getenv(name); env[name] == "" {
+			return errors.Errorf("--gitlab requires the %s variable, set by GitLab CI", name)
+		}
+	}
+	c, err := loadConfig(filename, options.generateOptions)
+	if err != nil {
+		return err
+	}
+	repository := strings.ToLower(env["CI_REGISTRY_IMAGE"] + "/" + composeServiceName(c.Target))
+	if options.credentials == nil {
+		options.credentials = map[string]types.AuthConfig{}
+	}
+	options.credentials[env["CI_REGISTRY"]] = types.AuthConfig{Username: "gitlab-ci-token", Password: env["CI_JOB_TOKEN"]}
+	if !options.load && len(options.outputs) == 0 {
+		options.push = true
+	}
+	if len(options.tags) == 0 && c.Image == "" {
+		options.tags = append(options.tags, repository+":"+env["CI_COMMIT_SHORT_SHA"])
+		if slug := os.Getenv("CI_COMMIT_REF_SLUG"); slug != "" {
+			options.tags = append(options.tags, repository+":"+slug)
+		}
+	}
+	if len(options.cacheFrom) == 0 && len(options.cacheTo) == 0 {
+		options.cacheFrom = append(options.cacheFrom, "type=registry,ref="+repository+":cache")
+		if options.push {
+			options.cacheTo = append(options.cacheTo, "type=registry,ref="+repository+":cache,mode=max")
+		}
+	}
+	return nil
+}
@@ -7,82 +7,601 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/BurntSushi/toml"
 	"github.com/charbonats/microbuild/v1/config"
 	"github.com/charbonats/microbuild/v1/dockerfile"
 	microbllb "github.com/charbonats/microbuild/v1/llb"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
-	"github.com/moby/buildkit/frontend/gateway/grpcclient"
-	"github.com/moby/buildkit/util/appcontext"
 	"github.com/pkg/errors"
 )
 
-var filename string
-var app string
-var outputLLB bool
-var outputDockerfile bool
-var buildkit bool
+// command is a subcommand of the microb cli
+type command struct {
+	name        string
+	usage       string
+	description string
+	// Maximum number of positional arguments, -1 for no limit
+	maxArgs int
+	// Hidden commands are not listed in the help output
+	hidden bool
+	// setup adds the flags of the command to its flag set, and returns the function
+	// running the command once the arguments are parsed
+	setup func(flags *flag.FlagSet) func() int
+}
+
+// commands are the subcommands of the microb cli, in the order of the help output.
+// They are set by init since the completion command lists them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name:        "build",
+			usage:       "[-app target] [-templates-dir dir] [--build-arg key=value] [--label key=value] [--secret id=...,src=...] [--ssh default] [--output type=...] [--tag name] [--push] [--load] [--debug-on-failure] [--metadata-file file] [--addr address] [--buildctl] [--all-targets] [pyproject.toml]",
+			description: "Build the image of a target using the buildkit of the Docker daemon. This is also the command run by buildkit, which builds the image as a frontend.",
+			maxArgs:     1,
+			setup:       buildCommand,
+		},
+		{
+			name:        "dockerfile",
+			usage:       "[-app target] [-templates-dir dir] [--build-arg key=value] [pyproject.toml]",
+			description: "Print the Dockerfile generated for a target.",
+			maxArgs:     1,
+			setup:       dockerfileCommand,
+		},
+		{
+			name:        "llb",
+			usage:       "[-app target] [-templates-dir dir] [--build-arg key=value] [--label key=value] [pyproject.toml]",
+			description: "Print the LLB generated for a target.",
+			maxArgs:     1,
+			setup:       llbCommand,
+		},
+		{
+			name:        "compose",
+			usage:       "[--build-arg key=value] [pyproject.toml]",
+			description: "Print a docker-compose.yml file with a service per target, to be written next to pyproject.toml.",
+			maxArgs:     1,
+			setup:       composeCommand,
+		},
+		{
+			name:        "bake",
+			usage:       "[--build-arg key=value] [--platform platform] [--cache-from cache] [--cache-to cache] [pyproject.toml]",
+			description: "Print a docker buildx bake file with a bake target per target, to be written next to pyproject.toml.",
+			maxArgs:     1,
+			setup:       bakeCommand,
+		},
+		{
+			name:        "validate",
+			usage:       "[-app target] [pyproject.toml...]",
+			description: "Validate pyproject.toml files and report the errors with their position.",
+			maxArgs:     -1,
+			setup:       validateCommand,
+		},
+		{
+			name:        "lint",
+			usage:       "[-app target] [-format text|json] [pyproject.toml...]",
+			description: "Report risky patterns found in the configuration of pyproject.toml files.",
+			maxArgs:     -1,
+			setup:       lintCommand,
+		},
+		{
+			name:        "show",
+			usage:       "[-app target] [-format json|toml] [pyproject.toml]",
+			description: "Print the configuration resolved for a target.",
+			maxArgs:     1,
+			setup:       showCommand,
+		},
+		{
+			name:        "schema",
+			description: "Print the JSON schema of the configuration.",
+			setup:       schemaCommand,
+		},
+		{
+			name:        "version",
+			usage:       "[-format text|json]",
+			description: "Print the version of microb and the capabilities of the frontend.",
+			setup:       versionCommand,
+		},
+		{
+			name:        "completion",
+			usage:       "bash|zsh|fish",
+			description: "Print the completion script of a shell.",
+			maxArgs:     1,
+			setup:       completionCommand,
+		},
+		{
+			name:        "__targets",
+			usage:       "[pyproject.toml]",
+			description: "Print the targets of a pyproject.toml file, used by the completion scripts.",
+			maxArgs:     1,
+			hidden:      true,
+			setup:       targetsCommand,
+		},
+	}
+}
 
 func main() {
-	flag.BoolVar(&outputLLB, "llb", false, "print llb to stdout")
-	flag.BoolVar(&outputDockerfile, "dockerfile", false, "print equivalent Dockerfile to stdout")
-	flag.BoolVar(&buildkit, "buildkit", true, "establish connection to buildkit and issue build")
-	flag.StringVar(&filename, "filename", "pyproject.toml", "the pyproject.toml to build from")
-	flag.StringVar(&app, "app", "", "the app to build")
-	flag.Parse()
-
-	// Display the dockerfile if requested
-	if outputDockerfile {
-		if err := printDockerfile(filename, app, os.Stdout); err != nil {
-			log.Fatal(err)
-		}
+	// Buildkit runs the frontend without arguments
+	if len(os.Args) < 2 {
+		os.Exit(commands[0].run(nil))
+	}
+	name := os.Args[1]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		printUsage(os.Stdout)
 		os.Exit(0)
 	}
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %s\n\n", name)
+	printUsage(os.Stderr)
+	os.Exit(2)
+}
+
+// run parses the arguments of a command and runs it. It returns the exit code of the command.
+func (c command) run(args []string) int {
+	flags := c.flagSet()
+	run := c.setup(flags)
+	flags.Parse(args)
+	if c.maxArgs >= 0 && flags.NArg() > c.maxArgs {
+		fmt.Fprintf(flags.Output(), "too many arguments: %s\n\n", strings.Join(flags.Args(), " "))
+		flags.Usage()
+		return 2
+	}
+	return run()
+}
 
-	// Display the LLB if requested
-	if outputLLB {
-		if err := printLlb(filename, app, os.Stdout); err != nil {
-			os.Exit(1)
+// printUsage prints the list of the commands to the given writer
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: microb <command> [flags] [arguments]\n\nCommands:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		if !c.hidden {
+			fmt.Fprintf(w, "  %s\t%s\n", c.name, c.description)
 		}
-		os.Exit(0)
 	}
+	w.Flush()
+	fmt.Fprintf(out, "\nRun 'microb <command> -h' for the flags of a command.\n")
+}
+
+// flagSet returns the flag set of a command. The usage of the command is printed on -h.
+func (c command) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: microb %s %s\n\n%s\n", c.name, c.usage, c.description)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(flags.Output(), "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// filenames returns the pyproject.toml files given as positional arguments,
+// or the pyproject.toml file of the current directory
+func filenames(flags *flag.FlagSet) []string {
+	if flags.NArg() == 0 {
+		return []string{"pyproject.toml"}
+	}
+	return flags.Args()
+}
+
+// generateOptions are the options of the commands generating a Dockerfile for a target
+type generateOptions struct {
+	app          string
+	templatesDir string
+	buildArgs    keyValues
+	labels       keyValues
+}
+
+// addFlags adds the flags of the options to the flag set of a command.
+// Labels are only used by the commands generating LLB.
+func (o *generateOptions) addFlags(flags *flag.FlagSet, withLabels bool) {
+	o.buildArgs = keyValues{}
+	flags.StringVar(&o.app, "app", "", "the target to generate, the first target is used by default")
+	flags.StringVar(&o.templatesDir, "templates-dir", "", "directory of the templates overriding the default stage templates")
+	flags.Var(o.buildArgs, "build-arg", "build argument as key=value, the value is read from the environment when omitted (repeatable)")
+	if withLabels {
+		o.labels = keyValues{}
+		flags.Var(o.labels, "label", "label of the image as key=value (repeatable)")
+	}
+}
+
+// keyValues is a repeatable flag of key=value pairs, such as --build-arg
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok {
+		// Like docker build, the value of a key without value is read from the environment
+		v, ok = os.LookupEnv(k)
+		if !ok {
+			return fmt.Errorf("%s is not set in the environment", k)
+		}
+	}
+	kv[k] = v
+	return nil
+}
+
+// values is a repeatable flag forwarded as is, such as --secret
+type values []string
+
+func (v *values) String() string {
+	return strings.Join(*v, " ")
+}
+
+func (v *values) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// dockerfileCommand prints the Dockerfile generated for a target
+func dockerfileCommand(flags *flag.FlagSet) func() int {
+	var options generateOptions
+	options.addFlags(flags, false)
+	return func() int {
+		if err := printDockerfile(filenames(flags)[0], options, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
 
-	// Build the image if requested
-	if buildkit {
-		if err := grpcclient.RunFromEnvironment(appcontext.Context(), microbllb.Build); err != nil {
-			log.Fatal(err)
+// llbCommand prints the LLB generated for a target
+func llbCommand(flags *flag.FlagSet) func() int {
+	var options generateOptions
+	options.addFlags(flags, true)
+	return func() int {
+		if err := printLlb(filenames(flags)[0], options, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
 		}
+		return 0
+	}
+}
+
+// schemaCommand prints the JSON schema of the configuration
+func schemaCommand(flags *flag.FlagSet) func() int {
+	return func() int {
+		if err := printSchema(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// loadConfig reads the configuration of a target using the build arguments
+func loadConfig(filename string, options generateOptions) (*config.Config, error) {
+	configOptions := localOptions(filename, options.app)
+	configOptions.BuildArgs = options.buildArgs
+	c, err := config.NewConfigFromFile(filename, configOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening pyproject.toml")
+	}
+	return c, nil
+}
+
+// generateDockerfile generates the Dockerfile of a target.
+// Placeholders of the configuration are expanded using the build arguments.
+func generateDockerfile(filename string, options generateOptions) (string, error) {
+	c, err := loadConfig(filename, options)
+	if err != nil {
+		return "", err
+	}
+	templates, err := readTemplates(options.templatesDir)
+	if err != nil {
+		return "", errors.Wrap(err, "reading templates")
+	}
+	dockerfile, err := dockerfile.Microb2DockerfileWithTemplates(c, options.buildArgs, templates)
+	if err != nil {
+		return "", errors.Wrap(err, "generating Dockerfile")
 	}
+	return dockerfile, nil
 }
 
 // printDockerfile prints the Dockerfile to the given writer
-func printDockerfile(filename string, app string, out io.Writer) error {
-	c, err := config.NewConfigFromFile(filename, &config.Options{Target: app})
+func printDockerfile(filename string, options generateOptions, out io.Writer) error {
+	dockerfile, err := generateDockerfile(filename, options)
 	if err != nil {
-		return errors.Wrap(err, "opening pyproject.toml")
+		return err
 	}
-	dockerfile := dockerfile.Microb2Dockerfile(c, nil)
-	out.Write([]byte(dockerfile))
-	return nil
+	_, err = out.Write([]byte(dockerfile))
+	return err
 }
 
-// printLlb prints the LLB to the given writer
-func printLlb(filename string, app string, out io.Writer) error {
-	c, err := config.NewConfigFromFile(filename, &config.Options{Target: app})
+// printLlb prints the LLB to the given writer. The LLB is built natively from the configuration,
+// unless templates or extra instructions are used, in which case the generated Dockerfile is compiled.
+func printLlb(filename string, options generateOptions, out io.Writer) error {
+	c, err := loadConfig(filename, options)
+	if err != nil {
+		return err
+	}
+	templates, err := readTemplates(options.templatesDir)
+	if err != nil {
+		return errors.Wrap(err, "reading templates")
+	}
+	convertOpts := dockerfile2llb.ConvertOpt{
+		BuildArgs: options.buildArgs,
+		Labels:    options.labels,
+	}
+	if microbllb.NativeSupported(c, templates) {
+		st, _, err := microbllb.Microb2LLB(context.TODO(), c, options.app, convertOpts)
+		if err != nil {
+			return errors.Wrap(err, "building llb")
+		}
+		dt, err := st.Marshal(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "marshaling llb state")
+		}
+		return llb.WriteTo(dt, out)
+	}
+	dockerfile, err := dockerfile.Microb2DockerfileWithTemplates(c, options.buildArgs, templates)
+	if err != nil {
+		return errors.Wrap(err, "generating Dockerfile")
+	}
+	if err := microbllb.ValidateDockerfile(dockerfile); err != nil {
+		return err
+	}
+	convertOpts.SourceMap = microbllb.NewSourceMap(dockerfile)
+	st, _, _, err := dockerfile2llb.Dockerfile2LLB(context.TODO(), []byte(dockerfile), convertOpts)
 	if err != nil {
-		return errors.Wrap(err, "opening pyproject.toml")
+		return errors.Wrap(err, "compiling Dockerfile to llb")
 	}
-	dockerfile := dockerfile.Microb2Dockerfile(c, nil)
-	st, _, _, _ := dockerfile2llb.Dockerfile2LLB(context.TODO(), []byte(dockerfile), dockerfile2llb.ConvertOpt{})
 	dt, err := st.Marshal(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "marshaling llb state")
 	}
+	microbllb.NameSteps(dt, dockerfile, options.app, nil)
 
 	return llb.WriteTo(dt, out)
 }
+
+// readTemplates reads the templates overriding the default stage templates from a directory.
+// Templates which are not found are not overridden.
+func readTemplates(dir string) (map[string]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	templates := map[string]string{}
+	for _, name := range dockerfile.TemplateNames {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = string(content)
+	}
+	return templates, nil
+}
+
+// printSchema prints the JSON schema of the microb configuration to the given writer
+func printSchema(out io.Writer) error {
+	schema, err := config.JSONSchema()
+	if err != nil {
+		return errors.Wrap(err, "generating JSON schema")
+	}
+	_, err = fmt.Fprintln(out, string(schema))
+	return err
+}
+
+// showCommand prints the configuration resolved for a target of a pyproject.toml file, either as
+// JSON or as TOML. Passwords of indices are redacted.
+func showCommand(flags *flag.FlagSet) func() int {
+	var app, format string
+	flags.StringVar(&app, "app", "", "the target to show, the first target is shown by default")
+	flags.StringVar(&format, "format", "json", "output format, either json or toml")
+	return func() int {
+		filename := filenames(flags)[0]
+		c, err := config.NewConfigFromFile(filename, localOptions(filename, app))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		indices := make([]config.Index, len(c.Indices))
+		for i, index := range c.Indices {
+			if index.Password != "" {
+				index.Password = "xxxxx"
+			}
+			indices[i] = index
+		}
+		c.Indices = indices
+		switch format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(c)
+		case "toml":
+			err = toml.NewEncoder(os.Stdout).Encode(c)
+		default:
+			err = fmt.Errorf("unknown format %s", format)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// localOptions returns the options used to read a pyproject.toml file from the local filesystem.
+// Files referenced by the pyproject.toml file are read relative to its directory.
+func localOptions(filename string, app string) *config.Options {
+	dir := filepath.Dir(filename)
+	return &config.Options{
+		Filename: filename,
+		Target:   app,
+		ReadPythonVersion: func(contextDir string) string {
+			return config.ReadPythonVersion(func(name string) ([]byte, error) {
+				return os.ReadFile(filepath.Join(dir, contextDir, name))
+			})
+		},
+		ReadRequirements: func(name string) ([]string, error) {
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			return strings.Split(string(content), "\n"), nil
+		},
+		PathExists: func(name string) bool {
+			_, err := os.Stat(filepath.Join(dir, name))
+			return err == nil
+		},
+		ReadFile: func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(dir, name))
+		},
+	}
+}
+
+// validateCommand validates pyproject.toml files and reports the errors with their position.
+// All the targets of a file are validated unless a target is selected.
+func validateCommand(flags *flag.FlagSet) func() int {
+	var app string
+	flags.StringVar(&app, "app", "", "the target to validate, all targets are validated by default")
+	return func() int {
+		code := 0
+		for _, filename := range filenames(flags) {
+			for _, err := range validateFile(filename, app) {
+				fmt.Fprintln(os.Stderr, err)
+				code = 1
+			}
+		}
+		return code
+	}
+}
+
+// validateFile validates the targets of a pyproject.toml file.
+// Errors are prefixed with the position of the error in the file when it is known.
+func validateFile(filename string, app string) []error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return []error{err}
+	}
+	targets, err := selectTargets(data, app)
+	if err != nil {
+		return []error{locateError(filename, data, err)}
+	}
+	var errs []error
+	for _, target := range targets {
+		if _, err := config.NewConfigFromBytes(data, localOptions(filename, target)); err != nil {
+			errs = append(errs, locateError(filename, data, err))
+		}
+	}
+	return errs
+}
+
+// selectTargets returns the targets of a pyproject.toml file to check: the given target
+// if any, else all the targets declared in the file.
+func selectTargets(data []byte, app string) ([]string, error) {
+	if app != "" {
+		return []string{app}, nil
+	}
+	targets, err := config.Targets(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		// The default configuration is used when no target is declared
+		targets = []string{""}
+	}
+	return targets, nil
+}
+
+// lintCommand reports the risky patterns found in the configuration of pyproject.toml files,
+// either as text or as JSON. All the targets of a file are linted unless a target is selected.
+func lintCommand(flags *flag.FlagSet) func() int {
+	var app, format string
+	flags.StringVar(&app, "app", "", "the target to lint, all targets are linted by default")
+	flags.StringVar(&format, "format", "text", "output format, either text or json")
+	return func() int {
+		if format != "text" && format != "json" {
+			fmt.Fprintf(os.Stderr, "unknown format %s\n", format)
+			return 2
+		}
+		type fileFinding struct {
+			File string `json:"file"`
+			config.Finding
+		}
+		findings := []fileFinding{}
+		code := 0
+		for _, filename := range filenames(flags) {
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				code = 2
+				continue
+			}
+			targets, err := selectTargets(data, app)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, locateError(filename, data, err))
+				code = 2
+				continue
+			}
+			for _, target := range targets {
+				targetFindings, err := config.Lint(data, localOptions(filename, target))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, locateError(filename, data, err))
+					code = 2
+					continue
+				}
+				for _, finding := range targetFindings {
+					findings = append(findings, fileFinding{File: filename, Finding: finding})
+				}
+			}
+		}
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(findings); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		} else {
+			for _, finding := range findings {
+				location := finding.File
+				if finding.Line > 0 {
+					location = fmt.Sprintf("%s:%d:%d", finding.File, finding.Line, finding.Column)
+				}
+				fmt.Fprintf(os.Stdout, "%s: %s: %s\n", location, finding.Rule, finding.Message)
+			}
+		}
+		if code == 0 && len(findings) > 0 {
+			code = 1
+		}
+		return code
+	}
+}
+
+// locateError prefixes an error with the file and the position where it occurred
+func locateError(filename string, data []byte, err error) error {
+	if position, ok := config.ErrorPosition(data, err); ok {
+		return fmt.Errorf("%s:%d:%d: %w", filename, position.Line, position.Column, err)
+	}
+	return fmt.Errorf("%s: %w", filename, err)
+}
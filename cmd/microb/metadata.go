@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// buildMetadata is the metadata of a successful build written by --metadata-file
+type buildMetadata struct {
+	Target        string                      `json:"target"`
+	Tags          []string                    `json:"tags"`
+	Digest        string                      `json:"digest,omitempty"`
+	Platforms     map[string]platformMetadata `json:"platforms"`
+	PythonVersion string                      `json:"python_version"`
+	Dependencies  []string                    `json:"dependencies"`
+	SystemDeps    []string                    `json:"system_deps"`
+}
+
+// platformMetadata is the metadata of the image built for a platform
+type platformMetadata struct {
+	// Digest of the image configuration, which is the id of the image
+	ConfigDigest string `json:"config_digest"`
+}
+
+// recordImageConfigs wraps a build function to record the image configurations of its result
+// by platform, since they are not part of the response of the exporter
+func recordImageConfigs(build gateway.BuildFunc, configs map[string]platformMetadata) gateway.BuildFunc {
+	return func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		res, err := build(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range res.Metadata {
+			if k != exptypes.ExporterImageConfigKey && !strings.HasPrefix(k, exptypes.ExporterImageConfigKey+"/") {
+				continue
+			}
+			var image ocispecs.Image
+			if err := json.Unmarshal(v, &image); err != nil {
+				return nil, errors.Wrap(err, "failed to parse image config")
+			}
+			platform := platforms.Format(ocispecs.Platform{OS: image.OS, Architecture: image.Architecture, Variant: image.Variant})
+			configs[platform] = platformMetadata{ConfigDigest: digest.FromBytes(v).String()}
+		}
+		return res, nil
+	}
+}
+
+// writeMetadata writes the metadata of a build to a JSON file
+func writeMetadata(filename string, c *config.Config, tags []string, response map[string]string, configs map[string]platformMetadata) error {
+	metadata := buildMetadata{
+		Target:        c.Target,
+		Tags:          tags,
+		Digest:        response[exptypes.ExporterImageDigestKey],
+		Platforms:     configs,
+		PythonVersion: c.PythonVersion,
+		Dependencies:  c.Dependencies,
+		SystemDeps:    c.SystemDeps,
+	}
+	// Lists are written as empty arrays rather than null
+	for _, list := range []*[]string{&metadata.Tags, &metadata.Dependencies, &metadata.SystemDeps} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	dt, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(dt, '\n'), 0644)
+}
+
+// writeGithubOutput appends the outputs of a build to the $GITHUB_OUTPUT file of GitHub Actions,
+// so that later steps can use the target, the digest and the tags of the image, e.g.
+// ${{ steps.build.outputs.digest }}. The tags are separated by newlines.
+func writeGithubOutput(filename string, c *config.Config, tags []string, response map[string]string) error {
+	outputs := [][2]string{
+		{"target", c.Target},
+		{"digest", response[exptypes.ExporterImageDigestKey]},
+		{"tags", strings.Join(tags, "\n")},
+	}
+	var content strings.Builder
+	for _, output := range outputs {
+		if !strings.Contains(output[1], "\n") {
+			fmt.Fprintf(&content, "%s=%s\n", output[0], output[1])
+			continue
+		}
+		// Multiline values are written between delimiters, which must not appear in the value
+		delimiter := "ghadelimiter_" + digest.FromString(output[1]).Encoded()
+		fmt.Fprintf(&content, "%s<<%s\n%s\n%s\n", output[0], delimiter, output[1], delimiter)
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
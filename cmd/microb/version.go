@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	microbllb "github.com/charbonats/microbuild/v1/llb"
+)
+
+// version is the version of the binary, set at build time using
+// -ldflags "-X main.version=v1.0.0". The version of the module is used otherwise.
+var version = ""
+
+// versionInfo describes the binary and the capabilities of the frontend, so that
+// mismatches between the gateway image and the documentation can be diagnosed
+type versionInfo struct {
+	Version         string   `json:"version"`
+	ApiVersions     []string `json:"api_versions"`
+	Label           string   `json:"label"`
+	Buildkit        string   `json:"buildkit"`
+	GoVersion       string   `json:"go_version"`
+	Platform        string   `json:"platform"`
+	FrontendOptions []string `json:"frontend_options"`
+}
+
+// newVersionInfo returns the version information of the running binary
+func newVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:         version,
+		ApiVersions:     config.ApiVersions,
+		Label:           dockerfile.VersionLabel + "=" + dockerfile.VersionLabelValue,
+		Buildkit:        "unknown",
+		GoVersion:       runtime.Version(),
+		Platform:        runtime.GOOS + "/" + runtime.GOARCH,
+		FrontendOptions: microbllb.FrontendOptions(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = build.Main.Version
+		}
+		for _, dep := range build.Deps {
+			if dep.Path == "github.com/moby/buildkit" {
+				info.Buildkit = dep.Version
+				if dep.Replace != nil {
+					info.Buildkit = dep.Replace.Version
+				}
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	return info
+}
+
+// versionCommand prints the version of the binary and the capabilities of the frontend
+func versionCommand(flags *flag.FlagSet) func() int {
+	var format string
+	flags.StringVar(&format, "format", "text", "output format, either text or json")
+	return func() int {
+		info := newVersionInfo()
+		switch format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(info); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		case "text":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "Version:\t%s\n", info.Version)
+			fmt.Fprintf(w, "Api versions:\t%s\n", strings.Join(info.ApiVersions, ", "))
+			fmt.Fprintf(w, "Label:\t%s\n", info.Label)
+			fmt.Fprintf(w, "Buildkit:\t%s\n", info.Buildkit)
+			fmt.Fprintf(w, "Go version:\t%s\n", info.GoVersion)
+			fmt.Fprintf(w, "Platform:\t%s\n", info.Platform)
+			fmt.Fprintf(w, "Frontend options:\t%s\n", strings.Join(info.FrontendOptions, ", "))
+			if err := w.Flush(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "unknown format %s\n", format)
+			return 2
+		}
+		return 0
+	}
+}
@@ -0,0 +1,13 @@
+package config
+
+// ApiVersions are the api versions supported by the frontend
+var ApiVersions = []string{"v1"}
+
+func ApiVersion(version string) (string, bool) {
+	switch version {
+	case "v1", "":
+		return "v1", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,14 @@
+package config
+
+// CacheSharing returns the sharing mode of the cache mounts of the package managers, locked by
+// default since apt and apk need exclusive access to their data
+func CacheSharing(sharing string) (string, bool) {
+	switch sharing {
+	case "locked", "shared", "private":
+		return sharing, true
+	case "":
+		return "locked", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Cleanup configures the clean up of the python dependencies installed in the build stage, which
+// removes the tests directories, the debug symbols of the shared libraries and the bytecode
+type Cleanup struct {
+	KeepTests        bool     `toml:"keep_tests"`
+	KeepDebugSymbols bool     `toml:"keep_debug_symbols"`
+	KeepBytecode     bool     `toml:"keep_bytecode"`
+	Exclude          []string `toml:"exclude"`
+}
+
+// importNameRegex matches the directory of a package in site-packages, which is its import name
+var importNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateCleanup checks that the excluded packages are import names, e.g. yaml for pyyaml
+func validateCleanup(c *Cleanup) error {
+	for _, name := range c.Exclude {
+		if !importNameRegex.MatchString(name) {
+			return fmt.Errorf("excluded package %s is not an import name", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package config
+
+func Compression(compression string) (string, bool) {
+	switch compression {
+	case "gzip", "zstd", "estargz", "uncompressed":
+		return compression, true
+	case "":
+		return compression, true
+	default:
+		return "", false
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"path"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -13,9 +14,14 @@ import (
 type Options struct {
 	Filename          string
 	Target            string
+	ContextDir        string
 	BuildArgs         map[string]string
 	ReadRequirements  func(name string) ([]string, error)
-	ReadPythonVersion func() string
+	ReadPythonVersion func(dir string) string
+	PathExists        func(name string) bool
+	ReadFile          func(name string) ([]byte, error)
+	// Python versions resolved from requires-python, which take precedence over [tool.microb] python_versions
+	PythonVersions []string
 }
 
 // NewConfigFromFile creates a new Config from a file path and a target.
@@ -32,37 +38,94 @@ func NewConfigFromFile(path string, options *Options) (*Config, error) {
 func NewConfigFromBytes(data []byte, options *Options) (*Config, error) {
 	var pyproject PyProject
 	// Start by decoding the pyproject.toml file
-	_, err := toml.Decode(string(data), &pyproject)
+	meta, err := toml.Decode(string(data), &pyproject)
 	if err != nil {
 		return nil, fmt.Errorf("NewConfigFromBytes: failed to decode pyproject.toml content: %w", err)
 	}
+	// Keys of the microb section which are not known are most likely typos,
+	// they are rejected so that the configuration is never silently ignored.
+	// Only the keys of the target being built are checked.
+	selectedTarget := options.Target
+	if selectedTarget == "" {
+		selectedTarget, _ = defaultTarget(&meta)
+	}
+	if keys := unknownMicrobKeys(&meta, selectedTarget); len(keys) > 0 {
+		return nil, &KeyError{Key: keys[0], err: fmt.Errorf("NewConfigFromBytes: unknown keys in pyproject.toml: %s", joinKeys(keys))}
+	}
+	pyproject.Tool.Poetry.fillProject(&pyproject.Project)
 	// Get the constraints on Python versions by the project
-	requiresPython := pyproject.Project.RequiresPython
-	// If we're using poetry, we need to check the python version constraints from there
-	if pyproject.Tool.Poetry.Name != "" {
-		requiresPython = pyproject.Tool.Poetry.PythonRequires()
+	requiresPython := projectRequiresPython(&pyproject)
+	// Python versions resolved from requires-python, the newest first
+	allowedPythonVersions := pyproject.Tool.Microb.PythonVersions
+	if len(options.PythonVersions) > 0 {
+		allowedPythonVersions = options.PythonVersions
+	}
+	if _, err := sortedPythonVersions(allowedPythonVersions); err != nil {
+		return nil, &KeyError{Key: toml.Key{"tool", "microb", "python_versions"}, err: fmt.Errorf("NewConfigFromBytes: %w", err)}
 	}
 	target := options.Target
 	// If no target is specified
 	if target == "" {
 		// Look for the first target in the microb config
-		defaultTarget, ok := defaultTarget(&pyproject.Tool.Microb)
+		defaultTarget, ok := defaultTarget(&meta)
 		// If there is still no target found, use default values
 		if !ok {
-			pythonVersion, err := GetPythonVersion(requiresPython, options.ReadPythonVersion())
+			pythonVersion, err := GetPythonVersion(requiresPython, options.ReadPythonVersion(options.ContextDir), allowedPythonVersions)
+			if err != nil {
+				return nil, err
+			}
+			err = readDynamicDependencies(&pyproject, func(name string) ([]string, error) {
+				return options.ReadRequirements(path.Join(options.ContextDir, name))
+			})
+			if err != nil {
+				return nil, err
+			}
+			dependencies, err := getPythonDeps(&pyproject, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			dependencies, err = applyUvSources(dependencies, pyproject.Tool.Uv.Sources, options.ContextDir, func(name string) (string, error) {
+				return findWorkspaceMember(&pyproject.Tool.Uv.Workspace, name, options.ContextDir, options.ReadFile, options.PathExists)
+			})
+			if err != nil {
+				return nil, err
+			}
+			dependencies, localDependencies, err := splitLocalDependencies(dependencies, options.ContextDir)
+			if err != nil {
+				return nil, err
+			}
+			dependenciesUseSsh := isUsingSsh(dependencies)
+			dependenciesUseGit := isUsingGit(dependencies)
+			user, uid, gid, home, err := RuntimeUser(&MicrobTarget{})
+			if err != nil {
+				return nil, err
+			}
+			entrypoint, err := getEntrypoint(&pyproject, &MicrobTarget{})
 			if err != nil {
 				return nil, err
 			}
-			dependenciesUseSsh := isUsingSsh(pyproject.Project.Dependencies)
-			dependenciesUseGit := isUsingGit(pyproject.Project.Dependencies)
 			return &Config{
-				Flavor:             DefaultFlavor(),
-				Name:               pyproject.Project.Name,
-				Authors:            pyproject.Project.Authors,
-				PythonVersion:      pythonVersion,
-				Dependencies:       pyproject.Project.Dependencies,
-				DependenciesUseSsh: dependenciesUseSsh,
-				DependenciesUseGit: dependenciesUseGit,
+				Flavor:              DefaultFlavor(),
+				Name:                pyproject.Project.Name,
+				Authors:             pyproject.Project.Authors,
+				Description:         pyproject.Project.Description,
+				Version:             pyproject.Project.Version,
+				License:             pyproject.Project.License.Text,
+				Urls:                pyproject.Project.Urls,
+				PythonVersion:       pythonVersion,
+				Entrypoint:          entrypoint,
+				Dependencies:        dependencies,
+				LocalDependencies:   localDependencies,
+				DependenciesUseSsh:  dependenciesUseSsh,
+				DependenciesUseGit:  dependenciesUseGit,
+				PoetryBuildBackend:  poetryBuildBackend(&pyproject),
+				User:                user,
+				Uid:                 uid,
+				Gid:                 gid,
+				Home:                home,
+				Prefix:              home + "/.local",
+				PackageCacheSharing: "locked",
+				ContextDir:          options.ContextDir,
 			}, nil
 			// Else use the first target found
 		} else {
@@ -72,64 +135,375 @@ func NewConfigFromBytes(data []byte, options *Options) (*Config, error) {
 	// Get the target config
 	targetConfig, ok := pyproject.Tool.Microb.Target[target]
 	if !ok {
-		return nil, fmt.Errorf("NewConfigFromBytes: target %s not found in pyproject.toml", target)
+		return nil, &KeyError{Key: toml.Key{"tool", "microb", "target"}, err: fmt.Errorf("NewConfigFromBytes: target %s not found in pyproject.toml", target)}
+	}
+	// Validate the api version
+	if _, ok := ApiVersion(targetConfig.ApiVersion); !ok {
+		return nil, targetKeyError(target, "api_version", "NewConfigFromBytes: target %s uses unknown api version %s", target, targetConfig.ApiVersion)
 	}
 	// Validate the build flavor
-	targetConfig.Flavor, ok = Flavor(targetConfig.Flavor)
+	flavor, ok := Flavor(targetConfig.Flavor)
+	if !ok {
+		return nil, targetKeyError(target, "flavor", "NewConfigFromBytes: target %s uses unknown flavor %s", target, targetConfig.Flavor)
+	}
+	targetConfig.Flavor = flavor
+	// Validate the layers compression
+	compression, ok := Compression(targetConfig.Compression)
+	if !ok {
+		return nil, targetKeyError(target, "compression", "NewConfigFromBytes: target %s uses unknown compression %s", target, targetConfig.Compression)
+	}
+	targetConfig.Compression = compression
+	// Validate the network mode
+	network, ok := Network(targetConfig.Network)
+	if !ok {
+		return nil, targetKeyError(target, "network", "NewConfigFromBytes: target %s uses unknown network mode %s", target, targetConfig.Network)
+	}
+	targetConfig.Network = network
+	sharing, ok := CacheSharing(targetConfig.PackageCacheSharing)
 	if !ok {
-		return nil, fmt.Errorf("NewConfigFromBytes: target %s uses unknown flavor %s", target, targetConfig.Flavor)
+		return nil, targetKeyError(target, "package_cache_sharing", "NewConfigFromBytes: target %s uses unknown cache sharing mode %s", target, targetConfig.PackageCacheSharing)
+	}
+	targetConfig.PackageCacheSharing = sharing
+	// Apt options are only supported by the debian flavor
+	if targetConfig.Flavor != "debian" && (targetConfig.AptMirror != "" || targetConfig.AptProxy != "" || targetConfig.AptSnapshot != "" || len(targetConfig.AptRepositories) > 0) {
+		return nil, targetKeyError(target, "flavor", "NewConfigFromBytes: target %s uses apt options with flavor %s", target, targetConfig.Flavor)
+	}
+	// Apk options are only supported by the alpine flavor
+	if targetConfig.Flavor != "alpine" && len(targetConfig.ApkRepositories) > 0 {
+		return nil, targetKeyError(target, "apk_repositories", "NewConfigFromBytes: target %s uses apk options with flavor %s", target, targetConfig.Flavor)
+	}
+	for _, repository := range targetConfig.AptRepositories {
+		if repository.Url == "" || repository.Suite == "" {
+			return nil, targetKeyError(target, "apt_repositories", "NewConfigFromBytes: target %s uses apt repository without url or suite", target)
+		}
+		if repository.KeyUrl != "" && repository.KeySecret != "" {
+			return nil, targetKeyError(target, "apt_repositories", "NewConfigFromBytes: target %s uses apt repository %s with both key_url and key_secret", target, repository.Url)
+		}
+	}
+	// Validate the ports and the healthcheck of the final image
+	for _, port := range targetConfig.Expose {
+		if !ExposedPort(port) {
+			return nil, targetKeyError(target, "expose", "NewConfigFromBytes: target %s exposes invalid port %s", target, port)
+		}
+	}
+	if err := validateCleanup(&targetConfig.Cleanup); err != nil {
+		return nil, targetKeyError(target, "cleanup", "NewConfigFromBytes: target %s uses invalid cleanup: %w", target, err)
+	}
+	if targetConfig.Healthcheck != nil {
+		if err := validateHealthcheck(targetConfig.Healthcheck); err != nil {
+			return nil, targetKeyError(target, "healthcheck", "NewConfigFromBytes: target %s uses invalid healthcheck: %w", target, err)
+		}
+	}
+	// Validate the placeholders of the image name
+	if err := ImageTemplate(targetConfig.Image); err != nil {
+		return nil, targetKeyError(target, "image", "NewConfigFromBytes: target %s uses invalid image %s: %w", target, targetConfig.Image, err)
+	}
+	// Validate the digests of the base images
+	for key, digest := range map[string]string{"builder_image_digest": targetConfig.BuilderImageDigest, "final_image_digest": targetConfig.FinalImageDigest} {
+		if !ImageDigest(digest) {
+			return nil, targetKeyError(target, key, "NewConfigFromBytes: target %s uses invalid image digest %s", target, digest)
+		}
+	}
+	if !AptSnapshot(targetConfig.AptSnapshot) {
+		return nil, targetKeyError(target, "apt_snapshot", "NewConfigFromBytes: target %s uses invalid apt snapshot %s", target, targetConfig.AptSnapshot)
+	}
+	if targetConfig.AptSnapshot != "" && targetConfig.AptMirror != "" {
+		return nil, targetKeyError(target, "apt_snapshot", "NewConfigFromBytes: target %s can not use both apt_mirror and apt_snapshot", target)
+	}
+	// Validate the build and system dependencies
+	for _, depsKey := range []string{"build_deps", "system_deps"} {
+		packages := targetConfig.BuildDeps
+		if depsKey == "system_deps" {
+			packages = targetConfig.SystemDeps
+		}
+		for _, key := range packages.Flavors() {
+			if _, ok := Flavor(key); !ok || key == "" {
+				return nil, targetKeyError(target, depsKey+"."+key, "NewConfigFromBytes: target %s declares dependencies for unknown flavor %s", target, key)
+			}
+		}
+		for _, dep := range packages.ForFlavor(targetConfig.Flavor) {
+			if !SystemPackage(targetConfig.Flavor, dep) {
+				return nil, targetKeyError(target, depsKey, "NewConfigFromBytes: target %s uses invalid %s package %s", target, targetConfig.Flavor, dep)
+			}
+		}
+	}
+	targetBuildDeps := targetConfig.BuildDeps.ForFlavor(targetConfig.Flavor)
+	targetSystemDeps := targetConfig.SystemDeps.ForFlavor(targetConfig.Flavor)
+	for _, name := range nativeBuildDepsNames(targetConfig.NativeBuildDeps) {
+		packages := targetConfig.NativeBuildDeps[name]
+		for _, key := range packages.Flavors() {
+			if _, ok := Flavor(key); !ok || key == "" {
+				return nil, targetKeyError(target, "native_build_deps", "NewConfigFromBytes: target %s declares native build dependencies of %s for unknown flavor %s", target, name, key)
+			}
+		}
+		for _, dep := range packages.ForFlavor(targetConfig.Flavor) {
+			if !SystemPackage(targetConfig.Flavor, dep) {
+				return nil, targetKeyError(target, "native_build_deps", "NewConfigFromBytes: target %s uses invalid %s package %s for %s", target, targetConfig.Flavor, dep, name)
+			}
+		}
+	}
+	// Only a single index can replace the default index
+	primaryIndices := 0
+	for _, index := range targetConfig.Indices {
+		for _, indexUrl := range append([]string{index.Url}, index.Mirrors...) {
+			if !IndexUrl(indexUrl) {
+				return nil, targetKeyError(target, "indices", "NewConfigFromBytes: target %s uses malformed index url %s", target, indexUrl)
+			}
+		}
+		if index.Primary {
+			primaryIndices++
+		}
+	}
+	if primaryIndices > 1 {
+		return nil, targetKeyError(target, "indices", "NewConfigFromBytes: target %s declares %d primary indices, at most one is allowed", target, primaryIndices)
+	}
+	// Annotation keys are used in exporter options, which can not contain whitespaces
+	for key := range targetConfig.Annotations {
+		if key == "" || strings.ContainsAny(key, " \t\n") {
+			return nil, targetKeyError(target, "annotations", "NewConfigFromBytes: target %s uses invalid annotation key %q", target, key)
+		}
+	}
+	// The wheelhouse replaces the indices, and is located in the context directory unless
+	// it is read from a named context, whose root is used by default
+	if targetConfig.Wheelhouse != "" || targetConfig.WheelhouseFrom != "" {
+		if len(targetConfig.Indices) > 0 {
+			return nil, targetKeyError(target, "wheelhouse", "NewConfigFromBytes: target %s can not use both indices and a wheelhouse", target)
+		}
+		if path.IsAbs(targetConfig.Wheelhouse) || strings.HasPrefix(path.Clean(targetConfig.Wheelhouse), "..") {
+			return nil, targetKeyError(target, "wheelhouse", "NewConfigFromBytes: target %s uses wheelhouse %s outside of the context directory", target, targetConfig.Wheelhouse)
+		}
+		if targetConfig.Wheelhouse == "" {
+			targetConfig.Wheelhouse = "."
+		}
+	}
+	// Context directory provided in options has precedence over target
+	if options.ContextDir != "" {
+		targetConfig.ContextDir = options.ContextDir
+	}
+	// Targets of a workspace root build one of its members, whose directory is used as project root
+	workspaceRoot := targetConfig.ContextDir
+	if targetConfig.Member != "" {
+		if path.IsAbs(targetConfig.Member) || strings.HasPrefix(path.Clean(targetConfig.Member), "..") {
+			return nil, targetKeyError(target, "member", "NewConfigFromBytes: target %s builds member %s outside of the context directory", target, targetConfig.Member)
+		}
+		if err := readWorkspaceMember(&pyproject, targetConfig.Member, workspaceRoot, options.ReadFile); err != nil {
+			return nil, targetKeyError(target, "member", "NewConfigFromBytes: target %s: %w", target, err)
+		}
+		targetConfig.ContextDir = path.Join(workspaceRoot, targetConfig.Member)
+		requiresPython = projectRequiresPython(&pyproject)
+	}
+	// Detect the project sources unless they are included explicitly
+	if targetConfig.SrcDetect && len(targetConfig.SrcInclude) == 0 {
+		targetConfig.SrcInclude = DetectSources(&pyproject, func(name string) bool {
+			return options.PathExists(path.Join(targetConfig.ContextDir, name))
+		})
+	}
+	// Project sources must be located in the context directory
+	for _, src := range targetConfig.SrcInclude {
+		if path.IsAbs(src) || strings.HasPrefix(path.Clean(src), "..") {
+			return nil, targetKeyError(target, "src_include", "NewConfigFromBytes: target %s includes source %s outside of the context directory", target, src)
+		}
 	}
 	// If no python version is specified, use the default
 	if targetConfig.PythonVersion == "" {
-		targetConfig.PythonVersion = options.ReadPythonVersion()
+		targetConfig.PythonVersion = options.ReadPythonVersion(targetConfig.ContextDir)
 	}
 	// Validate the python version
-	pythonVersion, err := GetPythonVersion(requiresPython, targetConfig.PythonVersion)
+	pythonVersion, err := GetPythonVersion(requiresPython, targetConfig.PythonVersion, allowedPythonVersions)
 	if err != nil {
-		return nil, fmt.Errorf("NewConfigFromBytes: failed to get python verson for target %s: %w", target, err)
+		return nil, targetKeyError(target, "python_version", "NewConfigFromBytes: failed to get python verson for target %s: %w", target, err)
 	}
 	if targetConfig.Requirements != "" && len(targetConfig.Extras) > 0 {
-		return nil, fmt.Errorf("NewConfigFromBytes: failed to validate configuration for taget %s: using requirements is not allowed together with extras", target)
+		return nil, targetKeyError(target, "extras", "NewConfigFromBytes: failed to validate configuration for taget %s: using requirements is not allowed together with extras", target)
 	}
 	// Merge the dependencies with extras if any
-	dependencies, err := getPythonDeps(&pyproject, targetConfig.Extras)
+	if targetConfig.Requirements != "" && len(targetConfig.Groups) > 0 {
+		return nil, targetKeyError(target, "groups", "NewConfigFromBytes: failed to validate configuration for target %s: using requirements is not allowed together with groups", target)
+	}
+	if pyproject.Tool.Poetry.Name == "" && len(targetConfig.Groups) > 0 {
+		return nil, targetKeyError(target, "groups", "NewConfigFromBytes: target %s selects groups, which are only supported for poetry projects", target)
+	}
+	for _, group := range targetConfig.Groups {
+		if !pyproject.Tool.Poetry.HasGroup(group) {
+			return nil, targetKeyError(target, "groups", "NewConfigFromBytes: target %s selects group %s, which is not found in pyproject.toml", target, group)
+		}
+	}
+	err = readDynamicDependencies(&pyproject, func(name string) ([]string, error) {
+		return options.ReadRequirements(path.Join(targetConfig.ContextDir, name))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("NewConfigFromBytes: failed to get dependencies for target %s: %w", target, err)
+		return nil, err
+	}
+	dependencies, err := getPythonDeps(&pyproject, targetConfig.Extras, targetConfig.Groups)
+	if err != nil {
+		return nil, targetKeyError(target, "extras", "NewConfigFromBytes: failed to get dependencies for target %s: %w", target, err)
+	}
+	// Local dependencies, including the members of the workspace, are copied from the build context
+	// and installed before the project, unless dependencies are installed from a requirements file
+	var localDependencies []LocalDependency
+	if targetConfig.Requirements == "" {
+		dependencies, err = applyUvSources(dependencies, pyproject.Tool.Uv.Sources, targetConfig.ContextDir, func(name string) (string, error) {
+			return findWorkspaceMember(&pyproject.Tool.Uv.Workspace, name, workspaceRoot, options.ReadFile, options.PathExists)
+		})
+		if err != nil {
+			return nil, targetKeyError(target, "context_dir", "NewConfigFromBytes: failed to get workspace dependencies for target %s: %w", target, err)
+		}
+		dependencies, localDependencies, err = splitLocalDependencies(dependencies, targetConfig.ContextDir)
+		if err != nil {
+			return nil, targetKeyError(target, "context_dir", "NewConfigFromBytes: failed to get local dependencies for target %s: %w", target, err)
+		}
+	}
+	if targetConfig.CrossCompile && len(localDependencies) > 0 {
+		return nil, targetKeyError(target, "cross_compile", "NewConfigFromBytes: target %s can not cross compile local dependencies, which are built from source", target)
 	}
 	dependenciesUseSsh := false
 	dependenciesUseGit := false
+	pythonDeps := dependencies
+	var requirementsFiles []string
 	if targetConfig.Requirements != "" {
-		reqs, err := options.ReadRequirements(targetConfig.Requirements)
+		var reqs []string
+		reqs, requirementsFiles, err = ParseRequirementsFile(targetConfig.Requirements, func(name string) ([]string, error) {
+			return options.ReadRequirements(path.Join(targetConfig.ContextDir, name))
+		})
 		if err != nil {
-			return nil, fmt.Errorf("NewConfigFromBytes: failed to get requirements for target %s: %w", target, err)
+			return nil, targetKeyError(target, "requirements", "NewConfigFromBytes: failed to get requirements for target %s: %w", target, err)
 		}
 		dependenciesUseSsh = isUsingSsh(reqs)
 		dependenciesUseGit = isUsingGit(reqs)
+		pythonDeps = reqs
 	} else {
 		dependenciesUseSsh = isUsingSsh(dependencies)
 		dependenciesUseGit = isUsingGit(dependencies)
 	}
-	buildDeps := getBuildDeps(targetConfig.Indices, targetConfig.BuildDeps, dependenciesUseSsh, dependenciesUseGit)
+	// Cross compiled dependencies are only installed from wheels, which git repositories do not provide
+	if targetConfig.CrossCompile && dependenciesUseGit {
+		return nil, targetKeyError(target, "cross_compile", "NewConfigFromBytes: target %s can not cross compile dependencies installed from git repositories", target)
+	}
+	user, uid, gid, home, err := RuntimeUser(&targetConfig)
+	if err != nil {
+		return nil, targetKeyError(target, "user", "NewConfigFromBytes: failed to validate runtime user for target %s: %w", target, err)
+	}
+	if targetConfig.Optimize < 0 || targetConfig.Optimize > 2 {
+		return nil, targetKeyError(target, "optimize", "NewConfigFromBytes: target %s uses optimize %d, which must be 0, 1 or 2", target, targetConfig.Optimize)
+	}
+	// Dependencies and the project are installed in the .local directory of the home directory by default
+	prefix := home + "/.local"
+	if targetConfig.Prefix != "" {
+		if !path.IsAbs(targetConfig.Prefix) || path.Clean(targetConfig.Prefix) == "/" {
+			return nil, targetKeyError(target, "prefix", "NewConfigFromBytes: target %s uses prefix %s, which must be an absolute path other than /", target, targetConfig.Prefix)
+		}
+		prefix = path.Clean(targetConfig.Prefix)
+	}
+	entrypoint, err := getEntrypoint(&pyproject, &targetConfig)
+	if err != nil {
+		return nil, targetKeyError(target, "entrypoint", "NewConfigFromBytes: failed to get entrypoint for target %s: %w", target, err)
+	}
+	// Add the system packages required to build well-known python dependencies,
+	// unless dependencies are installed from the wheels of a hermetic build
+	if !targetConfig.DisableAutoBuildDeps && !targetConfig.Hermetic {
+		targetBuildDeps = append(targetBuildDeps, NativeBuildDeps(pythonDeps, targetConfig.NativeBuildDeps, targetConfig.Flavor)...)
+	}
+	if !RustToolchain(targetConfig.RustToolchain) {
+		return nil, targetKeyError(target, "rust_toolchain", "NewConfigFromBytes: target %s uses invalid rust toolchain %s", target, targetConfig.RustToolchain)
+	}
+	// Rust is installed by rustup, which links with the C compiler of the build stage
+	rustToolchain := detectRustToolchain(targetConfig.RustToolchain, pythonDeps, targetConfig.Flavor, !targetConfig.DisableAutoBuildDeps && !targetConfig.Hermetic)
+	if rustToolchain != "" && targetConfig.Flavor == "alpine" {
+		targetBuildDeps = append(targetBuildDeps, "gcc", "musl-dev")
+	}
+	// Compilers are wrapped by ccache, which is packaged under the same name by both flavors
+	if targetConfig.NativeBuildCache {
+		targetBuildDeps = append(targetBuildDeps, "ccache")
+	}
+	buildDeps := utils.Unique(getBuildDeps(targetConfig.Indices, targetBuildDeps, dependenciesUseSsh, dependenciesUseGit))
+	systemDeps := getSystemDeps(targetSystemDeps, targetConfig.Init)
+	// Hermetic builds never access the network while installing packages
+	if targetConfig.Hermetic {
+		if key, err := hermeticError(&targetConfig, buildDeps, systemDeps, dependenciesUseGit); err != nil {
+			return nil, targetKeyError(target, key, "NewConfigFromBytes: target %s is hermetic: %w", target, err)
+		}
+		targetConfig.Network = "none"
+	}
 	config := Config{
-		Flavor:               targetConfig.Flavor,
-		Name:                 pyproject.Project.Name,
-		Authors:              pyproject.Project.Authors,
-		PythonVersion:        pythonVersion,
-		Entrypoint:           targetConfig.Entrypoint,
-		Command:              targetConfig.Command,
-		Env:                  targetConfig.Env,
-		Labels:               targetConfig.Labels,
-		BuildDeps:            buildDeps,
-		SystemDeps:           targetConfig.SystemDeps,
-		Dependencies:         dependencies,
-		Requirements:         targetConfig.Requirements,
-		DependenciesUseSsh:   dependenciesUseSsh,
-		DependenciesUseGit:   dependenciesUseGit,
-		Indices:              targetConfig.Indices,
-		CopyFiles:            targetConfig.CopyFiles,
-		CopyFilesBeforeBuild: targetConfig.CopyFilesBeforeBuild,
-		AddFiles:             targetConfig.AddFiles,
-		AddFilesBeforeBuild:  targetConfig.AddFilesBeforeBuild,
+		Flavor:                   targetConfig.Flavor,
+		Target:                   target,
+		Name:                     pyproject.Project.Name,
+		Authors:                  pyproject.Project.Authors,
+		Description:              pyproject.Project.Description,
+		Version:                  pyproject.Project.Version,
+		License:                  pyproject.Project.License.Text,
+		Urls:                     pyproject.Project.Urls,
+		PythonVersion:            pythonVersion,
+		Entrypoint:               entrypoint,
+		Command:                  targetConfig.Command,
+		Env:                      targetConfig.Env,
+		Labels:                   targetConfig.Labels,
+		Annotations:              targetConfig.Annotations,
+		Image:                    targetConfig.Image,
+		BuildDeps:                buildDeps,
+		SystemDeps:               systemDeps,
+		Dependencies:             dependencies,
+		LocalDependencies:        localDependencies,
+		Requirements:             targetConfig.Requirements,
+		RequirementsFiles:        requirementsFiles,
+		DependenciesUseSsh:       dependenciesUseSsh,
+		DependenciesUseGit:       dependenciesUseGit,
+		Indices:                  targetConfig.Indices,
+		CopyFiles:                targetConfig.CopyFiles,
+		CopyFilesBeforeBuild:     targetConfig.CopyFilesBeforeBuild,
+		AddFiles:                 targetConfig.AddFiles,
+		AddFilesBeforeBuild:      targetConfig.AddFilesBeforeBuild,
+		Volumes:                  targetConfig.Volumes,
+		StopSignal:               targetConfig.StopSignal,
+		Expose:                   targetConfig.Expose,
+		Healthcheck:              targetConfig.Healthcheck,
+		Shell:                    targetConfig.Shell,
+		User:                     user,
+		Uid:                      uid,
+		Gid:                      gid,
+		Home:                     home,
+		Prefix:                   prefix,
+		RunAsRoot:                targetConfig.RunAsRoot,
+		Init:                     targetConfig.Init,
+		SlimRuntime:              targetConfig.SlimRuntime,
+		CompileBytecode:          targetConfig.CompileBytecode,
+		Optimize:                 targetConfig.Optimize,
+		Cleanup:                  targetConfig.Cleanup,
+		DisableMetadataLabels:    targetConfig.DisableMetadataLabels,
+		Compression:              targetConfig.Compression,
+		OciMediatypes:            targetConfig.OciMediatypes,
+		InlineCache:              targetConfig.InlineCache,
+		CacheId:                  targetConfig.CacheId,
+		Network:                  targetConfig.Network,
+		PackageCacheSharing:      targetConfig.PackageCacheSharing,
+		KeepPackageCache:         targetConfig.KeepPackageCache,
+		NativeBuildCache:         targetConfig.NativeBuildCache,
+		RustToolchain:            rustToolchain,
+		ContextDir:               targetConfig.ContextDir,
+		SrcInclude:               targetConfig.SrcInclude,
+		SrcExclude:               targetConfig.SrcExclude,
+		ProjectBindMount:         targetConfig.ProjectBindMount,
+		PoetryBuildBackend:       poetryBuildBackend(&pyproject),
+		CrossCompile:             targetConfig.CrossCompile,
+		Wheelhouse:               targetConfig.Wheelhouse,
+		WheelhouseFrom:           targetConfig.WheelhouseFrom,
+		BuilderImageDigest:       targetConfig.BuilderImageDigest,
+		FinalImageDigest:         targetConfig.FinalImageDigest,
+		Hermetic:                 targetConfig.Hermetic,
+		IgnoreFile:               targetConfig.IgnoreFile,
+		PipArgs:                  targetConfig.PipArgs,
+		PipConfigSecret:          targetConfig.PipConfigSecret,
+		NetrcSecret:              targetConfig.NetrcSecret,
+		AptMirror:                targetConfig.AptMirror,
+		AptProxy:                 targetConfig.AptProxy,
+		AptSnapshot:              targetConfig.AptSnapshot,
+		AptRepositories:          targetConfig.AptRepositories,
+		ApkRepositories:          targetConfig.ApkRepositories,
+		PreInstall:               targetConfig.PreInstall,
+		PostInstall:              targetConfig.PostInstall,
+		RuntimePostInstall:       targetConfig.RuntimePostInstall,
+		ExtraBuildInstructions:   targetConfig.ExtraBuildInstructions,
+		ExtraRuntimeInstructions: targetConfig.ExtraRuntimeInstructions,
 	}
 	return &config, nil
 }
@@ -138,34 +512,98 @@ func NewConfigFromBytes(data []byte, options *Options) (*Config, error) {
 // A config is obtained from merging information found
 // at the project level and the target level.
 type Config struct {
-	Flavor               string            // Flavor of the build ("debian" or "alpine")
-	Name                 string            // Name of the project
-	Authors              []Author          // Authors of the project
-	PythonVersion        string            // Python version to use
-	Entrypoint           []string          // Default command to run. Arguments provided to the container will be appended to this command.
-	Command              []string          // Command to run when no arguments are provided. Command is concatenated with the entrypoint.
-	Env                  map[string]string // Additional environment variables to add to the final image
-	Labels               map[string]string // Addiional labels to add to the final image
-	BuildDeps            []string          // Build dependencies (not installed in final image)
-	SystemDeps           []string          // System dependencies (not installed during build, only installed in final image)
-	Indices              []Index           // Extra index urls to use
-	Dependencies         []string          // Dependencies to install
-	DependenciesUseSsh   bool              // Whether ssh is required to install dependencies or not
-	DependenciesUseGit   bool              // Whether git is required to install dependencies or not
-	Requirements         string            // Path to requirements file
-	CopyFiles            []Copy            // Files to copy to the final image
-	CopyFilesBeforeBuild []Copy            // Files to copy to the build context before building
-	AddFiles             []Add             // Files to add to the final image
-	AddFilesBeforeBuild  []Add             // Files to add to the build context before building
+	Flavor                   string            // Flavor of the build ("debian" or "alpine")
+	Target                   string            // Name of the target
+	Name                     string            // Name of the project
+	Authors                  []Author          // Authors of the project
+	Description              string            // Description of the project
+	Version                  string            // Version of the project
+	License                  string            // License of the project
+	Urls                     map[string]string // Urls of the project
+	PythonVersion            string            // Python version to use
+	Entrypoint               []string          // Default command to run. Arguments provided to the container will be appended to this command.
+	Command                  []string          // Command to run when no arguments are provided. Command is concatenated with the entrypoint.
+	Env                      map[string]string // Additional environment variables to add to the final image
+	Labels                   map[string]string // Addiional labels to add to the final image
+	Annotations              map[string]string // Annotations of the manifests and of the index of the exported image
+	Image                    string            // Name of the image, with placeholders, see ImageName
+	BuildDeps                []string          // Build dependencies (not installed in final image)
+	SystemDeps               []string          // System dependencies (not installed during build, only installed in final image)
+	Indices                  []Index           // Extra index urls to use
+	Dependencies             []string          // Dependencies to install
+	LocalDependencies        []LocalDependency // Dependencies installed from the build context before the project
+	DependenciesUseSsh       bool              // Whether ssh is required to install dependencies or not
+	DependenciesUseGit       bool              // Whether git is required to install dependencies or not
+	Requirements             string            // Path to requirements file
+	RequirementsFiles        []string          // Paths of the requirements file and of the files it references
+	CopyFiles                []Copy            // Files to copy to the final image
+	CopyFilesBeforeBuild     []Copy            // Files to copy to the build context before building
+	AddFiles                 []Add             // Files to add to the final image
+	AddFilesBeforeBuild      []Add             // Files to add to the build context before building
+	Volumes                  []string          // Paths to declare as volumes in the final image
+	StopSignal               string            // Signal sent to the container to stop it
+	Expose                   []string          // Ports exposed by the final image
+	Healthcheck              *Healthcheck      // Command checking the health of the containers of the final image
+	Shell                    []string          // Shell used for the shell form of commands in the final image
+	User                     string            // Name of the user running the final image
+	Uid                      int               // UID of the user running the final image
+	Gid                      int               // GID of the user running the final image
+	Home                     string            // Home directory of the user running the final image
+	Prefix                   string            // Directory where dependencies and the project are installed in the final image
+	RunAsRoot                bool              // Whether the final image runs as root or not
+	Init                     bool              // Whether tini is used as init process in the final image or not
+	SlimRuntime              bool              // Whether pip, setuptools and wheel are removed from the final image or not
+	CompileBytecode          bool              // Whether installed packages are compiled to bytecode in the build stage or not
+	Optimize                 int               // Optimization level of the bytecode, as set by PYTHONOPTIMIZE in the final image
+	Cleanup                  Cleanup           // Clean up of the installed python dependencies
+	DisableMetadataLabels    bool              // Whether labels are populated from project metadata or not
+	Compression              string            // Compression used for the layers of the exported image
+	OciMediatypes            bool              // Whether OCI media types are used for the exported image or not
+	InlineCache              bool              // Whether cache metadata is embedded into the exported image or not
+	CacheId                  string            // Prefix of the ids of the cache mounts used during build
+	Network                  string            // Network mode used to install python dependencies and project
+	PackageCacheSharing      string            // Sharing mode of the cache mounts of apt and apk in the build stage
+	KeepPackageCache         bool              // Whether apt and apk keep the downloaded packages in their cache mounts or not
+	NativeBuildCache         bool              // Whether native extensions are compiled with ccache and a cache mount or not
+	RustToolchain            string            // Rust toolchain installed by rustup in the build stage, none when empty
+	ContextDir               string            // Directory of the build context used as project root
+	SrcInclude               []string          // Paths of the project sources copied into the build stage
+	SrcExclude               []string          // Patterns of the files excluded from the build context
+	ProjectBindMount         bool              // Bind mount the project sources instead of copying them
+	PoetryBuildBackend       bool              // Declare poetry-core as build backend of a poetry project without build system
+	CrossCompile             bool              // Install the wheels of the target platform from the build platform
+	Wheelhouse               string            // Path of the directory of wheels python dependencies are installed from
+	WheelhouseFrom           string            // Named context or image containing the wheelhouse instead of the build context
+	BuilderImageDigest       string            // Digest pinning the base image of the build stage
+	FinalImageDigest         string            // Digest pinning the base image of the final stage
+	Hermetic                 bool              // Whether the build must not access the network or not
+	IgnoreFile               string            // Path of the ignore file used to exclude files from the build context
+	PipArgs                  []string          // Additional arguments of the pip install commands
+	PipConfigSecret          string            // Id of the secret mounted as pip configuration file
+	NetrcSecret              string            // Id of the secret mounted as netrc file
+	AptMirror                string            // Url of the debian mirror used by apt
+	AptProxy                 string            // Url of the proxy used by apt
+	AptSnapshot              string            // Timestamp of the debian snapshot used by apt
+	AptRepositories          []AptRepository   // Additional apt repositories used to install build and system dependencies
+	ApkRepositories          []string          // Additional apk repositories used to install build and system dependencies
+	PreInstall               []string          // Commands run in the build stage before installing python dependencies
+	PostInstall              []string          // Commands run in the build stage after installing the project
+	RuntimePostInstall       []string          // Commands run as root in the final stage after copying files
+	ExtraBuildInstructions   string            // Raw Dockerfile instructions inserted in the build stage
+	ExtraRuntimeInstructions string            // Raw Dockerfile instructions inserted in the final stage
 }
 
 // Copy is a struct that represents a file copy operation.
 // From is optional and can be used to specify a source outside of the build context.
 // When From is omitted, the source is assumed to be a file or directory in the build context.
+// Link, Chmod and Chown are optional and map to the COPY flags of the same name.
 type Copy struct {
 	From        string `toml:"from"`
 	Source      string `toml:"src"`
 	Destination string `toml:"dst"`
+	Link        bool   `toml:"link"`
+	Chmod       string `toml:"chmod"`
+	Chown       string `toml:"chown"`
 }
 
 // Add is a struct that represents a file add operation.
@@ -176,22 +614,44 @@ type Add struct {
 	Destination string `toml:"dst"`
 }
 
+// AptRepository is a struct that represents an additional apt repository.
+// The repository is signed by a key downloaded from KeyUrl or provided as the secret KeySecret.
+// When neither KeyUrl nor KeySecret is set, the repository must be signed by a key trusted by the image.
+type AptRepository struct {
+	Url        string   `toml:"url"`
+	Suite      string   `toml:"suite"`
+	Components []string `toml:"components"`
+	KeyUrl     string   `toml:"key_url"`
+	KeySecret  string   `toml:"key_secret"`
+}
+
 // Index is a struct that represents a package index.
 // Trust is optional and can be used to skip certificate verification.
 // It is not recommended to use trust unless you are sure the index is owned by you or a trusted party.
+// Primary is optional and can be used to replace the default index (pypi.org).
+// Mirrors are optional urls serving the same packages, using the same credentials.
 type Index struct {
-	Url            string `toml:"url"`
-	Username       string `toml:"username"`
-	UsernameSecret string `toml:"username_secret"`
-	Password       string `toml:"password"`
-	PasswordSecret string `toml:"password_secret"`
-	Trust          bool   `toml:"trust"`
+	Url            string   `toml:"url"`
+	Username       string   `toml:"username"`
+	UsernameSecret string   `toml:"username_secret"`
+	Password       string   `toml:"password"`
+	PasswordSecret string   `toml:"password_secret"`
+	Trust          bool     `toml:"trust"`
+	Primary        bool     `toml:"primary"`
+	Mirrors        []string `toml:"mirrors"`
 }
 
 // PyProject is a struct that represents a pyproject.toml file (partially)
 type PyProject struct {
-	Project Project `toml:"project"`
-	Tool    Tool    `toml:"tool"`
+	Project     Project     `toml:"project"`
+	BuildSystem BuildSystem `toml:"build-system"`
+	Tool        Tool        `toml:"tool"`
+}
+
+// BuildSystem is the build system used to install the project
+type BuildSystem struct {
+	Requires     []string `toml:"requires"`
+	BuildBackend string   `toml:"build-backend"`
 }
 
 // Project is a struct that represents a project section in a pyproject.toml file.
@@ -201,8 +661,41 @@ type Project struct {
 	Dependencies         []string            `toml:"dependencies"`
 	OptionalDependencies map[string][]string `toml:"optional-dependencies"`
 	RequiresPython       string              `toml:"requires-python"`
+	Scripts              map[string]string   `toml:"scripts"`
+	Dynamic              []string            `toml:"dynamic"`
+	Description          string              `toml:"description"`
+	Version              string              `toml:"version"`
+	License              License             `toml:"license"`
+	Readme               Readme              `toml:"readme"`
+	Urls                 map[string]string   `toml:"urls"`
+}
+
+// License is a struct that represents the license of a project.
+// License can be declared either as a SPDX expression or as a table with a text or file key.
+type License struct {
+	Text string `toml:"text"`
+	File string `toml:"file"`
+}
+
+func (l *License) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		l.Text = v
+	case map[string]interface{}:
+		if text, ok := v["text"].(string); ok {
+			l.Text = text
+		}
+		if file, ok := v["file"].(string); ok {
+			l.File = file
+		}
+	default:
+		return fmt.Errorf("expected string or map, got %T", value)
+	}
+	return nil
 }
 
+var _ toml.Unmarshaler = (*License)(nil)
+
 // Author is a struct that represents an author found in a pyproject.toml file.
 type Author struct {
 	Name  string `toml:"name"`
@@ -212,34 +705,96 @@ type Author struct {
 // Tool is a struct that represents a tool section in a pyproject.toml file.
 // It only contains the microb section and is not a complete representation of the file.
 type Tool struct {
-	Microb Microb `toml:"microb"`
-	Poetry Poetry `toml:"poetry"`
+	Microb     Microb     `toml:"microb"`
+	Poetry     Poetry     `toml:"poetry"`
+	Setuptools Setuptools `toml:"setuptools"`
+	Uv         Uv         `toml:"uv"`
 }
 
 // Microb is a struct that represents a microb section in a pyproject.toml file.
-// For now, it only contains a map of targets.
+// It contains a map of targets, and the python versions resolved from requires-python.
 type Microb struct {
-	Target map[string]MicrobTarget `toml:"target"`
+	Target         map[string]MicrobTarget `toml:"target"`
+	PythonVersions []string                `toml:"python_versions"`
 }
 
 // MicrobTarget is a struct that represents a build target.
 // All fields are optional and will be filled with default values if omitted.
 type MicrobTarget struct {
-	Flavor               string            `toml:"flavor"`
-	Entrypoint           []string          `toml:"entrypoint"`
-	Command              []string          `toml:"command"`
-	PythonVersion        string            `toml:"python_version"`
-	Requirements         string            `toml:"requirements"`
-	Indices              []Index           `toml:"indices"`
-	Extras               []string          `toml:"extras"`
-	Env                  map[string]string `toml:"environment"`
-	Labels               map[string]string `toml:"labels"`
-	BuildDeps            []string          `toml:"build_deps"`
-	SystemDeps           []string          `toml:"system_deps"`
-	CopyFiles            []Copy            `toml:"copy_files"`
-	CopyFilesBeforeBuild []Copy            `toml:"copy_files_before_build"`
-	AddFiles             []Add             `toml:"add_files"`
-	AddFilesBeforeBuild  []Add             `toml:"add_files_before_build"`
+	ApiVersion               string              `toml:"api_version"`
+	Flavor                   string              `toml:"flavor"`
+	Entrypoint               []string            `toml:"entrypoint"`
+	Command                  []string            `toml:"command"`
+	PythonVersion            string              `toml:"python_version"`
+	Requirements             string              `toml:"requirements"`
+	Indices                  []Index             `toml:"indices"`
+	Extras                   []string            `toml:"extras"`
+	Groups                   []string            `toml:"groups"`
+	Env                      map[string]string   `toml:"environment"`
+	Labels                   map[string]string   `toml:"labels"`
+	Annotations              map[string]string   `toml:"annotations"`
+	Image                    string              `toml:"image"`
+	BuildDeps                Packages            `toml:"build_deps"`
+	SystemDeps               Packages            `toml:"system_deps"`
+	CopyFiles                []Copy              `toml:"copy_files"`
+	CopyFilesBeforeBuild     []Copy              `toml:"copy_files_before_build"`
+	AddFiles                 []Add               `toml:"add_files"`
+	AddFilesBeforeBuild      []Add               `toml:"add_files_before_build"`
+	Volumes                  []string            `toml:"volumes"`
+	StopSignal               string              `toml:"stop_signal"`
+	Expose                   []string            `toml:"expose"`
+	Healthcheck              *Healthcheck        `toml:"healthcheck"`
+	Shell                    []string            `toml:"shell"`
+	User                     string              `toml:"user"`
+	Uid                      *int                `toml:"uid"`
+	Gid                      *int                `toml:"gid"`
+	Home                     string              `toml:"home"`
+	Prefix                   string              `toml:"prefix"`
+	RunAsRoot                bool                `toml:"run_as_root"`
+	Init                     bool                `toml:"init"`
+	SlimRuntime              bool                `toml:"slim_runtime"`
+	CompileBytecode          bool                `toml:"compile_bytecode"`
+	Optimize                 int                 `toml:"optimize"`
+	Cleanup                  Cleanup             `toml:"cleanup"`
+	EntrypointScript         string              `toml:"entrypoint_script"`
+	DisableMetadataLabels    bool                `toml:"disable_metadata_labels"`
+	Compression              string              `toml:"compression"`
+	OciMediatypes            bool                `toml:"oci_mediatypes"`
+	InlineCache              bool                `toml:"inline_cache"`
+	CacheId                  string              `toml:"cache_id"`
+	Network                  string              `toml:"network"`
+	PackageCacheSharing      string              `toml:"package_cache_sharing"`
+	KeepPackageCache         bool                `toml:"keep_package_cache"`
+	NativeBuildCache         bool                `toml:"native_build_cache"`
+	RustToolchain            string              `toml:"rust_toolchain"`
+	ContextDir               string              `toml:"context_dir"`
+	Member                   string              `toml:"member"`
+	SrcInclude               []string            `toml:"src_include"`
+	SrcExclude               []string            `toml:"src_exclude"`
+	SrcDetect                bool                `toml:"src_detect"`
+	ProjectBindMount         bool                `toml:"project_bind_mount"`
+	CrossCompile             bool                `toml:"cross_compile"`
+	Wheelhouse               string              `toml:"wheelhouse"`
+	WheelhouseFrom           string              `toml:"wheelhouse_from"`
+	BuilderImageDigest       string              `toml:"builder_image_digest"`
+	FinalImageDigest         string              `toml:"final_image_digest"`
+	Hermetic                 bool                `toml:"hermetic"`
+	IgnoreFile               string              `toml:"ignore_file"`
+	PipArgs                  []string            `toml:"pip_args"`
+	PipConfigSecret          string              `toml:"pip_config_secret"`
+	NetrcSecret              string              `toml:"netrc_secret"`
+	AptMirror                string              `toml:"apt_mirror"`
+	AptProxy                 string              `toml:"apt_proxy"`
+	AptSnapshot              string              `toml:"apt_snapshot"`
+	AptRepositories          []AptRepository     `toml:"apt_repositories"`
+	ApkRepositories          []string            `toml:"apk_repositories"`
+	NativeBuildDeps          map[string]Packages `toml:"native_build_deps"`
+	DisableAutoBuildDeps     bool                `toml:"disable_auto_build_deps"`
+	PreInstall               []string            `toml:"pre_install"`
+	PostInstall              []string            `toml:"post_install"`
+	RuntimePostInstall       []string            `toml:"runtime_post_install"`
+	ExtraBuildInstructions   string              `toml:"extra_build_instructions"`
+	ExtraRuntimeInstructions string              `toml:"extra_runtime_instructions"`
 }
 
 func getBuildDeps(
@@ -271,16 +826,74 @@ func getBuildDeps(
 	return deps
 }
 
-func getPythonDeps(pyproject *PyProject, extras []string) ([]string, error) {
+// getEntrypoint returns the entrypoint of the target.
+// When the target has neither an entrypoint nor a command, the entrypoint is
+// deduced from the scripts declared in the project.
+func getEntrypoint(pyproject *PyProject, t *MicrobTarget) ([]string, error) {
+	scripts := pyproject.Project.Scripts
+	if t.EntrypointScript != "" {
+		if len(t.Entrypoint) > 0 {
+			return nil, fmt.Errorf("using entrypoint_script is not allowed together with entrypoint")
+		}
+		if _, ok := scripts[t.EntrypointScript]; !ok {
+			return nil, fmt.Errorf("script %s not found in pyproject.toml", t.EntrypointScript)
+		}
+		return []string{t.EntrypointScript}, nil
+	}
+	if len(t.Entrypoint) > 0 || len(t.Command) > 0 {
+		return t.Entrypoint, nil
+	}
+	switch len(scripts) {
+	case 0:
+		return nil, nil
+	case 1:
+		for name := range scripts {
+			return []string{name}, nil
+		}
+	}
+	return nil, fmt.Errorf("project declares several scripts, use entrypoint_script to select the script used as entrypoint")
+}
+
+func getSystemDeps(systemDeps []string, init bool) []string {
+	deps := make([]string, len(systemDeps))
+	copy(deps, systemDeps)
+	if init {
+		deps = append(deps, "tini")
+	}
+	return deps
+}
+
+// projectRequiresPython returns the constraints on python versions of a project.
+// Poetry projects use the python dependency of tool.poetry.dependencies instead.
+func projectRequiresPython(pyproject *PyProject) string {
+	if pyproject.Tool.Poetry.Name != "" {
+		return pyproject.Tool.Poetry.PythonRequires()
+	}
+	return pyproject.Project.RequiresPython
+}
+
+func getPythonDeps(pyproject *PyProject, extras []string, groups []string) ([]string, error) {
 	dependencies := make([]string, len(pyproject.Project.Dependencies))
 	copy(dependencies, pyproject.Project.Dependencies)
-	if len(extras) > 0 {
-		for _, extra := range extras {
-			extraDeps, ok := pyproject.Project.OptionalDependencies[extra]
-			if !ok {
-				return nil, fmt.Errorf("extra %s not found in pyproject.toml", extra)
-			}
+	// Extras are either optional dependencies of the project table, or poetry extras
+	var poetryExtras []string
+	for _, extra := range extras {
+		if extraDeps, ok := pyproject.Project.OptionalDependencies[extra]; ok {
 			dependencies = append(dependencies, extraDeps...)
+		} else if _, ok := pyproject.Tool.Poetry.Extras[extra]; ok {
+			poetryExtras = append(poetryExtras, extra)
+		} else {
+			return nil, fmt.Errorf("extra %s not found in pyproject.toml", extra)
+		}
+	}
+	// Poetry projects which do not declare the dependencies of the project table use the poetry ones,
+	// from the main group unless groups are selected
+	if pyproject.Tool.Poetry.Name != "" {
+		if len(groups) == 0 && len(pyproject.Project.Dependencies) == 0 {
+			groups = []string{PoetryMainGroup}
+		}
+		for _, group := range groups {
+			dependencies = append(dependencies, pyproject.Tool.Poetry.Requirements(group, poetryExtras)...)
 		}
 	}
 	return utils.Unique(dependencies), nil
@@ -304,10 +917,50 @@ func isUsingGit(requirements []string) bool {
 	return false
 }
 
+// Targets returns the targets declared in the microb section of a pyproject.toml file.
+// Targets are returned in the order they are declared.
+func Targets(data []byte) ([]string, error) {
+	var content map[string]interface{}
+	meta, err := toml.Decode(string(data), &content)
+	if err != nil {
+		return nil, fmt.Errorf("Targets: failed to decode pyproject.toml content: %w", err)
+	}
+	var targets []string
+	for _, key := range meta.Keys() {
+		if len(key) == 4 && key[0] == "tool" && key[1] == "microb" && key[2] == "target" {
+			targets = append(targets, key[3])
+		}
+	}
+	return targets, nil
+}
+
+// TargetDescription returns the description of a target, read from the comment lines
+// immediately preceding its declaration, like the descriptions of Dockerfile stages.
+func TargetDescription(data []byte, target string) string {
+	position, ok := KeyPosition(data, toml.Key{"tool", "microb", "target", target})
+	lines := strings.Split(string(data), "\n")
+	// The position is the one of a parent table when the target is only declared by its sub-tables
+	if !ok || !strings.Contains(lines[position.Line-1], target) {
+		return ""
+	}
+	var comments []string
+	for i := position.Line - 2; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		comments = append([]string{strings.TrimSpace(strings.TrimLeft(line, "#"))}, comments...)
+	}
+	return strings.TrimSpace(strings.Join(comments, " "))
+}
+
 // DefaultTarget returns the first target found in the microb section.
-func defaultTarget(m *Microb) (string, bool) {
-	for name := range m.Target {
-		return name, true
+// Targets are looked up in the order they are declared in the pyproject.toml file.
+func defaultTarget(meta *toml.MetaData) (string, bool) {
+	for _, key := range meta.Keys() {
+		if len(key) == 4 && key[0] == "tool" && key[1] == "microb" && key[2] == "target" {
+			return key[3], true
+		}
 	}
 	return "", false
 }
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SetuptoolsDynamic is the tool.setuptools.dynamic table (partially): only the dependencies
+// read from requirements files are used
+type SetuptoolsDynamic struct {
+	Dependencies         SetuptoolsFiles            `toml:"dependencies"`
+	OptionalDependencies map[string]SetuptoolsFiles `toml:"optional-dependencies"`
+}
+
+// SetuptoolsFiles are the files of a file directive of tool.setuptools.dynamic,
+// given either as a path or as a list of paths
+type SetuptoolsFiles struct {
+	Files []string
+}
+
+func (f *SetuptoolsFiles) UnmarshalTOML(value interface{}) error {
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected map, got %T", value)
+	}
+	switch v := mapping["file"].(type) {
+	case string:
+		f.Files = []string{v}
+	case []interface{}:
+		for _, file := range v {
+			text, ok := file.(string)
+			if !ok {
+				return fmt.Errorf("expected string, got %T", file)
+			}
+			f.Files = append(f.Files, text)
+		}
+	case nil:
+	default:
+		return fmt.Errorf("expected string or list, got %T", v)
+	}
+	return nil
+}
+
+var _ toml.Unmarshaler = (*SetuptoolsFiles)(nil)
+
+// Files returns the files of the dynamic dependencies and optional dependencies
+func (d *SetuptoolsDynamic) Files() []string {
+	files := append([]string{}, d.Dependencies.Files...)
+	extras := make([]string, 0, len(d.OptionalDependencies))
+	for extra := range d.OptionalDependencies {
+		extras = append(extras, extra)
+	}
+	sort.Strings(extras)
+	for _, extra := range extras {
+		files = append(files, d.OptionalDependencies[extra].Files...)
+	}
+	return files
+}
+
+// readDynamicDependencies reads the dependencies and optional dependencies declared as dynamic
+// in the project table from the requirements files of tool.setuptools.dynamic, so that they are
+// installed like the dependencies of the project table. Files are read with a function reading
+// the lines of a file of the context directory.
+func readDynamicDependencies(pyproject *PyProject, read func(name string) ([]string, error)) error {
+	dynamic := pyproject.Tool.Setuptools.Dynamic
+	for _, field := range pyproject.Project.Dynamic {
+		switch field {
+		case "dependencies":
+			dependencies, err := readSetuptoolsFiles(dynamic.Dependencies, read)
+			if err != nil {
+				return &KeyError{Key: toml.Key{"tool", "setuptools", "dynamic", "dependencies"}, err: fmt.Errorf("NewConfigFromBytes: failed to read dynamic dependencies: %w", err)}
+			}
+			pyproject.Project.Dependencies = dependencies
+		case "optional-dependencies":
+			for extra, files := range dynamic.OptionalDependencies {
+				dependencies, err := readSetuptoolsFiles(files, read)
+				if err != nil {
+					return &KeyError{Key: toml.Key{"tool", "setuptools", "dynamic", "optional-dependencies", extra}, err: fmt.Errorf("NewConfigFromBytes: failed to read dynamic dependencies of extra %s: %w", extra, err)}
+				}
+				if pyproject.Project.OptionalDependencies == nil {
+					pyproject.Project.OptionalDependencies = map[string][]string{}
+				}
+				pyproject.Project.OptionalDependencies[extra] = dependencies
+			}
+		}
+	}
+	return nil
+}
+
+// readSetuptoolsFiles returns the requirements of the files of a file directive
+func readSetuptoolsFiles(files SetuptoolsFiles, read func(name string) ([]string, error)) ([]string, error) {
+	var requirements []string
+	for _, name := range files.Files {
+		reqs, _, err := ParseRequirementsFile(name, read)
+		if err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, reqs...)
+	}
+	return requirements, nil
+}
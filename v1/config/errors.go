@@ -0,0 +1,132 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// KeyError is an error caused by the value of a key of the pyproject.toml file.
+// The key is used to locate the error in the file, see ErrorPosition.
+type KeyError struct {
+	Key toml.Key
+	err error
+}
+
+func (e *KeyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.err
+}
+
+// targetKeyError returns an error caused by the value of a key of a target
+func targetKeyError(target string, key string, format string, args ...interface{}) error {
+	return &KeyError{
+		Key: append(toml.Key{"tool", "microb", "target", target}, strings.Split(key, ".")...),
+		err: fmt.Errorf(format, args...),
+	}
+}
+
+// Position is a position in the pyproject.toml file. Lines and columns start at 1.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Syntax errors of the toml decoder only report the line of the error
+var parseErrorRegex = regexp.MustCompile(`Near line (\d+) \(last key parsed`)
+
+// ErrorPosition returns the position of an error returned by NewConfigFromBytes in the
+// content of the pyproject.toml file. Errors caused by a key are located at the key, or at
+// its closest parent found in the file. Syntax errors are located at the start of their line.
+func ErrorPosition(data []byte, err error) (Position, bool) {
+	var keyError *KeyError
+	if errors.As(err, &keyError) {
+		return KeyPosition(data, keyError.Key)
+	}
+	if match := parseErrorRegex.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return Position{Line: line, Column: 1}, true
+	}
+	return Position{}, false
+}
+
+// KeyPosition returns the position of a key in the content of a TOML file, or the
+// position of its closest parent when the key is not declared on its own line,
+// for instance when it is declared in an inline table.
+func KeyPosition(data []byte, key toml.Key) (Position, bool) {
+	var position Position
+	found := 0
+	var table toml.Key
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		var declared toml.Key
+		if strings.HasPrefix(trimmed, "[") {
+			name, _, _ := strings.Cut(strings.TrimLeft(trimmed, "["), "]")
+			table = splitKey(name)
+			declared = table
+		} else if name, _, ok := cutUnquoted(trimmed, '='); ok {
+			declared = append(append(toml.Key{}, table...), splitKey(name)...)
+		} else {
+			continue
+		}
+		if len(declared) > found && isKeyPrefix(declared, key) {
+			found = len(declared)
+			position = Position{Line: i + 1, Column: len(line) - len(strings.TrimLeft(line, " \t")) + 1}
+		}
+	}
+	return position, found > 0
+}
+
+// isKeyPrefix checks whether a key is equal to or a parent of another key
+func isKeyPrefix(prefix toml.Key, key toml.Key) bool {
+	if len(prefix) > len(key) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != key[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitKey splits a dotted TOML key into its parts, removing the quotes of quoted parts
+func splitKey(name string) toml.Key {
+	var key toml.Key
+	for {
+		part, rest, ok := cutUnquoted(name, '.')
+		key = append(key, strings.Trim(strings.TrimSpace(part), `"'`))
+		if !ok {
+			return key
+		}
+		name = rest
+	}
+}
+
+// cutUnquoted slices a string around the first separator found outside of quotes
+func cutUnquoted(s string, sep byte) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
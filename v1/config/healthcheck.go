@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Healthcheck is the command checking the health of the containers of the final image, see
+// https://docs.docker.com/reference/dockerfile/#healthcheck. Durations use the go format, e.g. 30s.
+type Healthcheck struct {
+	Command     []string `toml:"command"`
+	Interval    string   `toml:"interval"`
+	Timeout     string   `toml:"timeout"`
+	StartPeriod string   `toml:"start_period"`
+	Retries     int      `toml:"retries"`
+}
+
+// Durations returns the interval, the timeout and the start period of the healthcheck, zero when unset
+func (h *Healthcheck) Durations() (interval, timeout, startPeriod time.Duration, err error) {
+	durations := []*time.Duration{&interval, &timeout, &startPeriod}
+	for i, value := range []string{h.Interval, h.Timeout, h.StartPeriod} {
+		if value == "" {
+			continue
+		}
+		if *durations[i], err = time.ParseDuration(value); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return interval, timeout, startPeriod, nil
+}
+
+// validateHealthcheck checks that a healthcheck has a command and valid durations
+func validateHealthcheck(h *Healthcheck) error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("command is required")
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("retries must be positive, got %d", h.Retries)
+	}
+	_, _, _, err := h.Durations()
+	return err
+}
+
+var exposedPortRegex = regexp.MustCompile(`^([0-9]+)(/(tcp|udp|sctp))?$`)
+
+// ExposedPort checks whether a port exposed by the final image is valid, e.g. 8000 or 8000/udp
+func ExposedPort(port string) bool {
+	m := exposedPortRegex.FindStringSubmatch(port)
+	if m == nil {
+		return false
+	}
+	n, err := strconv.Atoi(m[1])
+	return err == nil && n > 0 && n < 65536
+}
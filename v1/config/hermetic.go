@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var imageDigestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ImageDigest checks that a digest is a valid sha256 digest of an image, e.g. sha256:4f53...
+func ImageDigest(digest string) bool {
+	return digest == "" || imageDigestRegex.MatchString(digest)
+}
+
+// hermeticError returns the key of the first reason why a hermetic target would need network access
+// during the build, along with the reason, or a nil error when the target can be built without network.
+// Network access is only forbidden during the steps generated by microb, since pre and post
+// install commands are shell commands whose network usage can not be known.
+func hermeticError(t *MicrobTarget, buildDeps []string, systemDeps []string, dependenciesUseGit bool) (string, error) {
+	if t.Wheelhouse == "" && t.WheelhouseFrom == "" {
+		return "wheelhouse", fmt.Errorf("a wheelhouse is required to install python dependencies without network")
+	}
+	if t.BuilderImageDigest == "" || t.FinalImageDigest == "" {
+		return "hermetic", fmt.Errorf("builder_image_digest and final_image_digest are required to pin the base images")
+	}
+	if t.Network != "" && t.Network != "none" {
+		return "network", fmt.Errorf("network mode %s is not allowed, python dependencies are installed without network", t.Network)
+	}
+	if len(buildDeps) > 0 {
+		return "build_deps", fmt.Errorf("build dependencies %s can not be installed without network", strings.Join(buildDeps, ", "))
+	}
+	if len(systemDeps) > 0 {
+		return "system_deps", fmt.Errorf("system dependencies %s can not be installed without network", strings.Join(systemDeps, ", "))
+	}
+	if t.RustToolchain != "" && t.RustToolchain != "none" {
+		return "rust_toolchain", fmt.Errorf("rust toolchain %s can not be installed without network", t.RustToolchain)
+	}
+	if dependenciesUseGit {
+		return "hermetic", fmt.Errorf("dependencies installed from git repositories can not be installed without network")
+	}
+	for _, f := range append(t.AddFilesBeforeBuild, t.AddFiles...) {
+		if strings.Contains(f.Source, "://") {
+			return "add_files", fmt.Errorf("remote file %s can not be added without network", f.Source)
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// imagePlaceholderRegex matches the placeholders of an image name, e.g. {version}
+var imagePlaceholderRegex = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ImagePlaceholders are the placeholders of an image name: the name of the target, the version of
+// the project, and the git revision the image is built from, in full or abbreviated
+var ImagePlaceholders = []string{"target", "version", "git_sha", "git_short_sha"}
+
+// ImageTemplate checks that an image name only uses known placeholders
+func ImageTemplate(image string) error {
+	for _, m := range imagePlaceholderRegex.FindAllStringSubmatch(image, -1) {
+		known := false
+		for _, placeholder := range ImagePlaceholders {
+			known = known || m[1] == placeholder
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder {%s}, must be one of {%s}", m[1], strings.Join(ImagePlaceholders, "}, {"))
+		}
+	}
+	return nil
+}
+
+// ImageName returns the name of the image of a config, whose placeholders are expanded with the
+// target, the version of the project and the given git revision, e.g. ghcr.io/org/app-api:1.0.0
+// for ghcr.io/org/app-{target}:{version}. An empty name is returned when no image is configured.
+func ImageName(c *Config, revision string) (string, error) {
+	var missing []string
+	name := imagePlaceholderRegex.ReplaceAllStringFunc(c.Image, func(placeholder string) string {
+		var value string
+		switch strings.Trim(placeholder, "{}") {
+		case "target":
+			value = c.Target
+		case "version":
+			value = c.Version
+		case "git_sha":
+			value = revision
+		case "git_short_sha":
+			value = revision
+			if len(value) > 7 {
+				value = value[:7]
+			}
+		}
+		if value == "" {
+			missing = append(missing, placeholder)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("image %s can not be named, no value for %s", c.Image, strings.Join(missing, ", "))
+	}
+	return name, nil
+}
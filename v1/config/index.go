@@ -0,0 +1,12 @@
+package config
+
+import "net/url"
+
+// IndexUrl checks that the url of a python package index is an absolute http or https url
+func IndexUrl(rawUrl string) bool {
+	indexUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	return (indexUrl.Scheme == "http" || indexUrl.Scheme == "https") && indexUrl.Host != ""
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+var unmarshalerType = reflect.TypeOf((*toml.Unmarshaler)(nil)).Elem()
+
+// unknownMicrobKeys returns the keys of the microb section which were not decoded.
+// Keys of unknown tables are not returned, only the tables themselves.
+// Keys of targets other than the given target are ignored.
+func unknownMicrobKeys(meta *toml.MetaData, target string) []toml.Key {
+	undecoded := map[string]bool{}
+	for _, key := range meta.Undecoded() {
+		undecoded[key.String()] = true
+	}
+	var keys []toml.Key
+	for _, key := range meta.Undecoded() {
+		if len(key) <= 2 || key[0] != "tool" || key[1] != "microb" || unmarshaledKey(key) {
+			continue
+		}
+		if len(key) > 4 && key[2] == "target" && key[3] != target {
+			continue
+		}
+		if !undecodedParent(key, undecoded) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// joinKeys returns the dotted names of keys separated by commas
+func joinKeys(keys []toml.Key) string {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// undecodedParent checks whether a parent table of a key was not decoded
+func undecodedParent(key toml.Key, undecoded map[string]bool) bool {
+	for i := len(key) - 1; i > 2; i-- {
+		if undecoded[key[:i].String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshaledKey checks whether a key belongs to a value decoded by a custom unmarshaler,
+// such as Packages. The toml metadata does not track the keys of such values, so they
+// are always reported as undecoded.
+func unmarshaledKey(key toml.Key) bool {
+	t := reflect.TypeOf(PyProject{})
+	for i := 0; ; {
+		if reflect.PointerTo(t).Implements(unmarshalerType) {
+			return true
+		}
+		if i == len(key) {
+			return false
+		}
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice:
+			// Keys of arrays of tables do not contain the index of the table
+			t = t.Elem()
+		case reflect.Map:
+			t = t.Elem()
+			i++
+		case reflect.Struct:
+			field, ok := tomlField(t, key[i])
+			if !ok {
+				return false
+			}
+			t = field.Type
+			i++
+		default:
+			return false
+		}
+	}
+}
+
+// tomlField returns the field of a struct decoded from a key, using the same rules as the
+// toml decoder: the name of the toml tag, else the name of the field ignoring case
+func tomlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if tag == name || (tag == "" && strings.EqualFold(field.Name, name)) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
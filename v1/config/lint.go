@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Finding is a risky pattern found in the configuration of a target
+type Finding struct {
+	Rule    string `json:"rule"`
+	Target  string `json:"target"`
+	Key     string `json:"key"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// Lint checks the configuration of a target for risky patterns, such as credentials
+// written in pyproject.toml. The configuration must be valid, otherwise the error of
+// NewConfigFromBytes is returned.
+func Lint(data []byte, options *Options) ([]Finding, error) {
+	c, err := NewConfigFromBytes(data, options)
+	if err != nil {
+		return nil, err
+	}
+	return LintConfig(c, data, options)
+}
+
+// LintConfig checks a configuration created by NewConfigFromBytes from the same data and options
+// for risky patterns, so that the configuration is not created twice.
+func LintConfig(c *Config, data []byte, options *Options) ([]Finding, error) {
+	var pyproject PyProject
+	meta, err := toml.Decode(string(data), &pyproject)
+	if err != nil {
+		return nil, fmt.Errorf("Lint: failed to decode pyproject.toml content: %w", err)
+	}
+	target := options.Target
+	if target == "" {
+		target, _ = defaultTarget(&meta)
+	}
+	targetConfig := pyproject.Tool.Microb.Target[target]
+	var findings []Finding
+	add := func(rule string, key string, format string, args ...interface{}) {
+		finding := Finding{Rule: rule, Target: target, Key: key, Message: fmt.Sprintf(format, args...)}
+		if target != "" {
+			// Findings which are not caused by a key are located at the target
+			fullKey := toml.Key{"tool", "microb", "target", target}
+			if key != "" {
+				fullKey = append(fullKey, strings.Split(key, ".")...)
+			}
+			if position, ok := KeyPosition(data, fullKey); ok {
+				finding.Line, finding.Column = position.Line, position.Column
+			}
+		}
+		findings = append(findings, finding)
+	}
+	for _, index := range c.Indices {
+		indexUrl := redactUrl(index.Url)
+		if index.Trust {
+			add("trusted-index", "indices", "index %s is trusted, its certificate is not verified", indexUrl)
+		}
+		if index.Password != "" && index.PasswordSecret == "" {
+			add("inline-credentials", "indices", "password of index %s is written in pyproject.toml, use password_secret instead", indexUrl)
+		} else if index.Username != "" && index.UsernameSecret == "" && index.Password == "" && index.PasswordSecret == "" {
+			add("inline-credentials", "indices", "token of index %s is written in pyproject.toml, use username_secret instead", indexUrl)
+		}
+		for _, rawUrl := range append([]string{index.Url}, index.Mirrors...) {
+			if u, err := url.Parse(rawUrl); err == nil && u.User != nil {
+				add("inline-credentials", "indices", "url of index %s contains credentials, use username_secret and password_secret instead", u.Redacted())
+			}
+		}
+	}
+	if len(c.Entrypoint) == 0 && len(c.Command) == 0 {
+		add("missing-entrypoint", "entrypoint", "final image has neither entrypoint nor command")
+	}
+	if c.DependenciesUseSsh {
+		key := ""
+		if c.Requirements != "" {
+			key = "requirements"
+		}
+		add("ssh-dependencies", key, "dependencies are fetched using git+ssh, the build requires an ssh agent forwarded with --ssh default")
+	}
+	if targetConfig.PythonVersion == "" && options.ReadPythonVersion(c.ContextDir) == "" {
+		add("unpinned-python-version", "python_version", "python version %s is resolved from requires-python and can change between builds, set python_version or use a .python-version, .tool-versions or mise.toml file", c.PythonVersion)
+	} else if !strings.Contains(c.PythonVersion, ".") {
+		add("unpinned-python-version", "python_version", "python version %s does not pin a minor version", c.PythonVersion)
+	}
+	if c.RunAsRoot {
+		add("run-as-root", "run_as_root", "final image runs as root")
+	}
+	if c.Requirements != "" {
+		// Dependencies of the project are only installed when they are listed in the requirements
+		requirements, _, err := ParseRequirementsFile(c.Requirements, func(name string) ([]string, error) {
+			return options.ReadRequirements(path.Join(c.ContextDir, name))
+		})
+		if err == nil {
+			listed := map[string]bool{}
+			for _, requirement := range requirements {
+				listed[requirementName(requirement)] = true
+			}
+			for _, dependency := range c.Dependencies {
+				if name := requirementName(dependency); name != "" && !listed[name] {
+					add("missing-requirements", "requirements", "dependency %s of the project is not listed in %s, it is not installed", dependency, c.Requirements)
+				}
+			}
+		}
+	}
+	if targetConfig.SrcDetect && len(targetConfig.SrcInclude) > 0 {
+		add("ignored-key", "src_detect", "src_detect is ignored because src_include is set")
+	}
+	if targetConfig.DisableAutoBuildDeps && len(targetConfig.NativeBuildDeps) > 0 {
+		add("ignored-key", "native_build_deps", "native_build_deps is ignored because disable_auto_build_deps is set")
+	}
+	return findings, nil
+}
+
+// redactUrl returns an url with its password replaced, so that it can be reported
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// LocalDependency is a dependency installed from a local directory or archive, such as a sibling
+// library of a monorepo, e.g. `mylib @ file://../libs/mylib` or a poetry `path` dependency
+type LocalDependency struct {
+	Name   string   // Name of the dependency
+	Path   string   // Path of the dependency relative to the build context
+	Extras []string // Extras of the dependency
+}
+
+// localRequirementRegex matches the requirements of local dependencies, whose url uses the file scheme
+var localRequirementRegex = regexp.MustCompile(`^\s*([A-Za-z0-9][A-Za-z0-9._-]*)\s*(?:\[([^\]]*)\])?\s*@\s*file:([^\s;]+)`)
+
+// splitLocalDependencies splits the local dependencies from the other dependencies.
+// Paths are relative to the context directory of the project, and are returned relative to the
+// build context so that directories next to the project can be copied, as long as they are part
+// of the build context.
+func splitLocalDependencies(dependencies []string, contextDir string) ([]string, []LocalDependency, error) {
+	var remote []string
+	var local []LocalDependency
+	for _, dependency := range dependencies {
+		m := localRequirementRegex.FindStringSubmatch(dependency)
+		if m == nil {
+			remote = append(remote, dependency)
+			continue
+		}
+		// file://../libs/mylib is not a valid url, but is commonly used for relative paths
+		src := strings.TrimPrefix(m[3], "//")
+		if path.IsAbs(src) {
+			return nil, nil, fmt.Errorf("local dependency %s uses an absolute path %s, which is not part of the build context", m[1], src)
+		}
+		src = path.Join(contextDir, src)
+		if src == ".." || strings.HasPrefix(src, "../") {
+			return nil, nil, fmt.Errorf("local dependency %s uses path %s, which is outside of the build context", m[1], m[3])
+		}
+		var extras []string
+		for _, extra := range strings.Split(m[2], ",") {
+			if extra = strings.TrimSpace(extra); extra != "" {
+				extras = append(extras, extra)
+			}
+		}
+		local = append(local, LocalDependency{Name: m[1], Path: src, Extras: extras})
+	}
+	return remote, local, nil
+}
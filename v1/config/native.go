@@ -0,0 +1,73 @@
+package config
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Python packages which are often built from source, mapped to the system packages
+// required to build them. The python images based on debian already provide a compiler,
+// but the images based on alpine do not.
+var defaultNativeBuildDeps = map[string]Packages{
+	"psycopg2": {ByFlavor: map[string][]string{
+		"debian": {"libpq-dev"},
+		"alpine": {"gcc", "musl-dev", "postgresql-dev"},
+	}},
+	"cryptography": {ByFlavor: map[string][]string{
+		"debian": {"libssl-dev", "libffi-dev"},
+		"alpine": {"gcc", "musl-dev", "libffi-dev", "openssl-dev"},
+	}},
+	"lxml": {ByFlavor: map[string][]string{
+		"debian": {"libxml2-dev", "libxslt1-dev"},
+		"alpine": {"gcc", "musl-dev", "libxml2-dev", "libxslt-dev"},
+	}},
+	"pillow": {ByFlavor: map[string][]string{
+		"debian": {"libjpeg-dev", "zlib1g-dev"},
+		"alpine": {"gcc", "musl-dev", "jpeg-dev", "zlib-dev"},
+	}},
+	"mysqlclient": {ByFlavor: map[string][]string{
+		"debian": {"default-libmysqlclient-dev", "pkg-config"},
+		"alpine": {"gcc", "musl-dev", "mariadb-dev", "pkgconf"},
+	}},
+}
+
+var requirementNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*`)
+var requirementNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// NativeBuildDeps returns the system packages required to build the python dependencies
+// for a flavor. Python dependencies are looked up in the default mapping, which can be
+// extended or overridden by the mapping of the target.
+func NativeBuildDeps(dependencies []string, mapping map[string]Packages, flavor string) []string {
+	var deps []string
+	for _, dependency := range dependencies {
+		name := requirementName(dependency)
+		for key, packages := range mapping {
+			if requirementName(key) == name {
+				deps = append(deps, packages.ForFlavor(flavor)...)
+				name = ""
+				break
+			}
+		}
+		if packages, ok := defaultNativeBuildDeps[name]; ok {
+			deps = append(deps, packages.ForFlavor(flavor)...)
+		}
+	}
+	return deps
+}
+
+// nativeBuildDepsNames returns the python dependencies of a mapping sorted in increasing order
+func nativeBuildDepsNames(mapping map[string]Packages) []string {
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requirementName returns the normalized name of a requirement, as defined by PEP 503
+func requirementName(requirement string) string {
+	name := requirementNameRegex.FindString(strings.TrimSpace(requirement))
+	return strings.ToLower(requirementNameSeparators.ReplaceAllString(name, "-"))
+}
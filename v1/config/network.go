@@ -0,0 +1,12 @@
+package config
+
+func Network(network string) (string, bool) {
+	switch network {
+	case "default", "none", "host":
+		return network, true
+	case "":
+		return network, true
+	default:
+		return "", false
+	}
+}
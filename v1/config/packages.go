@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Packages is a list of build or system dependencies.
+// Packages can be declared either as a list used by all flavors, or as a table
+// of lists keyed by flavor, e.g. { debian = ["libpq-dev"], alpine = ["postgresql-dev"] }.
+type Packages struct {
+	All      []string
+	ByFlavor map[string][]string
+}
+
+func (p *Packages) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		names, err := packageNames(v)
+		if err != nil {
+			return err
+		}
+		p.All = names
+	case map[string]interface{}:
+		p.ByFlavor = map[string][]string{}
+		for flavor, list := range v {
+			values, ok := list.([]interface{})
+			if !ok {
+				return fmt.Errorf("expected list for flavor %s, got %T", flavor, list)
+			}
+			names, err := packageNames(values)
+			if err != nil {
+				return err
+			}
+			p.ByFlavor[flavor] = names
+		}
+	default:
+		return fmt.Errorf("expected list or map, got %T", value)
+	}
+	return nil
+}
+
+// ForFlavor returns the packages used by a flavor
+func (p *Packages) ForFlavor(flavor string) []string {
+	packages := make([]string, 0, len(p.All)+len(p.ByFlavor[flavor]))
+	packages = append(packages, p.All...)
+	return append(packages, p.ByFlavor[flavor]...)
+}
+
+// Flavors returns the flavors for which packages are declared, sorted in increasing order
+func (p *Packages) Flavors() []string {
+	flavors := make([]string, 0, len(p.ByFlavor))
+	for flavor := range p.ByFlavor {
+		flavors = append(flavors, flavor)
+	}
+	sort.Strings(flavors)
+	return flavors
+}
+
+func packageNames(values []interface{}) ([]string, error) {
+	names := make([]string, 0, len(values))
+	for _, value := range values {
+		name, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %T", value)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+var _ toml.Unmarshaler = (*Packages)(nil)
+
+// Debian packages can be pinned using name=version, where the version can contain
+// wildcards, e.g. libpq-dev=15.4-*
+var aptPackageRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?(=[A-Za-z0-9.+~:*-]+)?$`)
+
+// Alpine packages can be pinned using name=version or constrained using name~version,
+// name>version, name<version, name>=version or name<=version
+var apkPackageRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9+._-]*((=|~|>|<|>=|<=)[A-Za-z0-9.+_-]+)?$`)
+
+var aptSnapshotRegex = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z$`)
+
+// SystemPackage checks that a build or system dependency is a valid package
+// specification for the package manager of the flavor.
+func SystemPackage(flavor string, pkg string) bool {
+	switch flavor {
+	case "debian":
+		return aptPackageRegex.MatchString(pkg)
+	case "alpine":
+		return apkPackageRegex.MatchString(pkg)
+	default:
+		return false
+	}
+}
+
+// AptSnapshot checks that a snapshot is a valid snapshot.debian.org timestamp, e.g. 20240101T000000Z
+func AptSnapshot(snapshot string) bool {
+	return snapshot == "" || aptSnapshotRegex.MatchString(snapshot)
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version and specifier syntax of PEP 440, see https://peps.python.org/pep-0440/
+var (
+	pep440VersionRegex   = regexp.MustCompile(`^v?(?:(\d+)!)?(\d+(?:\.\d+)*)(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?(\d+)?)?(?:-(\d+)|[-_.]?(post|rev|r)[-_.]?(\d+)?)?(?:[-_.]?(dev)[-_.]?(\d+)?)?(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+	pep440SpecifierRegex = regexp.MustCompile(`^(~=|===|==|!=|<=|>=|<|>)\s*(\S+)$`)
+)
+
+// Phases of a pre-release, ordered like the versions they belong to
+var pep440PrePhases = map[string]int{"a": 0, "alpha": 0, "b": 1, "beta": 1, "c": 2, "rc": 2, "pre": 2, "preview": 2}
+
+// Phases of the pre-release key of a version without pre-release, see pep440Version.key
+const (
+	pep440DevOnly = -1
+	pep440Final   = 3
+)
+
+// pep440Version is a version as defined by PEP 440. Local version labels are parsed but
+// ignored when comparing versions, since python versions never have one.
+type pep440Version struct {
+	epoch   int
+	release []int
+	// pre is the phase and the number of the pre-release, the phase being -1 without pre-release
+	pre  [2]int
+	post int
+	dev  int
+}
+
+// parsePEP440Version parses a version using the normalization rules of PEP 440,
+// e.g. 3.11, 3.12.0rc1 or 1!2.0.post1.dev3
+func parsePEP440Version(s string) (pep440Version, error) {
+	m := pep440VersionRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return pep440Version{}, fmt.Errorf("invalid version %s", s)
+	}
+	v := pep440Version{pre: [2]int{-1, 0}, post: -1, dev: -1}
+	v.epoch = atoiOrZero(m[1])
+	for _, part := range strings.Split(m[2], ".") {
+		v.release = append(v.release, atoiOrZero(part))
+	}
+	if m[3] != "" {
+		v.pre = [2]int{pep440PrePhases[m[3]], atoiOrZero(m[4])}
+	}
+	if m[5] != "" {
+		v.post = atoiOrZero(m[5])
+	} else if m[6] != "" {
+		v.post = atoiOrZero(m[7])
+	}
+	if m[8] != "" {
+		v.dev = atoiOrZero(m[9])
+	}
+	return v, nil
+}
+
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// isPrerelease returns whether a version is a pre-release or a development release
+func (v pep440Version) isPrerelease() bool {
+	return v.pre[0] >= 0 || v.dev >= 0
+}
+
+// isPostrelease returns whether a version is a post-release
+func (v pep440Version) isPostrelease() bool {
+	return v.post >= 0
+}
+
+// key returns the values ordering versions with the same release: development releases come before
+// pre-releases, which come before the final release, which comes before post-releases
+func (v pep440Version) key() []int {
+	pre := v.pre
+	if pre[0] < 0 {
+		pre = [2]int{pep440Final, 0}
+		if v.post < 0 && v.dev >= 0 {
+			pre = [2]int{pep440DevOnly, 0}
+		}
+	}
+	post := v.post
+	if post < 0 {
+		post = math.MinInt
+	}
+	dev := v.dev
+	if dev < 0 {
+		dev = math.MaxInt
+	}
+	return []int{pre[0], pre[1], post, dev}
+}
+
+// compare returns -1, 0 or 1 when a version is lower, equal or greater than another one,
+// releases being padded with zeros so that 3.11 and 3.11.0 are equal
+func (v pep440Version) compare(o pep440Version) int {
+	if c := compareInts([]int{v.epoch}, []int{o.epoch}); c != 0 {
+		return c
+	}
+	if c := compareInts(padRelease(v.release, len(o.release)), padRelease(o.release, len(v.release))); c != 0 {
+		return c
+	}
+	return compareInts(v.key(), o.key())
+}
+
+// sameRelease returns whether two versions have the same epoch and release, e.g. 3.12.0rc1 and 3.12
+func (v pep440Version) sameRelease(o pep440Version) bool {
+	return v.epoch == o.epoch && compareInts(padRelease(v.release, len(o.release)), padRelease(o.release, len(v.release))) == 0
+}
+
+func padRelease(release []int, n int) []int {
+	padded := append([]int{}, release...)
+	for len(padded) < n {
+		padded = append(padded, 0)
+	}
+	return padded
+}
+
+func compareInts(a []int, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// pep440Specifier is a single version clause of a specifier set, e.g. >=3.8 or ==3.11.*
+type pep440Specifier struct {
+	operator string
+	raw      string
+	version  pep440Version
+	// prefix is the release before the trailing .* of == and != clauses, nil without wildcard
+	prefix []int
+}
+
+// pep440Specifiers is a comma separated list of version clauses, which are all satisfied by
+// the versions matching the list. An empty list matches all versions.
+type pep440Specifiers []pep440Specifier
+
+// parsePEP440Specifiers parses a specifier set such as requires-python, e.g. ">=3.8,<3.12", "~=3.10" or "==3.11.*"
+func parsePEP440Specifiers(s string) (pep440Specifiers, error) {
+	var specifiers pep440Specifiers
+	for _, clause := range strings.Split(s, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("invalid specifier %s: empty clause", s)
+		}
+		m := pep440SpecifierRegex.FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("invalid specifier %s", clause)
+		}
+		spec := pep440Specifier{operator: m[1], raw: m[2]}
+		if spec.operator == "===" {
+			specifiers = append(specifiers, spec)
+			continue
+		}
+		raw := m[2]
+		if strings.HasSuffix(raw, ".*") {
+			if spec.operator != "==" && spec.operator != "!=" {
+				return nil, fmt.Errorf("invalid specifier %s: wildcards are only allowed with == and !=", clause)
+			}
+			raw = strings.TrimSuffix(raw, ".*")
+		}
+		v, err := parsePEP440Version(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid specifier %s: %w", clause, err)
+		}
+		spec.version = v
+		if raw != m[2] {
+			if v.isPrerelease() || v.isPostrelease() {
+				return nil, fmt.Errorf("invalid specifier %s: wildcards are only allowed after a release", clause)
+			}
+			spec.prefix = v.release
+		}
+		if spec.operator == "~=" && len(v.release) < 2 {
+			return nil, fmt.Errorf("invalid specifier %s: ~= requires at least two release segments", clause)
+		}
+		specifiers = append(specifiers, spec)
+	}
+	return specifiers, nil
+}
+
+// contains returns whether a version satisfies all the clauses. Like pip does for requires-python,
+// pre-releases are accepted, except by the exclusive comparisons excluding them.
+func (specifiers pep440Specifiers) contains(raw string, v pep440Version) bool {
+	for _, spec := range specifiers {
+		if !spec.contains(raw, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (spec pep440Specifier) contains(raw string, v pep440Version) bool {
+	switch spec.operator {
+	case "===":
+		return strings.EqualFold(strings.TrimSpace(raw), spec.raw)
+	case "==":
+		if spec.prefix != nil {
+			return spec.matchesPrefix(v)
+		}
+		return v.compare(spec.version) == 0
+	case "!=":
+		if spec.prefix != nil {
+			return !spec.matchesPrefix(v)
+		}
+		return v.compare(spec.version) != 0
+	case "~=":
+		// ~=3.10 is >=3.10,==3.*
+		prefix := spec.version.release[:len(spec.version.release)-1]
+		return v.compare(spec.version) >= 0 && pep440Specifier{prefix: prefix, version: spec.version}.matchesPrefix(v)
+	case "<=":
+		return v.compare(spec.version) <= 0
+	case ">=":
+		return v.compare(spec.version) >= 0
+	case "<":
+		// <3.12 does not match pre-releases of 3.12, unless it is itself a pre-release
+		if v.compare(spec.version) >= 0 {
+			return false
+		}
+		return spec.version.isPrerelease() || !v.isPrerelease() || !v.sameRelease(spec.version)
+	case ">":
+		// >3.11 does not match post-releases of 3.11, unless it is itself a post-release
+		if v.compare(spec.version) <= 0 {
+			return false
+		}
+		return spec.version.isPostrelease() || !v.isPostrelease() || !v.sameRelease(spec.version)
+	}
+	return false
+}
+
+// matchesPrefix returns whether the epoch and the release of a version start with the prefix of a wildcard clause
+func (spec pep440Specifier) matchesPrefix(v pep440Version) bool {
+	if v.epoch != spec.version.epoch {
+		return false
+	}
+	release := padRelease(v.release, len(spec.prefix))
+	return compareInts(spec.prefix, release[:len(spec.prefix)]) == 0
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"fmt"
 	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -11,7 +15,15 @@ type Poetry struct {
 	Authors      []PoetryAuthor              `toml:"authors"`
 	Name         string                      `toml:"name"`
 	Description  string                      `toml:"description"`
+	Version      string                      `toml:"version"`
 	Dependencies map[string]PoetryDependency `toml:"dependencies"`
+	// Legacy development dependencies, which belong to the dev group
+	DevDependencies map[string]PoetryDependency `toml:"dev-dependencies"`
+	// Extras are lists of optional dependencies, by name
+	Extras   map[string][]string    `toml:"extras"`
+	Group    map[string]PoetryGroup `toml:"group"`
+	Packages []PoetryPackage        `toml:"packages"`
+	Readme   Readme                 `toml:"readme"`
 }
 
 func (p *Poetry) GetAuthors() []Author {
@@ -22,13 +34,116 @@ func (p *Poetry) GetAuthors() []Author {
 	return authors
 }
 
+// fillProject fills the metadata missing from the project table of a poetry project which only
+// declares the poetry table, so that images are named and labeled after the poetry project
+func (p *Poetry) fillProject(project *Project) {
+	if p.Name == "" || project.Name != "" {
+		return
+	}
+	project.Name = p.Name
+	project.Description = p.Description
+	project.Version = p.Version
+	project.Authors = p.GetAuthors()
+}
+
+// poetryBuildBackend returns whether poetry-core must be declared as the build backend of a poetry
+// project. Without build system, pip would build the project with the legacy setuptools backend,
+// which can not install poetry projects.
+func poetryBuildBackend(pyproject *PyProject) bool {
+	return pyproject.Tool.Poetry.Name != "" && pyproject.BuildSystem.BuildBackend == ""
+}
+
+// PythonRequires returns the python constraint of a poetry project translated to PEP 440 specifiers,
+// e.g. ">=3.10,<4" for "^3.10". Alternatives of the constraint are kept separated by ||.
 func (p *Poetry) PythonRequires() string {
 	if v, ok := p.Dependencies["python"]; ok {
-		return v.version
+		return poetryConstraint(v.version)
 	}
 	return ""
 }
 
+var (
+	poetryOrRegex       = regexp.MustCompile(`\|\|?`)
+	poetryOperatorRegex = regexp.MustCompile(`([<>=!~^]+)\s+`)
+)
+
+// poetryConstraint translates a poetry version constraint to PEP 440 specifiers. Clauses are
+// separated by commas or spaces, and alternatives by | or ||, see
+// https://python-poetry.org/docs/dependency-specification/#version-constraints
+func poetryConstraint(constraint string) string {
+	var alternatives []string
+	for _, alternative := range poetryOrRegex.Split(constraint, -1) {
+		alternative = poetryOperatorRegex.ReplaceAllString(alternative, "$1")
+		var clauses []string
+		for _, clause := range strings.FieldsFunc(alternative, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			clauses = append(clauses, poetryClause(clause)...)
+		}
+		alternatives = append(alternatives, strings.Join(clauses, ","))
+	}
+	return strings.Join(alternatives, " || ")
+}
+
+// poetryClause translates a clause of a poetry constraint to PEP 440 clauses:
+// caret and tilde requirements become ranges, * matches any version and bare versions are exact.
+// Clauses which can not be translated are returned as they are, so that they are reported as invalid.
+func poetryClause(clause string) []string {
+	switch {
+	case clause == "*":
+		return nil
+	case strings.HasPrefix(clause, "^"):
+		return poetryRange(clause, caretBound)
+	case strings.HasPrefix(clause, "~") && !strings.HasPrefix(clause, "~="):
+		return poetryRange(clause, tildeBound)
+	case clause[0] >= '0' && clause[0] <= '9':
+		return []string{"==" + clause}
+	}
+	return []string{clause}
+}
+
+// poetryRange returns the clauses of the range starting at the version of a caret or tilde clause,
+// and ending before the upper bound of its release
+func poetryRange(clause string, bound func(release []int) []int) []string {
+	version := clause[1:]
+	v, err := parsePEP440Version(version)
+	if err != nil {
+		return []string{clause}
+	}
+	upper := make([]string, 0, len(v.release))
+	for _, n := range bound(v.release) {
+		upper = append(upper, strconv.Itoa(n))
+	}
+	return []string{">=" + version, "<" + strings.Join(upper, ".")}
+}
+
+// caretBound returns the upper bound of a caret requirement, which allows updates that do not
+// modify the left-most non-zero part of the release, e.g. <4 for ^3.10 and <0.3 for ^0.2.1
+func caretBound(release []int) []int {
+	i := len(release) - 1
+	for j, n := range release {
+		if n != 0 {
+			i = j
+			break
+		}
+	}
+	return append(append([]int{}, release[:i]...), release[i]+1)
+}
+
+// tildeBound returns the upper bound of a tilde requirement, which allows patch updates when a
+// minor version is given, e.g. <3.11 for ~3.10, and minor updates otherwise, e.g. <4 for ~3
+func tildeBound(release []int) []int {
+	if len(release) == 1 {
+		return []int{release[0] + 1}
+	}
+	return []int{release[0], release[1] + 1}
+}
+
+// PoetryPackage is a package included in a poetry project.
+// From is optional and is the directory containing the package.
+type PoetryPackage struct {
+	Include string `toml:"include"`
+	From    string `toml:"from"`
+}
+
 type PoetryAuthor struct {
 	Name  string `toml:"name"`
 	Email string `toml:"email"`
@@ -52,8 +167,20 @@ func (p *PoetryAuthor) UnmarshalTOML(value interface{}) error {
 	return err
 }
 
+// PoetryDependency is a dependency of a poetry project, given either as a version constraint, or as
+// a table with a version constraint, a git repository, a local path or an url, see
+// https://python-poetry.org/docs/dependency-specification/
 type PoetryDependency struct {
-	version string
+	version      string
+	git          string
+	ref          string
+	subdirectory string
+	path         string
+	url          string
+	extras       []string
+	markers      string
+	python       string
+	optional     bool
 }
 
 func (p *PoetryDependency) UnmarshalTOML(value interface{}) error {
@@ -62,18 +189,209 @@ func (p *PoetryDependency) UnmarshalTOML(value interface{}) error {
 		p.version = text
 		return nil
 	}
+	// Multiple constraints depend on environment markers, which are not supported: the first one is used
+	if list, ok := value.([]interface{}); ok && len(list) > 0 {
+		value = list[0]
+	}
 	mapping, ok := value.(map[string]interface{})
 	if !ok {
 		return fmt.Errorf("expected string or map, got %T", value)
 	}
-	if v, ok := mapping["version"]; ok {
-		p.version = v.(string)
-	} else {
-		return fmt.Errorf("version field is required")
+	for _, key := range []string{"version", "git", "subdirectory", "path", "url", "markers", "python"} {
+		if v, ok := mapping[key]; ok {
+			text, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s field must be a string, got %T", key, v)
+			}
+			switch key {
+			case "version":
+				p.version = text
+			case "git":
+				p.git = text
+			case "subdirectory":
+				p.subdirectory = text
+			case "path":
+				p.path = text
+			case "url":
+				p.url = text
+			case "markers":
+				p.markers = text
+			case "python":
+				p.python = text
+			}
+		}
+	}
+	// Only one of the git references is allowed by poetry
+	for _, key := range []string{"rev", "tag", "branch"} {
+		if v, ok := mapping[key].(string); ok {
+			p.ref = v
+		}
+	}
+	if extras, ok := mapping["extras"].([]interface{}); ok {
+		for _, extra := range extras {
+			if text, ok := extra.(string); ok {
+				p.extras = append(p.extras, text)
+			}
+		}
+	}
+	p.optional, _ = mapping["optional"].(bool)
+	if p.version == "" && p.git == "" && p.path == "" && p.url == "" {
+		return fmt.Errorf("one of version, git, path or url fields is required")
 	}
 	return nil
 }
 
+// Requirement returns the pip requirement of a dependency, e.g. "requests[socks]>=2.31,<3" for a
+// caret constraint or "lib @ git+ssh://git@github.com/org/lib.git@v1" for a git repository.
+// Git repositories given as scp-like addresses are converted to ssh urls, which are detected as
+// ssh dependencies. Local path dependencies use the file scheme, e.g. "lib @ file://../libs/lib",
+// and are installed from the build context, see LocalDependency.
+// The markers and the python constraint of the dependency are added as environment markers,
+// so that pip skips the dependency when poetry would, e.g. `; python_version < "3.11"`.
+func (p *PoetryDependency) Requirement(name string) (string, bool) {
+	requirement, ok := p.requirement(name)
+	if !ok {
+		return "", false
+	}
+	var markers []string
+	if p.markers != "" {
+		markers = append(markers, p.markers)
+	}
+	if python := pythonMarker(p.python); python != "" {
+		markers = append(markers, python)
+	}
+	switch len(markers) {
+	case 1:
+		requirement += " ; " + markers[0]
+	case 2:
+		requirement += " ; (" + markers[0] + ") and (" + markers[1] + ")"
+	}
+	return requirement, true
+}
+
+// pythonMarker translates the python constraint of a poetry dependency to an environment marker,
+// e.g. python_version >= "3.8" and python_version < "4" for ^3.8. Patch releases are compared
+// with the full python version.
+func pythonMarker(constraint string) string {
+	var alternatives []string
+	for _, alternative := range strings.Split(poetryConstraint(constraint), "||") {
+		var clauses []string
+		for _, clause := range strings.Split(alternative, ",") {
+			m := pep440SpecifierRegex.FindStringSubmatch(strings.TrimSpace(clause))
+			if m == nil {
+				continue
+			}
+			variable := "python_version"
+			if strings.Count(strings.TrimSuffix(m[2], ".*"), ".") > 1 {
+				variable = "python_full_version"
+			}
+			clauses = append(clauses, fmt.Sprintf("%s %s \"%s\"", variable, m[1], m[2]))
+		}
+		if len(clauses) > 0 {
+			alternatives = append(alternatives, strings.Join(clauses, " and "))
+		}
+	}
+	if len(alternatives) > 1 {
+		return "(" + strings.Join(alternatives, ") or (") + ")"
+	}
+	return strings.Join(alternatives, "")
+}
+
+// requirement returns the pip requirement of a dependency, without environment markers
+func (p *PoetryDependency) requirement(name string) (string, bool) {
+	if len(p.extras) > 0 {
+		name += "[" + strings.Join(p.extras, ",") + "]"
+	}
+	switch {
+	case p.git != "":
+		url := p.git
+		if !strings.Contains(url, "://") {
+			// git@github.com:org/lib.git is ssh://git@github.com/org/lib.git
+			url = "ssh://" + strings.Replace(url, ":", "/", 1)
+		}
+		if !strings.HasPrefix(url, "git+") {
+			url = "git+" + url
+		}
+		if p.ref != "" {
+			url += "@" + p.ref
+		}
+		if p.subdirectory != "" {
+			url += "#subdirectory=" + p.subdirectory
+		}
+		return name + " @ " + url, true
+	case p.url != "":
+		return name + " @ " + p.url, true
+	case p.path != "":
+		return name + " @ file://" + p.path, true
+	}
+	constraint := poetryConstraint(p.version)
+	if strings.Contains(constraint, "||") {
+		// Alternatives can not be expressed as a requirement, pip resolves any version
+		constraint = ""
+	}
+	return name + constraint, true
+}
+
+// PoetryGroup is a dependency group of a poetry project. Groups are installed when they are
+// selected by a target, whether they are optional or not.
+type PoetryGroup struct {
+	Dependencies map[string]PoetryDependency `toml:"dependencies"`
+}
+
+// PoetryMainGroup is the group of the dependencies of [tool.poetry.dependencies]
+const PoetryMainGroup = "main"
+
+// Requirements returns the pip requirements of the dependencies of a group of a poetry project,
+// sorted by name. The main group is made of the dependencies of [tool.poetry.dependencies], and
+// the dev group also includes the legacy dev-dependencies.
+// Optional dependencies are only installed when they belong to one of the given poetry extras.
+func (p *Poetry) Requirements(group string, extras []string) []string {
+	selected := map[string]bool{}
+	for _, extra := range extras {
+		for _, name := range p.Extras[extra] {
+			selected[name] = true
+		}
+	}
+	dependencies := map[string]PoetryDependency{}
+	switch group {
+	case PoetryMainGroup:
+		dependencies = p.Dependencies
+	default:
+		for name, dependency := range p.Group[group].Dependencies {
+			dependencies[name] = dependency
+		}
+		if group == "dev" {
+			for name, dependency := range p.DevDependencies {
+				dependencies[name] = dependency
+			}
+		}
+	}
+	var requirements []string
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dependency := dependencies[name]
+		if name == "python" || (dependency.optional && !selected[name]) {
+			continue
+		}
+		if requirement, ok := dependency.Requirement(name); ok {
+			requirements = append(requirements, requirement)
+		}
+	}
+	return requirements
+}
+
+// HasGroup returns whether a dependency group is declared by a poetry project
+func (p *Poetry) HasGroup(group string) bool {
+	if _, ok := p.Group[group]; ok {
+		return true
+	}
+	return group == PoetryMainGroup || (group == "dev" && len(p.DevDependencies) > 0)
+}
+
 var (
 	_ toml.Unmarshaler = (*PoetryAuthor)(nil)
 	_ toml.Unmarshaler = (*PoetryDependency)(nil)
@@ -2,43 +2,242 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"regexp"
+	"sort"
 	"strings"
 
-	"github.com/hashicorp/go-version"
+	"github.com/BurntSushi/toml"
 )
 
 var (
-	ALLOWED_PYTHON_VERSIONS = []string{"3.12", "3.11", "3.10", "3.9", "3.8", "3.7", "3.6"}
+	ALLOWED_PYTHON_VERSIONS = []string{"3.14", "3.13", "3.12", "3.11", "3.10", "3.9", "3.8", "3.7", "3.6"}
 )
 
-func GetPythonVersion(requires string, candidate string) (string, error) {
+var pythonImageTagRegex = regexp.MustCompile(`^\d+(\.\d+(\.\d+((a|b|rc)\d+)?)?t?)?$`)
+
+// PythonImageTag checks that a python version can be used as the tag of the official python images,
+// e.g. 3, 3.11, 3.11.9, 3.13.0rc1 or 3.13t
+func PythonImageTag(version string) bool {
+	return pythonImageTagRegex.MatchString(version)
+}
+
+// FreeThreaded returns whether a python version selects the free-threaded build of python, e.g. 3.13t
+func FreeThreaded(version string) bool {
+	return strings.HasSuffix(version, "t")
+}
+
+// freeThreadedSince is the first python version with a free-threaded build
+var freeThreadedSince = pep440Version{release: []int{3, 13}, pre: [2]int{-1, 0}, post: -1, dev: -1}
+
+// parsePythonVersion parses a python version used as tag of the python images. Free-threaded
+// versions are compared without their suffix, so that 3.13t satisfies requires-python >=3.13.
+func parsePythonVersion(version string) (pep440Version, error) {
+	if !PythonImageTag(version) {
+		return pep440Version{}, fmt.Errorf("version %s is not a CPython version available as tag of the python images, e.g. 3.11, 3.11.9 or 3.13t", version)
+	}
+	v, err := parsePEP440Version(strings.TrimSuffix(version, "t"))
+	if err != nil {
+		return v, err
+	}
+	if FreeThreaded(version) && (len(v.release) < 2 || v.compare(freeThreadedSince) < 0) {
+		return v, fmt.Errorf("version %s is not valid: free-threaded python is only available since python 3.13", version)
+	}
+	return v, nil
+}
+
+// PatchPythonVersion returns whether a python version pins a patch release, e.g. 3.11.9,
+// whose images may not be published for every flavor
+func PatchPythonVersion(version string) bool {
+	return strings.Count(version, ".") == 2
+}
+
+// GetPythonVersion returns the candidate python version when it satisfies the requires-python
+// specifiers, or the most recent allowed python version satisfying them when there is no candidate.
+// Allowed versions default to ALLOWED_PYTHON_VERSIONS, and are tried from the newest whatever their order.
+// Specifiers follow PEP 440, e.g. ">=3.8,<3.12", "~=3.10" or "==3.11.*", alternatives of translated
+// poetry constraints being separated by ||, see Poetry.PythonRequires.
+// Candidates pinning a patch release, e.g. 3.11.9, or selecting the free-threaded build, e.g. 3.13t,
+// are used as they are in the tags of the images.
+func GetPythonVersion(requires string, candidate string, allowed []string) (string, error) {
 	// When we read version from file, there might be a leading line break
 	requires = strings.TrimSpace(strings.Split(requires, "\n")[0])
 	candidate = strings.TrimSpace(strings.Split(candidate, "\n")[0])
-	constraints, err := version.NewConstraint(requires)
+	specifiers, err := parsePythonRequirement(requires)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("GetPythonVersion: %w", err)
 	}
 	if candidate != "" {
-		v, err := version.NewVersion(candidate)
+		v, err := parsePythonVersion(candidate)
 		if err != nil {
-			return "", fmt.Errorf("GetPythonVersion: version %s is not valid: %w", candidate, err)
+			return "", fmt.Errorf("GetPythonVersion: %w", err)
 		}
-		if constraints.Check(v) {
+		if specifiers.contains(candidate, v) {
 			return candidate, nil
 		} else {
 			return "", fmt.Errorf("GetPythonVersion: version %s does not satisfy the constraint %s", candidate, requires)
 		}
 	}
-	for _, target := range ALLOWED_PYTHON_VERSIONS {
-		v, err := version.NewVersion(target)
+	if len(allowed) == 0 {
+		allowed = ALLOWED_PYTHON_VERSIONS
+	}
+	versions, err := sortedPythonVersions(allowed)
+	if err != nil {
+		return "", fmt.Errorf("GetPythonVersion: %w", err)
+	}
+	for _, target := range versions {
+		if specifiers.contains(target.raw, target.version) {
+			return target.raw, nil
+		}
+	}
+	return "", fmt.Errorf("GetPythonVersion: no version satisfies the constraint %s", requires)
+}
+
+// pythonRequirement is a list of alternative specifier sets, which is satisfied by the versions
+// satisfying any of them
+type pythonRequirement []pep440Specifiers
+
+// parsePythonRequirement parses the specifier sets of a python requirement separated by ||
+func parsePythonRequirement(requires string) (pythonRequirement, error) {
+	var requirement pythonRequirement
+	for _, alternative := range strings.Split(requires, "||") {
+		specifiers, err := parsePEP440Specifiers(alternative)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		if constraints.Check(v) {
-			return target, nil
+		requirement = append(requirement, specifiers)
+	}
+	return requirement, nil
+}
+
+func (r pythonRequirement) contains(raw string, v pep440Version) bool {
+	for _, specifiers := range r {
+		if specifiers.contains(raw, v) {
+			return true
 		}
 	}
-	return "", fmt.Errorf("GetPythonVersion: no version satisfies the constraint %s", requires)
+	return false
+}
+
+// pythonVersion is an allowed python version, along with its parsed version
+type pythonVersion struct {
+	raw     string
+	version pep440Version
+}
+
+// sortedPythonVersions parses allowed python versions and sorts them from the newest
+func sortedPythonVersions(allowed []string) ([]pythonVersion, error) {
+	versions := make([]pythonVersion, 0, len(allowed))
+	for _, raw := range allowed {
+		raw = strings.TrimSpace(raw)
+		v, err := parsePythonVersion(raw)
+		if err != nil {
+			return nil, fmt.Errorf("allowed %w", err)
+		}
+		versions = append(versions, pythonVersion{raw: raw, version: v})
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].version.compare(versions[j].version) > 0
+	})
+	return versions, nil
+}
+
+// PythonVersionFiles are the files of the context directory from which the python version is read,
+// by order of precedence: pyenv's .python-version, asdf's .tool-versions and mise's configuration
+var PythonVersionFiles = []string{".python-version", ".tool-versions", "mise.toml", ".mise.toml"}
+
+// ReadPythonVersion returns the python version written in the first of the PythonVersionFiles
+// which pins python, or an empty string. Files are read with a function returning an error
+// when the file does not exist.
+func ReadPythonVersion(read func(name string) ([]byte, error)) string {
+	for _, name := range PythonVersionFiles {
+		content, err := read(name)
+		if err != nil || len(content) == 0 {
+			continue
+		}
+		if version := parsePythonVersionFile(name, string(content)); version != "" {
+			return version
+		}
+	}
+	return ""
+}
+
+// parsePythonVersionFile returns the python version of a file of PythonVersionFiles. When several
+// versions are listed, the first CPython version is used, e.g. 3.11.9 for "pypy3.10 cpython-3.11.9".
+// Versions which do not pin python, such as system or latest, are ignored. When no version is
+// a CPython version, the first one is returned so that it is reported as invalid.
+func parsePythonVersionFile(name string, content string) string {
+	var versions []string
+	switch name {
+	case ".python-version":
+		versions = versionFileLines(content)
+	case ".tool-versions":
+		for _, line := range versionFileLines(content) {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "python" {
+				versions = fields[1:]
+				break
+			}
+		}
+	default:
+		var mise struct {
+			Tools map[string]interface{} `toml:"tools"`
+		}
+		if _, err := toml.Decode(content, &mise); err != nil {
+			return ""
+		}
+		versions = miseToolVersions(mise.Tools["python"])
+	}
+	unsupported := ""
+	for _, version := range versions {
+		if version == "system" || version == "latest" {
+			continue
+		}
+		if cpython, ok := cpythonVersion(version); ok {
+			return cpython
+		}
+		if unsupported == "" {
+			unsupported = version
+		}
+	}
+	return unsupported
+}
+
+// cpythonVersion returns the version of a CPython entry of a version file, without the prefixes
+// and suffixes of the tools, e.g. 3.12 for cpython-3.12-linux-x86_64-gnu or 3.11.9 for the
+// virtualenv 3.11.9/envs/api, and whether the entry is a CPython version
+func cpythonVersion(entry string) (string, bool) {
+	version, _, _ := strings.Cut(entry, "/")
+	if trimmed := strings.TrimPrefix(strings.ToLower(version), "cpython-"); trimmed != strings.ToLower(version) {
+		version, _, _ = strings.Cut(trimmed, "-")
+	}
+	return version, PythonImageTag(version)
+}
+
+// versionFileLines returns the lines of a version file, without blank lines and comments
+func versionFileLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// miseToolVersions returns the versions of a tool of mise.toml, which is either a version,
+// a list of versions, or a table with a version key
+func miseToolVersions(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var versions []string
+		for _, item := range v {
+			versions = append(versions, miseToolVersions(item)...)
+		}
+		return versions
+	case map[string]interface{}:
+		return miseToolVersions(v["version"])
+	}
+	return nil
 }
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var requirementCommentRegex = regexp.MustCompile(`(^|\s+)#.*$`)
+
+// ParseRequirementsFile reads a requirements file and the requirements and constraints
+// files it references. It returns the requirements found in the files, without
+// comments and options, and the paths of all the files which were read.
+// Referenced files are resolved relative to the file referencing them.
+func ParseRequirementsFile(name string, read func(name string) ([]string, error)) ([]string, []string, error) {
+	r := &requirementsReader{read: read, seen: map[string]bool{}}
+	if err := r.readFile(path.Clean(name), false); err != nil {
+		return nil, nil, err
+	}
+	return r.requirements, r.files, nil
+}
+
+type requirementsReader struct {
+	read         func(name string) ([]string, error)
+	seen         map[string]bool
+	requirements []string
+	files        []string
+}
+
+func (r *requirementsReader) readFile(name string, constraints bool) error {
+	if r.seen[name] {
+		return nil
+	}
+	r.seen[name] = true
+	r.files = append(r.files, name)
+	lines, err := r.read(name)
+	if err != nil {
+		return fmt.Errorf("failed to read requirements file %s: %w", name, err)
+	}
+	for _, line := range joinRequirementLines(lines) {
+		fields := strings.Fields(requirementCommentRegex.ReplaceAllString(line, ""))
+		if len(fields) == 0 {
+			continue
+		}
+		option, value := requirementOption(fields)
+		switch option {
+		case "-r", "--requirement":
+			if strings.Contains(value, "://") {
+				// Remote files are read by pip at build time
+				continue
+			}
+			if err := r.readFile(path.Join(path.Dir(name), value), constraints); err != nil {
+				return err
+			}
+		case "-c", "--constraint":
+			if strings.Contains(value, "://") {
+				continue
+			}
+			if err := r.readFile(path.Join(path.Dir(name), value), true); err != nil {
+				return err
+			}
+		case "-e", "--editable":
+			if !constraints {
+				r.requirements = append(r.requirements, value)
+			}
+		case "":
+			if !constraints {
+				r.requirements = append(r.requirements, requirementSpecifier(fields))
+			}
+		default:
+			// Global options such as --index-url do not declare requirements
+		}
+	}
+	return nil
+}
+
+// joinRequirementLines joins the lines ending with a backslash with the following line
+func joinRequirementLines(lines []string) []string {
+	var joined []string
+	current := ""
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		joined = append(joined, current+line)
+		current = ""
+	}
+	if current != "" {
+		joined = append(joined, current)
+	}
+	return joined
+}
+
+// requirementOption returns the option and its value when the line starts with an option,
+// e.g. "-r other.txt", "--requirement=other.txt" or "-rother.txt"
+func requirementOption(fields []string) (string, string) {
+	first := fields[0]
+	if !strings.HasPrefix(first, "-") {
+		return "", ""
+	}
+	option, value, ok := strings.Cut(first, "=")
+	if !ok && !strings.HasPrefix(first, "--") && len(first) > 2 {
+		option, value = first[:2], first[2:]
+	}
+	if value == "" && len(fields) > 1 {
+		value = fields[1]
+	}
+	return option, value
+}
+
+// requirementSpecifier returns the requirement of a line without its per-requirement
+// options such as --hash. Environment markers are kept.
+func requirementSpecifier(fields []string) string {
+	var specifier []string
+	for _, field := range fields {
+		if strings.HasPrefix(field, "--") {
+			break
+		}
+		specifier = append(specifier, field)
+	}
+	return strings.Join(specifier, " ")
+}
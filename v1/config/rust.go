@@ -0,0 +1,50 @@
+package config
+
+import "regexp"
+
+// rustDependencies are python dependencies built with pyo3 or maturin, which require a rust
+// toolchain when they are built from source. Images based on alpine build them from source
+// when no musllinux wheel is published for the python version or the architecture.
+var rustDependencies = []string{
+	"bcrypt",
+	"cryptography",
+	"jiter",
+	"orjson",
+	"polars",
+	"pydantic",
+	"pydantic-core",
+	"rpds-py",
+	"tiktoken",
+	"tokenizers",
+	"watchfiles",
+}
+
+// rustToolchainRegex matches the toolchains accepted by rustup, e.g. stable or 1.78.0
+var rustToolchainRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// RustToolchain checks whether a rust toolchain is valid: a channel, a version or none
+func RustToolchain(toolchain string) bool {
+	return toolchain == "" || rustToolchainRegex.MatchString(toolchain)
+}
+
+// detectRustToolchain returns the rust toolchain installed in the build stage. The toolchain of
+// the target is installed unless it is none, otherwise the stable toolchain is installed when a
+// python dependency requires rust and the flavor is alpine. Detection can be disabled.
+func detectRustToolchain(toolchain string, dependencies []string, flavor string, detect bool) string {
+	switch {
+	case toolchain == "none":
+		return ""
+	case toolchain != "":
+		return toolchain
+	case !detect || flavor != "alpine":
+		return ""
+	}
+	for _, dependency := range dependencies {
+		for _, name := range rustDependencies {
+			if requirementName(dependency) == name {
+				return "stable"
+			}
+		}
+	}
+	return ""
+}
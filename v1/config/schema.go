@@ -0,0 +1,233 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Descriptions of the keys of the microb configuration used in the JSON schema, by struct
+var schemaDescriptions = map[reflect.Type]map[string]string{
+	reflect.TypeOf(MicrobTarget{}): {
+		"api_version":                "Api version of the microb frontend.",
+		"flavor":                     "Flavor of the base images.",
+		"entrypoint":                 "Entrypoint of the final image.",
+		"command":                    "Command of the final image.",
+		"python_version":             "Version of the python interpreter, e.g. 3.11, 3.11.9 to pin a patch release or 3.13t for the free-threaded build. Defaults to the version of .python-version, .tool-versions or mise.toml.",
+		"requirements":               "Path of a requirements file used to install the python dependencies instead of the project dependencies.",
+		"indices":                    "Additional python package indices.",
+		"extras":                     "Optional dependency groups of the project to install.",
+		"groups":                     "Poetry dependency groups to install, main being the dependencies of [tool.poetry.dependencies] and dev the legacy dev-dependencies. Defaults to main.",
+		"environment":                "Environment variables of the build stage and of the final image.",
+		"labels":                     "Labels of the final image.",
+		"annotations":                "Annotations of the manifests of the exported image, and of its index when exported as an index.",
+		"image":                      "Name of the image, e.g. ghcr.io/org/app-{target}:{version}, with the {target}, {version}, {git_sha} and {git_short_sha} placeholders.",
+		"build_deps":                 "System packages installed in the build stage only, either for all flavors or by flavor.",
+		"system_deps":                "System packages installed in the final image only, either for all flavors or by flavor.",
+		"copy_files":                 "Files copied into the final image.",
+		"copy_files_before_build":    "Files copied into the build stage.",
+		"add_files":                  "Files added into the final image.",
+		"add_files_before_build":     "Files added into the build stage.",
+		"volumes":                    "Paths declared as volumes in the final image.",
+		"stop_signal":                "Signal sent to the container to make it exit.",
+		"expose":                     "Ports exposed by the final image, e.g. 8000 or 8000/udp.",
+		"healthcheck":                "Command checking the health of the containers of the final image.",
+		"shell":                      "Shell used for the shell form of commands in the final image.",
+		"user":                       "Name of the non-root user running the final image, made of lowercase letters, digits, underscores and dashes.",
+		"uid":                        "Uid of the non-root user running the final image. Use run_as_root instead of a uid of 0.",
+		"gid":                        "Gid of the group of the non-root user running the final image.",
+		"home":                       "Absolute path of the home directory of the non-root user running the final image.",
+		"prefix":                     "Directory where python dependencies and the project are installed in the final image, instead of the .local directory of the home directory.",
+		"run_as_root":                "Run the final image as root instead of a non-root user.",
+		"init":                       "Use tini as init process of the final image.",
+		"compile_bytecode":           "Compile the installed packages and the project to bytecode in the build stage, reducing the startup time of the final image.",
+		"optimize":                   "Optimization level of the final image: 1 removes assertions and 2 also removes docstrings. Installed packages are compiled at this level.",
+		"package_cache_sharing":      "Sharing mode of the cache mounts of apt and apk in the build stage: locked, shared or private.",
+		"keep_package_cache":         "Keep the packages downloaded by apt and apk in their cache mounts, disabling the docker-clean configuration of debian images.",
+		"native_build_cache":         "Compile the native extensions of the dependencies built from source with ccache, whose cache is kept in a cache mount between builds.",
+		"rust_toolchain":             "Rust toolchain installed by rustup in the build stage to build pyo3 and maturin dependencies from source, e.g. stable or 1.78.0, or none to disable the detection of the alpine flavor.",
+		"cleanup":                    "Clean up of the installed python dependencies in the build stage.",
+		"slim_runtime":               "Remove pip, setuptools, wheel and ensurepip from the Python installation of the final image.",
+		"entrypoint_script":          "Name of the script of [project.scripts] used as entrypoint.",
+		"disable_metadata_labels":    "Do not populate OCI labels from the [project] section.",
+		"compression":                "Compression of the layers of the exported image.",
+		"oci_mediatypes":             "Use OCI media types in the exported image manifest.",
+		"inline_cache":               "Embed cache metadata into the exported image.",
+		"cache_id":                   "Prefix of the ids of the cache mounts used during build.",
+		"network":                    "Network mode used to install python dependencies and the project.",
+		"context_dir":                "Directory of the build context used as project root.",
+		"member":                     "Directory of the workspace member built by the target, relative to the context directory.",
+		"src_include":                "Paths of the project sources copied into the build stage.",
+		"src_exclude":                "Patterns of the files excluded from the build context.",
+		"src_detect":                 "Detect the project sources copied into the build stage.",
+		"project_bind_mount":         "Bind mount the project sources instead of copying them into the build stage.",
+		"wheelhouse":                 "Directory of wheels from which python dependencies and the project are installed without index.",
+		"wheelhouse_from":            "Named context or image containing the wheelhouse instead of the build context.",
+		"builder_image_digest":       "Digest pinning the base image of the build stage, e.g. sha256:4f53....",
+		"final_image_digest":         "Digest pinning the base image of the final stage, e.g. sha256:4f53....",
+		"hermetic":                   "Install python dependencies without network, from a wheelhouse, on base images pinned by digest.",
+		"cross_compile":              "Run the build stage on the build platform and install the wheels of the target platform.",
+		"ignore_file":                "Path of the ignore file used to exclude files from the build context.",
+		"pip_args":                   "Additional arguments of the pip install commands.",
+		"pip_config_secret":          "Id of the secret mounted as pip configuration file.",
+		"netrc_secret":               "Id of the secret mounted as netrc file.",
+		"apt_mirror":                 "Base url of the debian mirror used to install system packages.",
+		"apt_proxy":                  "Url of the proxy used by apt to install system packages.",
+		"apt_snapshot":               "Timestamp of the debian snapshot used to install system packages, e.g. 20240101T000000Z.",
+		"apt_repositories":           "Additional apt repositories used to install system packages.",
+		"apk_repositories":           "Urls of additional apk repositories used to install system packages.",
+		"native_build_deps":          "System packages required to build python dependencies from source, by python dependency.",
+		"disable_auto_build_deps":    "Do not add the build dependencies of well-known python dependencies.",
+		"pre_install":                "Shell commands run in the build stage before installing python dependencies.",
+		"post_install":               "Shell commands run in the build stage after installing the project.",
+		"runtime_post_install":       "Shell commands run as root in the final stage after copying files.",
+		"extra_build_instructions":   "Raw Dockerfile instructions inserted in the build stage.",
+		"extra_runtime_instructions": "Raw Dockerfile instructions inserted in the final stage.",
+	},
+	reflect.TypeOf(Index{}): {
+		"url":             "Url of the index.",
+		"username":        "Username used to authenticate.",
+		"username_secret": "Id of the secret containing the username.",
+		"password":        "Password used to authenticate.",
+		"password_secret": "Id of the secret containing the password.",
+		"trust":           "Add the host of the index as trusted host.",
+		"primary":         "Use the index instead of the default index.",
+		"mirrors":         "Urls of mirrors of the index.",
+	},
+	reflect.TypeOf(Copy{}): {
+		"from":  "Stage, context or image to copy from.",
+		"src":   "Source path.",
+		"dst":   "Destination path.",
+		"link":  "Copy files into an independent layer.",
+		"chmod": "Permissions of the copied files.",
+		"chown": "Owner of the copied files.",
+	},
+	reflect.TypeOf(Add{}): {
+		"checksum": "Checksum used to verify file integrity.",
+		"src":      "Source path.",
+		"dst":      "Destination path.",
+	},
+	reflect.TypeOf(Healthcheck{}): {
+		"command":      "Command run in exec form, e.g. [\"curl\", \"-f\", \"http://localhost:8000/health\"].",
+		"interval":     "Time between two checks, e.g. 30s.",
+		"timeout":      "Time after which a check is considered failed, e.g. 5s.",
+		"start_period": "Time during which failed checks are not counted, e.g. 10s.",
+		"retries":      "Number of consecutive failed checks making the container unhealthy.",
+	},
+	reflect.TypeOf(Cleanup{}): {
+		"keep_tests":         "Keep the tests directories of the installed dependencies.",
+		"keep_debug_symbols": "Keep the debug symbols of the shared libraries of the installed dependencies.",
+		"keep_bytecode":      "Keep the bytecode of the installed dependencies.",
+		"exclude":            "Import names of the packages which are not cleaned up, e.g. [\"pandas\", \"hypothesis\"].",
+	},
+	reflect.TypeOf(AptRepository{}): {
+		"url":        "Url of the repository.",
+		"suite":      "Suite of the repository.",
+		"components": "Components of the repository.",
+		"key_url":    "Url of the armored gpg key used to sign the repository.",
+		"key_secret": "Id of the secret containing the armored gpg key used to sign the repository.",
+	},
+}
+
+// Values accepted by the keys of the microb configuration, see the validation functions
+var schemaEnums = map[string][]string{
+	"api_version":           {"v1"},
+	"flavor":                {"debian", "alpine"},
+	"compression":           {"gzip", "zstd", "estargz", "uncompressed"},
+	"network":               {"default", "none", "host"},
+	"package_cache_sharing": {"locked", "shared", "private"},
+}
+
+// Keys which are required in the tables of the microb configuration, by struct
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(Index{}):         {"url"},
+	reflect.TypeOf(Copy{}):          {"src", "dst"},
+	reflect.TypeOf(Add{}):           {"src", "dst"},
+	reflect.TypeOf(AptRepository{}): {"url", "suite"},
+	reflect.TypeOf(Healthcheck{}):   {"command"},
+}
+
+// JSONSchema returns the JSON schema of the [tool.microb] section of pyproject.toml files.
+// The schema is generated from the configuration structs, so that it is always up to date.
+func JSONSchema() ([]byte, error) {
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "microb",
+		"description": "Configuration of the microb buildkit frontend, in the [tool.microb] section of pyproject.toml.",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"python_versions": map[string]interface{}{
+				"description": "Python versions resolved from requires-python when a target does not set python_version, the newest satisfying version being used. Defaults to the maintained python versions.",
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string"},
+			},
+			"target": map[string]interface{}{
+				"description":          "Build targets, by name.",
+				"type":                 "object",
+				"additionalProperties": typeSchema(reflect.TypeOf(MicrobTarget{})),
+			},
+		},
+		"additionalProperties": false,
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the JSON schema of the values decoded into a type
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(Packages{}):
+		// Packages are either a list or a table of lists keyed by flavor
+		list := map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				list,
+				map[string]interface{}{
+					"type":                 "object",
+					"propertyNames":        map[string]interface{}{"enum": schemaEnums["flavor"]},
+					"additionalProperties": list,
+				},
+			},
+		}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+			if name == "" {
+				continue
+			}
+			property := typeSchema(t.Field(i).Type)
+			if description, ok := schemaDescriptions[t][name]; ok {
+				property["description"] = description
+			}
+			if enum, ok := schemaEnums[name]; ok && t == reflect.TypeOf(MicrobTarget{}) {
+				property["enum"] = enum
+			}
+			properties[name] = property
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if required, ok := schemaRequired[t]; ok {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
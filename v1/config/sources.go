@@ -0,0 +1,198 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Setuptools is a struct that represents a tool.setuptools section in a pyproject.toml file (partially)
+type Setuptools struct {
+	Packages   SetuptoolsPackages `toml:"packages"`
+	PackageDir map[string]string  `toml:"package-dir"`
+	PyModules  []string           `toml:"py-modules"`
+	Dynamic    SetuptoolsDynamic  `toml:"dynamic"`
+}
+
+// SetuptoolsPackages represents the packages of a setuptools project.
+// Packages can be declared either as a list of package names or as a table
+// with a find key used for automatic discovery.
+type SetuptoolsPackages struct {
+	Names []string
+	Where []string
+}
+
+func (p *SetuptoolsPackages) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, name := range v {
+			text, ok := name.(string)
+			if !ok {
+				return fmt.Errorf("expected string, got %T", name)
+			}
+			p.Names = append(p.Names, text)
+		}
+	case map[string]interface{}:
+		find, ok := v["find"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		where, ok := find["where"].([]interface{})
+		if !ok {
+			// Packages are discovered in the project root by default
+			p.Where = []string{"."}
+			return nil
+		}
+		for _, dir := range where {
+			text, ok := dir.(string)
+			if !ok {
+				return fmt.Errorf("expected string, got %T", dir)
+			}
+			p.Where = append(p.Where, text)
+		}
+	default:
+		return fmt.Errorf("expected list or map, got %T", value)
+	}
+	return nil
+}
+
+// Readme is a struct that represents the readme files of a project.
+// Readme can be declared either as a path, as a table with a file key,
+// or as a list of paths when using poetry.
+type Readme struct {
+	Files []string
+}
+
+func (r *Readme) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		r.Files = []string{v}
+	case map[string]interface{}:
+		if file, ok := v["file"].(string); ok {
+			r.Files = []string{file}
+		}
+	case []interface{}:
+		for _, file := range v {
+			text, ok := file.(string)
+			if !ok {
+				return fmt.Errorf("expected string, got %T", file)
+			}
+			r.Files = append(r.Files, text)
+		}
+	default:
+		return fmt.Errorf("expected string, list or map, got %T", value)
+	}
+	return nil
+}
+
+var (
+	_ toml.Unmarshaler = (*SetuptoolsPackages)(nil)
+	_ toml.Unmarshaler = (*Readme)(nil)
+)
+
+// DetectSources returns the paths of the sources required to install a project,
+// relative to the project root.
+// Package directories are read from the setuptools or poetry configuration, and
+// default to the src-layout or flat-layout conventions. The exists function is
+// used to check whether a path exists in the project root.
+// An empty slice is returned when the package directories cannot be detected.
+func DetectSources(pyproject *PyProject, exists func(name string) bool) []string {
+	packages := detectPackages(pyproject, exists)
+	if len(packages) == 0 {
+		return nil
+	}
+	sources := []string{"pyproject.toml"}
+	sources = append(sources, pyproject.Project.Readme.Files...)
+	sources = append(sources, pyproject.Tool.Poetry.Readme.Files...)
+	if pyproject.Project.License.File != "" {
+		sources = append(sources, pyproject.Project.License.File)
+	}
+	for _, name := range []string{"setup.py", "setup.cfg"} {
+		if exists(name) {
+			sources = append(sources, name)
+		}
+	}
+	// Files of dynamic dependencies are read by setuptools when building the project
+	sources = append(sources, pyproject.Tool.Setuptools.Dynamic.Files()...)
+	return append(sources, packages...)
+}
+
+func detectPackages(pyproject *PyProject, exists func(name string) bool) []string {
+	var packages []string
+	setuptools := pyproject.Tool.Setuptools
+	for _, name := range setuptools.Packages.Names {
+		packages = append(packages, setuptoolsPackage(&setuptools, name, exists))
+	}
+	for _, name := range setuptools.PyModules {
+		packages = append(packages, setuptoolsPackageDir(&setuptools, name)+".py")
+	}
+	for _, where := range setuptools.Packages.Where {
+		if path.Clean(where) == "." {
+			// Packages are discovered in the whole project root
+			return nil
+		}
+		packages = append(packages, where)
+	}
+	for _, pkg := range pyproject.Tool.Poetry.Packages {
+		if strings.ContainsAny(pkg.Include, "*?[") {
+			// Glob patterns can not be copied to a fixed destination
+			return nil
+		}
+		packages = append(packages, path.Join(pkg.From, pkg.Include))
+	}
+	if len(packages) > 0 {
+		return packages
+	}
+	// Packages of the src-layout, including namespace packages, are all located in the src directory
+	if exists("src") {
+		return []string{"src"}
+	}
+	name := pyproject.Project.Name
+	if name == "" {
+		name = pyproject.Tool.Poetry.Name
+	}
+	if name == "" {
+		return nil
+	}
+	flat := strings.ToLower(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+	if exists(flat) {
+		return []string{flat}
+	}
+	if exists(flat + ".py") {
+		return []string{flat + ".py"}
+	}
+	// Projects named after a portion of a namespace package, e.g. acme-foo for acme/foo,
+	// only include the portion, other portions of the namespace belong to other projects
+	namespace := strings.ToLower(strings.NewReplacer("-", "/", ".", "/").Replace(name))
+	if dir, _ := path.Split(namespace); dir != "" && !exists(path.Join(dir, "__init__.py")) && exists(namespace) {
+		return []string{namespace}
+	}
+	return nil
+}
+
+// setuptoolsPackage returns the directory of a package to copy, which is the directory of its
+// top-level package, unless the top-level package is a namespace package (PEP 420), i.e. has no
+// __init__.py file, in which case the directory of the first regular package is returned so that
+// other portions of the namespace are not copied.
+func setuptoolsPackage(s *Setuptools, name string, exists func(name string) bool) string {
+	parts := strings.Split(name, ".")
+	dir := setuptoolsPackageDir(s, parts[0])
+	for _, part := range parts[1:] {
+		if exists(path.Join(dir, "__init__.py")) {
+			break
+		}
+		dir = path.Join(dir, part)
+	}
+	return dir
+}
+
+// setuptoolsPackageDir returns the directory of a top-level package or module
+// according to the package-dir mapping
+func setuptoolsPackageDir(s *Setuptools, name string) string {
+	if dir, ok := s.PackageDir[name]; ok {
+		return dir
+	}
+	return path.Join(s.PackageDir[""], name)
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+const (
+	DefaultUser = "nonroot"
+	DefaultUid  = 65532
+)
+
+// userNameRegex matches the names accepted by both useradd and adduser
+var userNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// homeRegex matches the home directories which can be given unquoted to useradd and adduser
+var homeRegex = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// RuntimeUser returns the user, uid, gid and home directory of the user running the final image.
+// Default values are used for options omitted in the target.
+func RuntimeUser(t *MicrobTarget) (string, int, int, string, error) {
+	if t.RunAsRoot {
+		if t.User != "" || t.Uid != nil || t.Gid != nil || t.Home != "" {
+			return "", 0, 0, "", fmt.Errorf("run_as_root cannot be used together with user, uid, gid or home")
+		}
+		return "root", 0, 0, "/root", nil
+	}
+	user := t.User
+	if user == "" {
+		user = DefaultUser
+	}
+	if !userNameRegex.MatchString(user) {
+		return "", 0, 0, "", fmt.Errorf("user %q must start with a lowercase letter or an underscore, followed by lowercase letters, digits, underscores or dashes", user)
+	}
+	uid := DefaultUid
+	if t.Uid != nil {
+		uid = *t.Uid
+	}
+	if uid == 0 {
+		return "", 0, 0, "", fmt.Errorf("uid 0 is the uid of root, use run_as_root instead")
+	}
+	if uid < 0 {
+		return "", 0, 0, "", fmt.Errorf("uid must be a strictly positive integer, got %d", uid)
+	}
+	// Use a group with the same id as the user by default
+	gid := uid
+	if t.Gid != nil {
+		gid = *t.Gid
+	}
+	if gid == 0 {
+		return "", 0, 0, "", fmt.Errorf("gid 0 is the gid of root, use run_as_root instead")
+	}
+	if gid < 0 {
+		return "", 0, 0, "", fmt.Errorf("gid must be a strictly positive integer, got %d", gid)
+	}
+	home := t.Home
+	if home == "" {
+		home = fmt.Sprintf("/home/%s", user)
+	}
+	if !path.IsAbs(home) {
+		return "", 0, 0, "", fmt.Errorf("home %q must be an absolute path", home)
+	}
+	if !homeRegex.MatchString(home) {
+		return "", 0, 0, "", fmt.Errorf("home %q must only contain letters, digits, dots, underscores, dashes and slashes", home)
+	}
+	return user, uid, gid, home, nil
+}
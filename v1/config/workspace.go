@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Uv is a struct that represents a tool.uv section in a pyproject.toml file (partially):
+// the sources of the dependencies and the members of a workspace, see
+// https://docs.astral.sh/uv/concepts/projects/workspaces/
+type Uv struct {
+	Sources   map[string]UvSource `toml:"sources"`
+	Workspace UvWorkspace         `toml:"workspace"`
+}
+
+// UvWorkspace is the tool.uv.workspace table of a workspace root. Members and excluded
+// directories are paths relative to the root, or glob patterns such as packages/*.
+type UvWorkspace struct {
+	Members []string `toml:"members"`
+	Exclude []string `toml:"exclude"`
+}
+
+// UvSource is the source of a dependency declared in tool.uv.sources, either a member of the
+// workspace, a local path, a git repository or an url
+type UvSource struct {
+	workspace    bool
+	path         string
+	git          string
+	ref          string
+	subdirectory string
+	url          string
+}
+
+func (s *UvSource) UnmarshalTOML(value interface{}) error {
+	// Multiple sources depend on environment markers, which are not supported: the first one is used
+	if list, ok := value.([]interface{}); ok && len(list) > 0 {
+		value = list[0]
+	}
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected map, got %T", value)
+	}
+	s.workspace, _ = mapping["workspace"].(bool)
+	for _, key := range []string{"path", "git", "subdirectory", "url"} {
+		if v, ok := mapping[key]; ok {
+			text, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s field must be a string, got %T", key, v)
+			}
+			switch key {
+			case "path":
+				s.path = text
+			case "git":
+				s.git = text
+			case "subdirectory":
+				s.subdirectory = text
+			case "url":
+				s.url = text
+			}
+		}
+	}
+	for _, key := range []string{"rev", "tag", "branch"} {
+		if v, ok := mapping[key].(string); ok {
+			s.ref = v
+		}
+	}
+	if !s.workspace && s.path == "" && s.git == "" && s.url == "" {
+		return fmt.Errorf("one of workspace, path, git or url fields is required")
+	}
+	return nil
+}
+
+var _ toml.Unmarshaler = (*UvSource)(nil)
+
+// readWorkspaceMember replaces the project tables of a workspace root by the ones of a member, read
+// from the pyproject.toml file of the member directory, so that targets of the root build the members.
+// The microb table of the root is kept, and the uv sources of the root are inherited by the member.
+func readWorkspaceMember(root *PyProject, member string, rootDir string, read func(name string) ([]byte, error)) error {
+	data, err := read(path.Join(rootDir, member, "pyproject.toml"))
+	if err != nil {
+		return fmt.Errorf("failed to read pyproject.toml of member %s: %w", member, err)
+	}
+	var pyproject PyProject
+	if _, err := toml.Decode(string(data), &pyproject); err != nil {
+		return fmt.Errorf("failed to decode pyproject.toml of member %s: %w", member, err)
+	}
+	pyproject.Tool.Poetry.fillProject(&pyproject.Project)
+	sources := map[string]UvSource{}
+	for name, source := range root.Tool.Uv.Sources {
+		sources[requirementName(name)] = source
+	}
+	for name, source := range pyproject.Tool.Uv.Sources {
+		sources[requirementName(name)] = source
+	}
+	root.Project = pyproject.Project
+	root.BuildSystem = pyproject.BuildSystem
+	root.Tool.Poetry = pyproject.Tool.Poetry
+	root.Tool.Setuptools = pyproject.Tool.Setuptools
+	root.Tool.Uv.Sources = sources
+	return nil
+}
+
+// findWorkspaceMember returns the directory of the member of a workspace named after a dependency,
+// relative to the build context. Members given as glob patterns are looked up in the directory
+// matching the name of the dependency, e.g. packages/my_lib or packages/my-lib for packages/*.
+func findWorkspaceMember(workspace *UvWorkspace, name string, rootDir string, read func(name string) ([]byte, error), exists func(name string) bool) (string, error) {
+	for _, member := range workspace.Members {
+		candidates := []string{member}
+		if strings.ContainsAny(member, "*?[") {
+			candidates = nil
+			for _, dir := range []string{name, strings.ReplaceAll(name, "-", "_"), strings.ReplaceAll(name, "-", ".")} {
+				candidate := path.Join(path.Dir(member), dir)
+				if ok, _ := path.Match(member, candidate); ok {
+					candidates = append(candidates, candidate)
+				}
+			}
+		}
+		for _, candidate := range candidates {
+			if excludedWorkspaceMember(workspace, candidate) || !exists(path.Join(rootDir, candidate, "pyproject.toml")) {
+				continue
+			}
+			data, err := read(path.Join(rootDir, candidate, "pyproject.toml"))
+			if err != nil {
+				return "", fmt.Errorf("failed to read pyproject.toml of member %s: %w", candidate, err)
+			}
+			var pyproject PyProject
+			if _, err := toml.Decode(string(data), &pyproject); err != nil {
+				return "", fmt.Errorf("failed to decode pyproject.toml of member %s: %w", candidate, err)
+			}
+			pyproject.Tool.Poetry.fillProject(&pyproject.Project)
+			if requirementName(pyproject.Project.Name) == name {
+				return path.Join(rootDir, candidate), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("dependency %s is not a member of the workspace", name)
+}
+
+// excludedWorkspaceMember checks whether a member directory is excluded from a workspace
+func excludedWorkspaceMember(workspace *UvWorkspace, dir string) bool {
+	for _, pattern := range workspace.Exclude {
+		if ok, _ := path.Match(path.Clean(pattern), dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uvRequirementRegex matches the name, the extras and the markers of a requirement
+var uvRequirementRegex = regexp.MustCompile(`^\s*([A-Za-z0-9][A-Za-z0-9._-]*)\s*(\[[^\]]*\])?([^;]*)(;.*)?$`)
+
+// applyUvSources converts the dependencies declared in tool.uv.sources to direct references, e.g.
+// "mylib @ file://../libs/mylib" for a member of the workspace, which are then installed from the
+// build context like other local dependencies. Members are looked up with a function returning
+// their directory relative to the build context, and paths are relative to the project directory.
+func applyUvSources(dependencies []string, sources map[string]UvSource, projectDir string, member func(name string) (string, error)) ([]string, error) {
+	if len(sources) == 0 {
+		return dependencies, nil
+	}
+	normalized := map[string]UvSource{}
+	for name, source := range sources {
+		normalized[requirementName(name)] = source
+	}
+	requirements := make([]string, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		m := uvRequirementRegex.FindStringSubmatch(dependency)
+		source, ok := normalized[requirementName(dependency)]
+		if m == nil || !ok || strings.Contains(m[3], "@") {
+			requirements = append(requirements, dependency)
+			continue
+		}
+		var url string
+		switch {
+		case source.workspace:
+			dir, err := member(requirementName(dependency))
+			if err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(path.Join("/", projectDir), path.Join("/", dir))
+			if err != nil {
+				return nil, err
+			}
+			url = "file://" + filepath.ToSlash(rel)
+		case source.path != "":
+			url = "file://" + source.path
+		case source.git != "":
+			url = "git+" + strings.TrimPrefix(source.git, "git+")
+			if source.ref != "" {
+				url += "@" + source.ref
+			}
+			if source.subdirectory != "" {
+				url += "#subdirectory=" + source.subdirectory
+			}
+		default:
+			url = source.url
+		}
+		requirement := m[1] + m[2] + " @ " + url
+		if m[4] != "" {
+			requirement += " " + m[4]
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
@@ -0,0 +1,163 @@
+package dockerfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Flag is a flag of an instruction, e.g. --mount=type=cache,target=/root/.cache.
+// Flags without value are rendered without the equal sign, e.g. --link.
+type Flag struct {
+	Name  string
+	Value string
+}
+
+func (f Flag) String() string {
+	if f.Value == "" {
+		return "--" + f.Name
+	}
+	return fmt.Sprintf("--%s=%s", f.Name, f.Value)
+}
+
+// Flags is a list of flags of an instruction
+type Flags []Flag
+
+func (f Flags) String() string {
+	flags := make([]string, 0, len(f))
+	for _, flag := range f {
+		flags = append(flags, flag.String())
+	}
+	return strings.Join(flags, " ")
+}
+
+// Instruction is a single Dockerfile instruction, made of a command such as RUN or COPY,
+// its flags and its arguments. Arguments are rendered as they are, separated by spaces.
+// The lines of the heredoc, if any, are rendered after the arguments.
+type Instruction struct {
+	Command string
+	Flags   Flags
+	Args    []string
+	Heredoc []string
+}
+
+func (i Instruction) String() string {
+	parts := []string{i.Command}
+	if len(i.Flags) > 0 {
+		parts = append(parts, i.Flags.String())
+	}
+	for _, arg := range i.Args {
+		if arg != "" {
+			parts = append(parts, arg)
+		}
+	}
+	if len(i.Heredoc) == 0 {
+		return strings.Join(parts, " ")
+	}
+	parts = append(parts, "<<"+heredocDelimiter)
+	lines := append([]string{strings.Join(parts, " ")}, i.Heredoc...)
+	return strings.Join(append(lines, heredocDelimiter), "\n")
+}
+
+const heredocDelimiter = "EOF"
+
+// Block is a group of instructions generated by a single step of a stage.
+// Blocks are separated by an empty line, and empty blocks are not rendered at all,
+// so steps never need to care about the newlines surrounding them.
+type Block []Instruction
+
+func (b Block) String() string {
+	if len(b) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("\n")
+	for _, instruction := range b {
+		out.WriteString(instruction.String())
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// stepCommentPrefix starts the comment naming the step which generated the instructions
+// following it, up to the next empty line
+const stepCommentPrefix = "# step: "
+
+// step names the step which generated a block, by preceding its instructions with a step comment.
+// Comments are rendered as instructions made of the comment only.
+func step(name string, block Block) Block {
+	if len(block) == 0 {
+		return nil
+	}
+	return append(Block{{Command: strings.TrimSpace(stepCommentPrefix), Args: []string{name}}}, block...)
+}
+
+// from returns the FROM instruction starting a stage. The stage is not named when name is empty.
+func from(image string, name string) Instruction {
+	if name == "" {
+		return Instruction{Command: "FROM", Args: []string{image}}
+	}
+	return Instruction{Command: "FROM", Args: []string{image, "AS", name}}
+}
+
+// run returns a RUN instruction executing the shell commands one after the other.
+// Several commands are written as a heredoc script, which stops at the first failing command.
+func run(flags Flags, commands ...string) Instruction {
+	if len(commands) == 1 {
+		return Instruction{Command: "RUN", Flags: flags, Args: commands}
+	}
+	return Instruction{Command: "RUN", Flags: flags, Heredoc: append([]string{"set -e"}, commands...)}
+}
+
+// execForm returns an instruction using the JSON array form, e.g. CMD ["python", "-m", "app"]
+func execForm(command string, values []string) Instruction {
+	value, err := json.Marshal(values)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return Instruction{Command: command, Args: []string{string(value)}}
+}
+
+// keyValue returns an instruction setting a key to a value, such as ENV or LABEL.
+// The value is quoted and escaped unless it is made of safe characters only.
+func keyValue(command string, key string, value string) Instruction {
+	return Instruction{Command: command, Args: []string{fmt.Sprintf("%s=%s", key, quoteValue(value))}}
+}
+
+// label returns a LABEL instruction. Label values are always quoted.
+func label(key string, value string) Instruction {
+	return Instruction{Command: "LABEL", Args: []string{fmt.Sprintf("%s=\"%s\"", key, escapeValue(value))}}
+}
+
+var safeValueRegex = regexp.MustCompile(`^[A-Za-z0-9_./:@,+=%-]+$`)
+
+// quoteValue quotes a value within double quotes when it contains characters
+// which would be interpreted by the Dockerfile parser
+func quoteValue(v string) string {
+	if safeValueRegex.MatchString(v) {
+		return v
+	}
+	return fmt.Sprintf("\"%s\"", escapeValue(v))
+}
+
+// escapeValue escapes a value so that it can be used within double quotes.
+// Whitespaces, including newlines, are collapsed into single spaces.
+func escapeValue(v string) string {
+	v = strings.ReplaceAll(v, "\\", "\\\\")
+	v = strings.ReplaceAll(v, "\"", "\\\"")
+	v = strings.ReplaceAll(v, "$", "\\$")
+	return strings.Join(strings.Fields(v), " ")
+}
+
+// command returns a shell command made of the non empty parts
+func command(parts ...string) string {
+	args := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			args = append(args, part)
+		}
+	}
+	return strings.Join(args, " ")
+}
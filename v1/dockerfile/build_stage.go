@@ -4,216 +4,683 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"path"
+	"regexp"
 	"strings"
 
 	"github.com/charbonats/microbuild/v1/config"
 	"github.com/charbonats/microbuild/v1/utils"
 )
 
-func buildStage(c *config.Config, placeholders map[string]string) string {
-	dockerfile := fromBuilderStage(c)
+// installBuildDeps installs the build dependencies with the package manager of the flavor
+func installBuildDeps(c *config.Config) Block {
 	switch c.Flavor {
 	case "debian":
-		dockerfile += installBuildDepsWithApt(c)
+		return step("install build dependencies", installBuildDepsWithApt(c))
 	case "alpine":
-		dockerfile += installBuildDepsWithApk(c)
+		return step("install build dependencies", installBuildDepsWithApk(c))
 	default:
 		log.Fatalf("unsupported flavor: %s", c.Flavor)
 	}
-	dockerfile += addEnvironmentVariables(utils.Union(defaultEnvs, c.Env), placeholders)
-	dockerfile += copyFilesBeforeBuild(c)
-	dockerfile += addFilesBeforeBuild(c)
+	return nil
+}
+
+// Python dependencies are installed in the user base of the root user, while the project is installed
+// in a user base of its own. Both are copied into the same directory of the final image, but in distinct
+// layers, so that pushing a new version of the project only uploads the small layer of the project.
+const (
+	DependenciesUserBase = "/root/.local"
+	ProjectUserBase      = "/root/.app"
+)
+
+// sitePackages returns the site-packages directory of a user base for the python version of the config.
+// The directory is unknown when the python version does not include the minor version.
+// Free-threaded builds use their own directories, e.g. lib/python3.13t.
+func sitePackages(c *config.Config, userBase string) (string, bool) {
+	parts := strings.Split(strings.TrimSuffix(c.PythonVersion, "t"), ".")
+	if len(parts) < 2 {
+		return "", false
+	}
+	abi := strings.Join(parts[:2], ".")
+	if config.FreeThreaded(c.PythonVersion) {
+		abi += "t"
+	}
+	return fmt.Sprintf("%s/lib/python%s/site-packages", userBase, abi), true
+}
+
+// BuilderEnvs returns the environment variables of the build stage, which include proxy build arguments.
+// The project is added to the python path so that post install commands can import it.
+// Values are not expanded, see ExpandPlaceholders.
+func BuilderEnvs(c *config.Config, placeholders map[string]string) map[string]string {
+	envs := utils.Union(defaultEnvs, proxyEnvs(placeholders))
+	if c.NativeBuildCache {
+		envs = utils.Union(envs, nativeBuildCacheEnvs)
+	}
+	if c.RustToolchain != "" {
+		envs = utils.Union(envs, map[string]string{"RUSTUP_HOME": RustupHome, "CARGO_HOME": CargoHome, "CARGO_TARGET_DIR": CargoTargetDir})
+	}
+	if site, ok := sitePackages(c, ProjectUserBase); ok {
+		envs = utils.Union(envs, map[string]string{"PYTHONPATH": site})
+	}
+	return utils.Union(envs, c.Env)
+}
+
+// addBuilderEnvironmentVariables adds the environment variables of the build stage
+func addBuilderEnvironmentVariables(c *config.Config, placeholders map[string]string) Block {
+	return addEnvironmentVariables(BuilderEnvs(c, placeholders), placeholders)
+}
+
+// RustPath is the directory of the binaries of the rust toolchain, prepended to PATH
+const RustPath = CargoHome + "/bin"
+
+// InstallRustToolchainCommands returns the commands installing the rust toolchain of the config
+// with rustup, using the minimal profile since only cargo and rustc are required
+func InstallRustToolchainCommands(c *config.Config) []string {
+	if c.RustToolchain == "" {
+		return nil
+	}
+	return []string{
+		"wget -qO /tmp/rustup-init.sh https://sh.rustup.rs",
+		"sh /tmp/rustup-init.sh -y --no-modify-path --profile minimal --default-toolchain " + c.RustToolchain,
+		"rm /tmp/rustup-init.sh",
+	}
+}
+
+func installRustToolchain(c *config.Config) Block {
+	commands := InstallRustToolchainCommands(c)
+	if len(commands) == 0 {
+		return nil
+	}
+	return step("install rust toolchain", Block{
+		{Command: "ENV", Args: []string{"PATH=" + RustPath + ":$PATH"}},
+		run(nil, commands...),
+	})
+}
+
+// installPythonDeps installs the python dependencies either from the requirements file or from pyproject.toml
+func installPythonDeps(c *config.Config) Block {
 	switch c.Requirements {
 	case "":
-		dockerfile += installPythonDepsFromPyProject(c)
+		return step("install dependencies", installPythonDepsFromPyProject(c))
 	default:
-		dockerfile += installPythonDepsFromRequirements(c)
+		return step("install dependencies", installPythonDepsFromRequirements(c))
 	}
-	dockerfile += installProject(c)
-	dockerfile += clearInstalledPythonLibs(c)
-	return dockerfile
 }
 
-func fromBuilderStage(c *config.Config) string {
+// BuilderImage returns the base image of the build stage
+func BuilderImage(c *config.Config) string {
 	image := fmt.Sprintf("docker.io/python:%s", c.PythonVersion)
 	if c.Flavor == "alpine" {
 		image += "-alpine"
 	}
-	line := fmt.Sprintf("FROM %s AS builder\n", image)
-	return line
+	if c.BuilderImageDigest != "" {
+		image += "@" + c.BuilderImageDigest
+	}
+	return image
+}
+
+// Cross compiled builds run the build stage on the build platform, and install the wheels of the
+// target platform. The architecture of the wheels is read from the platform build arguments,
+// which are declared in the build stage so that they are available to RUN instructions.
+var crossCompileArgs = []string{"TARGETARCH", "TARGETVARIANT"}
+
+func fromBuilderStage(c *config.Config) Block {
+	image := BuilderImage(c)
+	if !c.CrossCompile {
+		return step("pull "+image, Block{from(image, "builder")})
+	}
+	instruction := from(image, "builder")
+	instruction.Flags = Flags{{Name: "platform", Value: "$BUILDPLATFORM"}}
+	block := Block{instruction}
+	for _, arg := range crossCompileArgs {
+		block = append(block, Instruction{Command: "ARG", Args: []string{arg}})
+	}
+	return step("pull "+image, block)
 }
 
-func installBuildDepsWithApt(c *config.Config) string {
+// BuildDepsCommands returns the commands installing the build dependencies with the package manager of the flavor
+func BuildDepsCommands(c *config.Config) []string {
 	if len(c.BuildDeps) == 0 {
-		return ""
+		return nil
 	}
-	line := fmt.Sprintf("RUN %s ", aptCacheMount)
-	line += "apt-get update && apt-get install -y --no-install-recommends "
-	line += strings.Join(c.BuildDeps, " ")
-	return line
+	commands := keepPackageCacheCommands(c)
+	if c.Flavor == "alpine" {
+		return append(commands, command("apk add", apkRepositories(c), systemPackages(c.BuildDeps)))
+	}
+	return append(commands, aptInstall(c, c.BuildDeps)...)
 }
 
-func installBuildDepsWithApk(c *config.Config) string {
+func installBuildDepsWithApt(c *config.Config) Block {
 	if len(c.BuildDeps) == 0 {
-		return ""
+		return nil
 	}
-	line := fmt.Sprintf("RUN %s ", apkCacheMount)
-	line += "apk add "
-	line += strings.Join(c.BuildDeps, " ")
-	return line
+	block := Block(addAptRepositoryKeys(c))
+	flags := append(aptCacheMounts(c), secretMountFlags(AptRepositorySecrets(c))...)
+	return append(block, run(flags, BuildDepsCommands(c)...))
 }
 
-func copyFilesBeforeBuild(c *config.Config) string {
-	line := ""
-	if len(c.CopyFilesBeforeBuild) > 0 {
-		line += "\n"
-		for _, f := range c.CopyFiles {
-			if f.From != "" {
-				line += fmt.Sprintf("COPY --from=%s %s %s\n", f.From, f.Source, f.Destination)
-			} else {
-				line += fmt.Sprintf("COPY %s %s\n", f.Source, f.Destination)
-			}
-		}
+func installBuildDepsWithApk(c *config.Config) Block {
+	if len(c.BuildDeps) == 0 {
+		return nil
 	}
-	return line
+	return Block{run(Flags{apkCacheMount(c)}, BuildDepsCommands(c)...)}
 }
 
-func addFilesBeforeBuild(c *config.Config) string {
-	line := ""
-	if len(c.AddFilesBeforeBuild) > 0 {
-		line += "\n"
-		for _, f := range c.AddFilesBeforeBuild {
-			if f.Checksum != "" {
-				line += fmt.Sprintf("ADD --checksum=%s %s %s\n", f.Checksum, f.Source, f.Destination)
-			}
-			line += fmt.Sprintf("ADD %s %s\n", f.Source, f.Destination)
-		}
+func copyFilesBeforeBuild(c *config.Config) Block {
+	var block Block
+	for _, f := range c.CopyFilesBeforeBuild {
+		block = append(block, copyFile(c, f))
 	}
-	return line
+	return step("copy files", block)
+}
+
+func addFilesBeforeBuild(c *config.Config) Block {
+	var block Block
+	for _, f := range c.AddFilesBeforeBuild {
+		block = append(block, addFile(c, f))
+	}
+	return step("add files", block)
 }
 
 func formatPipIndices(c *config.Config) string {
-	indices := "--retries 2"
+	indices := []string{"--retries 2"}
 
 	for _, index := range c.Indices {
-		indexUrl, err := url.Parse(index.Url)
-		if err != nil {
-			log.Fatal(err)
-		}
-		replaceUser := ""
-		replacePassword := ""
-		if index.UsernameSecret != "" {
-			userSecretFile := fmt.Sprintf("/run/secrets/%s", index.UsernameSecret)
-			replaceUser = fmt.Sprintf("$(echo -n $(cat %s) | jq -sRr @uri)", userSecretFile)
-			index.Username = "REPLACE_USER"
+		// A primary index replaces the default index, mirrors are always added as extra indices
+		option := "--extra-index-url"
+		if index.Primary {
+			option = "--index-url"
 		}
-		if index.PasswordSecret != "" {
-			passSecretFile := fmt.Sprintf("/run/secrets/%s", index.PasswordSecret)
-			replacePassword = fmt.Sprintf("$(echo -n $(cat %s) | jq -sRr @uri)", passSecretFile)
-			index.Password = "REPLACE_PASSWORD"
+		indices = append(indices, formatPipIndex(index, index.Url, option))
+		for _, mirror := range index.Mirrors {
+			indices = append(indices, formatPipIndex(index, mirror, "--extra-index-url"))
 		}
+	}
 
-		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) == 0 {
-			indexUrl.User = url.User(index.Username)
-		}
+	return strings.Join(indices, " ")
+}
 
-		if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) != 0 {
-			indexUrl.User = url.UserPassword(index.Username, index.Password)
-		}
-		indexUrlString := indexUrl.String()
-		if replaceUser != "" {
-			indexUrlString = strings.Replace(indexUrlString, "REPLACE_USER", replaceUser, 1)
-		}
-		if replacePassword != "" {
-			indexUrlString = strings.Replace(indexUrlString, "REPLACE_PASSWORD", replacePassword, 1)
-		}
-		indices += fmt.Sprintf(" --extra-index-url \"%s\"", indexUrlString)
+// formatPipIndex returns the pip options used to add an index url with the credentials of the index
+func formatPipIndex(index config.Index, rawUrl string, option string) string {
+	indexUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replaceUser := ""
+	replacePassword := ""
+	if index.UsernameSecret != "" {
+		userSecretFile := fmt.Sprintf("/run/secrets/%s", index.UsernameSecret)
+		replaceUser = fmt.Sprintf("$(echo -n $(cat %s) | jq -sRr @uri)", userSecretFile)
+		index.Username = "REPLACE_USER"
+	}
+	if index.PasswordSecret != "" {
+		passSecretFile := fmt.Sprintf("/run/secrets/%s", index.PasswordSecret)
+		replacePassword = fmt.Sprintf("$(echo -n $(cat %s) | jq -sRr @uri)", passSecretFile)
+		index.Password = "REPLACE_PASSWORD"
+	}
+
+	if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) == 0 {
+		indexUrl.User = url.User(index.Username)
+	}
+
+	if len(strings.TrimSpace(index.Username)) != 0 && len(strings.TrimSpace(index.Password)) != 0 {
+		indexUrl.User = url.UserPassword(index.Username, index.Password)
+	}
+	indexUrlString := indexUrl.String()
+	if replaceUser != "" {
+		indexUrlString = strings.Replace(indexUrlString, "REPLACE_USER", replaceUser, 1)
+	}
+	if replacePassword != "" {
+		indexUrlString = strings.Replace(indexUrlString, "REPLACE_PASSWORD", replacePassword, 1)
+	}
+	line := fmt.Sprintf("%s \"%s\"", option, indexUrlString)
+
+	if index.Trust {
+		line += fmt.Sprintf(" --trusted-host \"%s\"", indexUrl.Host)
+	}
+	return line
+}
 
-		if index.Trust {
-			indices += fmt.Sprintf(" --trusted-host \"%s\"", indexUrl.Host)
+// PipSecrets returns the secrets required by pip install commands.
+// The pip configuration secret is mounted at the location of the global pip configuration file,
+// and the netrc secret is mounted in the home directory of the root user, where it is used by
+// pip to authenticate against indices and by git to authenticate against https remotes.
+func PipSecrets(c *config.Config) []Secret {
+	var secrets []Secret
+	if c.PipConfigSecret != "" {
+		secrets = append(secrets, Secret{ID: c.PipConfigSecret, Target: "/etc/pip.conf"})
+	}
+	if c.NetrcSecret != "" {
+		secrets = append(secrets, Secret{ID: c.NetrcSecret, Target: "/root/.netrc"})
+	}
+	return secrets
+}
+
+// IndexSecrets returns the secrets holding the credentials of the indices, which are
+// read from /run/secrets by the pip install commands of python dependencies
+func IndexSecrets(c *config.Config) []Secret {
+	var secrets []Secret
+	for _, index := range c.Indices {
+		if index.PasswordSecret != "" {
+			secrets = append(secrets, Secret{ID: index.PasswordSecret})
+		}
+		if index.UsernameSecret != "" {
+			secrets = append(secrets, Secret{ID: index.UsernameSecret})
 		}
 	}
+	return secrets
+}
 
-	return indices
+// secretMounts returns the RUN flags used to mount the secrets required by pip install commands
+func secretMounts(c *config.Config) Flags {
+	return secretMountFlags(PipSecrets(c))
 }
 
-func installPythonDepsFromPyProject(c *config.Config) string {
-	if len(c.Dependencies) == 0 {
+// pipArgs returns the additional arguments of the pip install commands
+func pipArgs(c *config.Config) string {
+	return strings.Join(c.PipArgs, " ")
+}
+
+// WheelhousePath is the directory where the wheelhouse is mounted while installing python dependencies and the project
+const WheelhousePath = "/wheelhouse"
+
+// WheelhouseSource returns the path of the wheelhouse in the named context or image it is read from,
+// or in the build context when it is not read from a named context
+func WheelhouseSource(c *config.Config) string {
+	if c.WheelhouseFrom != "" {
+		return path.Join("/", c.Wheelhouse)
+	}
+	return ContextPath(c, c.Wheelhouse)
+}
+
+// wheelhouseArgs returns the pip options installing packages from the wheelhouse only
+func wheelhouseArgs(c *config.Config) string {
+	if c.Wheelhouse == "" {
 		return ""
 	}
-	line := "\n"
-	line += fmt.Sprintf("RUN %s", pipCacheMount)
-	if len(c.Indices) > 0 {
-		for _, index := range c.Indices {
-			if index.PasswordSecret != "" {
-				line += fmt.Sprintf(" --mount=type=secret,id=%s", index.PasswordSecret)
-			}
-			if index.UsernameSecret != "" {
-				line += fmt.Sprintf(" --mount=type=secret,id=%s", index.UsernameSecret)
-			}
-		}
+	return "--no-index --find-links " + WheelhousePath
+}
+
+// wheelhouseMount returns the RUN flag used to bind mount the wheelhouse
+func wheelhouseMount(c *config.Config) Flags {
+	if c.Wheelhouse == "" {
+		return nil
+	}
+	value := fmt.Sprintf("type=bind,source=%s,target=%s", WheelhouseSource(c), WheelhousePath)
+	if c.WheelhouseFrom != "" {
+		value = fmt.Sprintf("type=bind,from=%s,source=%s,target=%s", c.WheelhouseFrom, WheelhouseSource(c), WheelhousePath)
+	}
+	return Flags{{Name: "mount", Value: value}}
+}
+
+// pipInstallFlags returns the RUN flags of the pip install commands of python dependencies,
+// which mount the pip cache, the secrets of the config and the credentials of the indices
+func pipInstallFlags(c *config.Config, useSsh bool) Flags {
+	flags := buildCacheMounts(c)
+	flags = append(flags, networkFlag(c)...)
+	flags = append(flags, secretMounts(c)...)
+	flags = append(flags, secretMountFlags(IndexSecrets(c))...)
+	flags = append(flags, wheelhouseMount(c)...)
+	if useSsh {
+		flags = append(flags, sshMount)
+	}
+	return flags
+}
+
+// gitSshCommand is prepended to pip install commands when dependencies are fetched over ssh
+const gitSshCommand = "GIT_SSH_COMMAND='ssh -o StrictHostKeyChecking=no'"
+
+// DependenciesUseSsh returns whether python dependencies are fetched over ssh,
+// in which case the ssh agent of the client is mounted when they are installed
+func DependenciesUseSsh(c *config.Config) bool {
+	if c.Requirements != "" {
+		return c.DependenciesUseSsh
 	}
-	useSsh := false
 	for _, d := range c.Dependencies {
 		if strings.Contains(d, "git+ssh") {
-			useSsh = true
-			break
+			return true
 		}
 	}
-	if useSsh {
-		line += sshMount
-		line += " GIT_SSH_COMMAND='ssh -o StrictHostKeyChecking=no'"
+	return false
+}
+
+// wheelArchCommand sets the arch shell variable to the architecture of the wheels of the target platform
+const wheelArchCommand = `case "$TARGETARCH$TARGETVARIANT" in amd64) arch=x86_64 ;; arm64*) arch=aarch64 ;; armv7) arch=armv7l ;; 386) arch=i686 ;; ppc64le|s390x) arch=$TARGETARCH ;; *) echo "unsupported target architecture $TARGETARCH$TARGETVARIANT" >&2; exit 1 ;; esac`
+
+// wheelPlatforms returns the pip options selecting the wheels of the target platform.
+// Debian images are compatible with manylinux wheels, alpine images with musllinux wheels.
+func wheelPlatforms(c *config.Config) string {
+	tags := []string{"manylinux_2_28", "manylinux_2_24", "manylinux2014"}
+	if c.Flavor == "alpine" {
+		tags = []string{"musllinux_1_2", "musllinux_1_1"}
 	}
-	line += fmt.Sprintf(" python -m pip install --user %s ", formatPipIndices(c))
-	line += strings.Join(c.Dependencies, " ")
-	return line
+	var options []string
+	for _, tag := range tags {
+		options = append(options, fmt.Sprintf("--platform %s_$arch", tag))
+	}
+	return strings.Join(options, " ") + " --only-binary=:all:"
+}
+
+// InstallDependenciesCommands returns the commands installing the python dependencies,
+// either from the requirements file or from pyproject.toml.
+// Cross compiled dependencies can not be installed in the user base by pip, they are installed
+// in the user site-packages directory instead, and their scripts are moved to the bin directory of the user base.
+func InstallDependenciesCommands(c *config.Config) []string {
+	if !c.CrossCompile {
+		return []string{command(sshCommand(c), "python -m pip install --user", formatPipIndices(c), wheelhouseArgs(c), pipArgs(c), dependenciesArgs(c))}
+	}
+	bin := DependenciesUserBase + "/bin"
+	return []string{
+		wheelArchCommand,
+		"site=$(python -m site --user-site)",
+		command("PIP_USER=0 python -m pip install --target \"$site\"", wheelPlatforms(c), formatPipIndices(c), wheelhouseArgs(c), pipArgs(c), dependenciesArgs(c)),
+		fmt.Sprintf("if [ -d \"$site/bin\" ]; then mkdir -p %[1]s && mv \"$site\"/bin/* %[1]s/ && rmdir \"$site/bin\"; fi", bin),
+	}
+}
+
+// sshCommand returns the environment variable prepended to pip commands when dependencies are fetched over ssh
+func sshCommand(c *config.Config) string {
+	if DependenciesUseSsh(c) {
+		return gitSshCommand
+	}
+	return ""
+}
+
+// dependenciesArgs returns the pip arguments of the python dependencies, either the requirements file or the dependencies
+func dependenciesArgs(c *config.Config) string {
+	if c.Requirements != "" {
+		return "-r " + RequirementsPath(c.Requirements)
+	}
+	dependencies := make([]string, 0, len(c.Dependencies))
+	for _, dependency := range c.Dependencies {
+		dependencies = append(dependencies, shellQuote(dependency))
+	}
+	return strings.Join(dependencies, " ")
+}
+
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9._,\[\]-]+$`)
+
+// shellQuote quotes a requirement so that version specifiers, markers and direct references
+// are given to pip as a single argument, e.g. 'requests>=2.31,<3'
+func shellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
-func installPythonDepsFromRequirements(c *config.Config) string {
-	line := "\n"
-	line += fmt.Sprintf("COPY %s /requirements.txt", c.Requirements)
-	line += "\n"
-	// Remove all file requirements since they will not be available at build time
-	// Rye generates a requirements.lock file that contains an additional entry:
-	// -e file:.
-	// This entry is not desired at this time because the project sources have
-	// not been copied yet.
-	// The sed command is used to remove all lines starting with "-e"
-	line += "RUN sed '/^-e/d' /requirements.txt > requirements.txt\n"
-	line += fmt.Sprintf("RUN %s", pipCacheMount)
-	if len(c.Indices) > 0 {
-		for _, index := range c.Indices {
-			if index.PasswordSecret != "" {
-				line += fmt.Sprintf(" --mount=type=secret,id=%s", index.PasswordSecret)
-			}
-			if index.UsernameSecret != "" {
-				line += fmt.Sprintf(" --mount=type=secret,id=%s", index.UsernameSecret)
-			}
+// Stages exporting the wheels of the python dependencies, see WheelhouseStages
+const (
+	WheelsStageName     = "wheels"
+	WheelhouseStageName = "wheelhouse"
+	WheelsPath          = "/wheels"
+)
+
+// BuildWheelsCommands returns the commands writing the wheels of the python dependencies into WheelsPath.
+// Wheels are built from source when needed, except for cross compiled dependencies, whose wheels
+// of the target platform are downloaded.
+func BuildWheelsCommands(c *config.Config) []string {
+	if c.Requirements == "" && len(c.Dependencies) == 0 {
+		return []string{"mkdir -p " + WheelsPath}
+	}
+	if !c.CrossCompile {
+		return []string{command(sshCommand(c), "python -m pip wheel --wheel-dir", WheelsPath, formatPipIndices(c), wheelhouseArgs(c), pipArgs(c), dependenciesArgs(c))}
+	}
+	return []string{
+		wheelArchCommand,
+		command("python -m pip download --dest", WheelsPath, wheelPlatforms(c), formatPipIndices(c), wheelhouseArgs(c), pipArgs(c), dependenciesArgs(c)),
+	}
+}
+
+// WheelhouseStages returns the stages exporting the wheels of the python dependencies, which are
+// built from the build stage. The wheelhouse stage only contains the wheels, so that it can be
+// exported to a local directory, or pushed as an image used as wheelhouse by other builds.
+func WheelhouseStages(c *config.Config) string {
+	block := Block{from("builder", WheelsStageName)}
+	if c.CrossCompile {
+		for _, arg := range crossCompileArgs {
+			block = append(block, Instruction{Command: "ARG", Args: []string{arg}})
 		}
 	}
-	if c.DependenciesUseSsh {
-		line += sshMount
-		line += " GIT_SSH_COMMAND='ssh -o StrictHostKeyChecking=no'"
+	block = append(block, run(pipInstallFlags(c, DependenciesUseSsh(c)), BuildWheelsCommands(c)...))
+	wheels := step("build wheels", block)
+	wheelhouse := step("export wheels", Block{
+		from("scratch", WheelhouseStageName),
+		{Command: "COPY", Flags: Flags{{Name: "from", Value: WheelsStageName}}, Args: []string{WheelsPath + "/", "/"}},
+	})
+	return strings.Trim(wheels.String()+wheelhouse.String(), "\n") + "\n"
+}
+
+func installPythonDepsFromPyProject(c *config.Config) Block {
+	if len(c.Dependencies) == 0 {
+		return nil
+	}
+	return Block{run(pipInstallFlags(c, DependenciesUseSsh(c)), InstallDependenciesCommands(c)...)}
+}
+
+// RequirementsFiles returns the requirements files copied into the build stage.
+// The requirements files are copied with the files they reference, keeping
+// their relative paths so that references can be resolved by pip.
+func RequirementsFiles(c *config.Config) []string {
+	if len(c.RequirementsFiles) == 0 {
+		return []string{c.Requirements}
 	}
-	line += fmt.Sprintf(" python -m pip install --user %s -r /requirements.txt", formatPipIndices(c))
-	return line
+	return c.RequirementsFiles
 }
 
-func installProject(c *config.Config) string {
-	line := "\n"
-	line += "COPY . /projectdir\n"
-	line += fmt.Sprintf("RUN %s python -m pip install --no-deps /projectdir", pipCacheMount)
-	return line
+// RequirementsPath returns the path of a requirements file copied into the build stage
+func RequirementsPath(f string) string {
+	return path.Join("/requirements", f)
 }
 
-func clearInstalledPythonLibs(c *config.Config) string {
-	line := "\n"
-	if len(c.Dependencies) > 0 {
-		line += "RUN find /root/.local/lib/python*/ -name 'tests' -exec rm -r '{}' + && "
-		line += "find /root/.local/lib/python*/site-packages/ -name '*.so' -exec sh -c 'file \"{}\" | grep -q \"not stripped\" && strip -s \"{}\"' \\; && "
-		line += "find /root/.local/lib/python*/ -type f -name '*.pyc' -delete && "
-		line += "find /root/.local/lib/python*/ -type d -name '__pycache__' -delete\n"
+// RemoveEditableRequirementsCommand returns the command removing all editable file requirements
+// from the copied requirements files, since they will not be available at build time.
+// Rye generates a requirements.lock file that contains an additional entry:
+// -e file:.
+// This entry is not desired at this time because the project sources have
+// not been copied yet.
+// The sed command is used to remove all editable requirements which are local paths
+func RemoveEditableRequirementsCommand(c *config.Config) string {
+	var destinations []string
+	for _, f := range RequirementsFiles(c) {
+		destinations = append(destinations, RequirementsPath(f))
 	}
+	return fmt.Sprintf("sed -i -E '/^(-e|--editable)[= ]*(file:|\\.|\\/)/d' %s", strings.Join(destinations, " "))
+}
 
-	return line
+func installPythonDepsFromRequirements(c *config.Config) Block {
+	var block Block
+	for _, f := range RequirementsFiles(c) {
+		block = append(block, Instruction{Command: "COPY", Args: []string{ContextPath(c, f), RequirementsPath(f)}})
+	}
+	block = append(block, run(nil, RemoveEditableRequirementsCommand(c)))
+	return append(block, run(pipInstallFlags(c, DependenciesUseSsh(c)), InstallDependenciesCommands(c)...))
+}
+
+// LocalDependencyPath returns the path of a local dependency copied into the build stage
+func LocalDependencyPath(src string) string {
+	return path.Join("/localdeps", src)
+}
+
+// InstallLocalDependenciesCommands returns the commands installing the local dependencies, copied from
+// the build context, in the user base of the dependencies. Their own dependencies are installed as well,
+// since they are not declared by the project.
+func InstallLocalDependenciesCommands(c *config.Config) []string {
+	if len(c.LocalDependencies) == 0 {
+		return nil
+	}
+	dependencies := make([]string, 0, len(c.LocalDependencies))
+	for _, d := range c.LocalDependencies {
+		dependency := LocalDependencyPath(d.Path)
+		if len(d.Extras) > 0 {
+			dependency += "[" + strings.Join(d.Extras, ",") + "]"
+		}
+		dependencies = append(dependencies, shellQuote(dependency))
+	}
+	return []string{command("python -m pip install --user", formatPipIndices(c), wheelhouseArgs(c), pipArgs(c), strings.Join(dependencies, " "))}
+}
+
+// installLocalDependencies copies the local dependencies from the build context and installs them
+func installLocalDependencies(c *config.Config) Block {
+	if len(c.LocalDependencies) == 0 {
+		return nil
+	}
+	var block Block
+	for _, d := range c.LocalDependencies {
+		block = append(block, Instruction{Command: "COPY", Args: []string{d.Path, LocalDependencyPath(d.Path)}})
+	}
+	block = append(block, run(pipInstallFlags(c, false), InstallLocalDependenciesCommands(c)...))
+	return step("install local dependencies", block)
+}
+
+// networkFlag returns the RUN flag used to select the network mode of python installs
+func networkFlag(c *config.Config) Flags {
+	if c.Network == "" {
+		return nil
+	}
+	return Flags{{Name: "network", Value: c.Network}}
+}
+
+// InstallProjectCommands returns the commands installing the project, whose sources are in /projectdir,
+// in the user base of the project. The user base of the dependencies is created as well, since it is
+// copied into the final image even when the project has no dependencies.
+// Poetry projects without build system are declared to be built with poetry-core.
+func InstallProjectCommands(c *config.Config) []string {
+	commands := []string{"mkdir -p " + DependenciesUserBase}
+	if c.PoetryBuildBackend {
+		commands = append(commands, fmt.Sprintf("printf '%s' >> %s", poetryBuildSystem, ProjectPath("pyproject.toml")))
+	}
+	return append(commands, command("PYTHONUSERBASE="+ProjectUserBase, "python -m pip install --no-deps", wheelhouseArgs(c), pipArgs(c), "/projectdir"))
+}
+
+// poetryBuildSystem is the build system appended to the pyproject.toml file of poetry projects
+// without build system, so that pip builds them with poetry-core
+const poetryBuildSystem = `\n[build-system]\nrequires = ["poetry-core>=1.0.0"]\nbuild-backend = "poetry.core.masonry.api"\n`
+
+func installProject(c *config.Config) Block {
+	flags := buildCacheMounts(c)
+	flags = append(flags, networkFlag(c)...)
+	flags = append(flags, secretMounts(c)...)
+	flags = append(flags, wheelhouseMount(c)...)
+	install := InstallProjectCommands(c)
+	if c.ProjectBindMount {
+		return step("install project", Block{run(append(bindProjectSources(c), flags...), install...)})
+	}
+	return step("install project", append(copyProjectSources(c), run(flags, install...)))
+}
+
+// ProjectSources returns the paths of the project sources relative to the context directory.
+// The whole context directory is used unless source paths are included explicitly,
+// in which case only pyproject.toml and the included paths are used.
+func ProjectSources(c *config.Config) []string {
+	if len(c.SrcInclude) == 0 {
+		return []string{"."}
+	}
+	sources := []string{"pyproject.toml"}
+	for _, src := range c.SrcInclude {
+		sources = append(sources, path.Clean(src))
+	}
+	return utils.Unique(sources)
+}
+
+// ProjectPath returns the path of a project source in the build stage
+func ProjectPath(src string) string {
+	return path.Join("/projectdir", src)
+}
+
+// copyProjectSources copies the project sources into the build stage
+func copyProjectSources(c *config.Config) Block {
+	var block Block
+	for _, src := range ProjectSources(c) {
+		block = append(block, Instruction{Command: "COPY", Args: []string{ContextPath(c, src), ProjectPath(src)}})
+	}
+	return block
+}
+
+// bindProjectSources returns the RUN flags used to bind mount the project sources.
+// Mounts are writable so that build artifacts can be written into the project directory,
+// but changes are discarded once the instruction completes.
+func bindProjectSources(c *config.Config) Flags {
+	var flags Flags
+	for _, src := range ProjectSources(c) {
+		flags = append(flags, Flag{Name: "mount", Value: fmt.Sprintf("type=bind,source=%s,target=%s,rw", ContextPath(c, src), ProjectPath(src))})
+	}
+	return flags
+}
+
+// ClearInstalledPythonLibsCommands returns the commands removing the tests, the debug symbols
+// and the bytecode of the installed python dependencies, unless they are kept by the cleanup
+// options. The directories of the excluded packages are skipped.
+// Each command tolerates missing files: nothing is done when no dependency was installed in the
+// user base, matched directories are not traversed once removed, and shared libraries are only
+// stripped when strip is available, which is not the case of the alpine builder unless binutils
+// is a build dependency. Cross compiled libraries are not stripped, since strip does not support
+// the target architecture.
+func ClearInstalledPythonLibsCommands(c *config.Config) []string {
+	if len(c.Dependencies) == 0 && len(c.LocalDependencies) == 0 {
+		return nil
+	}
+	prune := excludedPackagesPrune(c.Cleanup.Exclude)
+	var commands []string
+	if !c.Cleanup.KeepTests {
+		commands = append(commands, "find "+DependenciesUserBase+"/lib/python*/ "+prune+"-type d -name 'tests' -prune -exec rm -rf '{}' +")
+	}
+	if !c.CrossCompile && !c.Cleanup.KeepDebugSymbols {
+		commands = append(commands, "if command -v strip >/dev/null 2>&1; then find "+DependenciesUserBase+"/lib/python*/site-packages/ "+prune+"-type f -name '*.so' -exec strip -s '{}' + 2>/dev/null || true; fi")
+	}
+	if !c.Cleanup.KeepBytecode {
+		commands = append(commands,
+			"find "+DependenciesUserBase+"/lib/python*/ "+prune+"-type d -name '__pycache__' -prune -exec rm -rf '{}' +",
+			"find "+DependenciesUserBase+"/lib/python*/ "+prune+"-type f -name '*.pyc' -exec rm -f '{}' +",
+		)
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	return append([]string{"if [ ! -d " + DependenciesUserBase + "/lib ]; then exit 0; fi"}, commands...)
+}
+
+// excludedPackagesPrune returns the find expression skipping the directories of the excluded packages
+func excludedPackagesPrune(packages []string) string {
+	if len(packages) == 0 {
+		return ""
+	}
+	paths := make([]string, 0, len(packages))
+	for _, name := range packages {
+		paths = append(paths, fmt.Sprintf("-path '*/site-packages/%s'", name))
+	}
+	return "\\( " + strings.Join(paths, " -o ") + " \\) -prune -o "
+}
+
+func clearInstalledPythonLibs(c *config.Config) Block {
+	commands := ClearInstalledPythonLibsCommands(c)
+	if len(commands) == 0 {
+		return nil
+	}
+	return step("clean up installed packages", Block{run(nil, commands...)})
+}
+
+// CompileBytecodeCommands returns the commands compiling the installed dependencies and the project
+// to bytecode, at the optimization level of the final image when it is set. Hash based pycs are not
+// checked against the sources, so that they do not depend on the modification time of the files and
+// are reproducible. Files which do not compile, such as templates shipped by some packages, are
+// skipped as pip does. The pycache prefix of the builder is cleared, so that the pycs are written
+// next to the sources and copied to the final image.
+func CompileBytecodeCommands(c *config.Config) []string {
+	if !c.CompileBytecode && c.Optimize == 0 {
+		return nil
+	}
+	python := "env -u PYTHONPYCACHEPREFIX python"
+	if c.Optimize > 0 {
+		python += " -" + strings.Repeat("O", c.Optimize)
+	}
+	return []string{fmt.Sprintf("for userbase in %s %s; do if [ -d $userbase/lib ]; then %s -m compileall -f -q -j 0 --invalidation-mode unchecked-hash $userbase/lib || true; fi; done", DependenciesUserBase, ProjectUserBase, python)}
+}
+
+func compileBytecode(c *config.Config) Block {
+	commands := CompileBytecodeCommands(c)
+	if len(commands) == 0 {
+		return nil
+	}
+	return step("compile bytecode", Block{run(nil, commands...)})
 }
@@ -1,9 +1,9 @@
 package dockerfile
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/charbonats/microbuild/v1/config"
@@ -11,27 +11,39 @@ import (
 	"mvdan.cc/sh/v3/shell"
 )
 
-func runStage(c *config.Config, placeholders map[string]string) string {
-	dockerfile := fromFinalStage(c)
-	if c.Flavor == "debian" {
-		dockerfile += installSystemDepsWithApt(c)
-	} else if c.Flavor == "alpine" {
-		dockerfile += installSystemDepsWithApk(c)
-	} else {
+// installSystemDeps installs the system dependencies with the package manager of the flavor
+func installSystemDeps(c *config.Config) Block {
+	switch c.Flavor {
+	case "debian":
+		return step("install system dependencies", installSystemDepsWithApt(c))
+	case "alpine":
+		return step("install system dependencies", installSystemDepsWithApk(c))
+	default:
 		log.Fatalf("unsupported flavor: %s", c.Flavor)
 	}
-	dockerfile += createNonRootUser(c)
-	dockerfile += copyFiles(c)
-	dockerfile += addFiles(c)
-	dockerfile += addEntrypointAndCommand(c)
-	dockerfile += addEnvironmentVariables(c.Env, placeholders)
-	dockerfile += addLabels(utils.Union(defaulLabels, c.Labels), placeholders)
-	dockerfile += addAuthorsLabels(c)
-	return dockerfile
+	return nil
 }
 
-func fromFinalStage(c *config.Config) string {
-	line := "\n"
+// addImageLabels adds the default labels and the labels of the config
+func addImageLabels(c *config.Config, placeholders map[string]string) Block {
+	return addLabels(utils.Union(defaulLabels, c.Labels), placeholders)
+}
+
+// ImageLabels returns the labels of the final image: the default labels, the labels
+// of the config and the metadata labels, with their placeholders expanded
+func ImageLabels(c *config.Config, placeholders map[string]string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range utils.Union(defaulLabels, c.Labels) {
+		labels[k] = ExpandPlaceholders(v, placeholders)
+	}
+	for _, l := range metadataLabels(c) {
+		labels[l[0]] = l[1]
+	}
+	return labels
+}
+
+// FinalImage returns the base image of the final stage
+func FinalImage(c *config.Config) string {
 	image := fmt.Sprintf("python:%s", c.PythonVersion)
 	switch c.Flavor {
 	case "alpine":
@@ -39,78 +51,146 @@ func fromFinalStage(c *config.Config) string {
 	case "debian":
 		image += "-slim"
 	}
-	line += fmt.Sprintf("FROM %s\n", image)
-	return line
+	if c.FinalImageDigest != "" {
+		image += "@" + c.FinalImageDigest
+	}
+	return image
 }
 
-func installSystemDepsWithApt(c *config.Config) string {
-	line := "\n"
-	if len(c.SystemDeps) > 0 {
-		line += "RUN apt-get update && apt-get install -y --no-install-recommends "
-		for _, dep := range c.SystemDeps {
-			line += fmt.Sprintf(" %s ", dep)
-		}
-		line += " && rm -rf /var/lib/apt/lists/*\n"
+func fromFinalStage(c *config.Config) Block {
+	image := FinalImage(c)
+	return step("pull "+image, Block{from(image, "")})
+}
+
+// SystemDepsCommands returns the commands installing the system dependencies with the package manager
+// of the flavor. Package indexes are not kept in the final image.
+func SystemDepsCommands(c *config.Config) []string {
+	if len(c.SystemDeps) == 0 {
+		return nil
 	}
-	return line
+	if c.Flavor == "alpine" {
+		return []string{command("apk add --no-cache", apkRepositories(c), systemPackages(c.SystemDeps))}
+	}
+	return append(aptInstall(c, c.SystemDeps), "rm -rf /var/lib/apt/lists/*")
 }
 
-func installSystemDepsWithApk(c *config.Config) string {
-	line := "\n"
-	if len(c.SystemDeps) > 0 {
-		line += "RUN apk add --no-cache "
-		for _, dep := range c.SystemDeps {
-			line += fmt.Sprintf(" %s ", dep)
-		}
-		line += "\n"
+func installSystemDepsWithApt(c *config.Config) Block {
+	if len(c.SystemDeps) == 0 {
+		return nil
+	}
+	block := Block(addAptRepositoryKeys(c))
+	return append(block, run(secretMountFlags(AptRepositorySecrets(c)), SystemDepsCommands(c)...))
+}
+
+func installSystemDepsWithApk(c *config.Config) Block {
+	if len(c.SystemDeps) == 0 {
+		return nil
+	}
+	return Block{run(nil, SystemDepsCommands(c)...)}
+}
+
+// slimRuntimePaths are the files of the package managers of the Python installation of the final image
+var slimRuntimePaths = []string{
+	"/usr/local/bin/pip*",
+	"/usr/local/bin/wheel",
+	"/usr/local/lib/python*/ensurepip",
+	"/usr/local/lib/python*/site-packages/pip",
+	"/usr/local/lib/python*/site-packages/pip-*.dist-info",
+	"/usr/local/lib/python*/site-packages/setuptools",
+	"/usr/local/lib/python*/site-packages/setuptools-*.dist-info",
+	"/usr/local/lib/python*/site-packages/pkg_resources",
+	"/usr/local/lib/python*/site-packages/_distutils_hack",
+	"/usr/local/lib/python*/site-packages/distutils-precedence.pth",
+	"/usr/local/lib/python*/site-packages/wheel",
+	"/usr/local/lib/python*/site-packages/wheel-*.dist-info",
+}
+
+// SlimRuntimeCommands returns the commands removing pip, setuptools, wheel and ensurepip from the
+// Python installation of the final image. They run before the dependencies are copied, so that the
+// versions of setuptools or wheel required by the project are kept.
+func SlimRuntimeCommands(c *config.Config) []string {
+	if !c.SlimRuntime {
+		return nil
+	}
+	return []string{"rm -rf " + strings.Join(slimRuntimePaths, " ")}
+}
+
+func slimRuntime(c *config.Config) Block {
+	commands := SlimRuntimeCommands(c)
+	if len(commands) == 0 {
+		return nil
 	}
-	return line
+	return step("remove package managers", Block{run(nil, commands...)})
 }
 
-func createNonRootUser(c *config.Config) string {
-	line := "\n"
+// User returns the user of the final image, as uid:gid
+func User(c *config.Config) string {
+	return fmt.Sprintf("%d:%d", c.Uid, c.Gid)
+}
+
+// user returns the USER instruction switching to the user of the config
+func user(c *config.Config) Instruction {
+	return Instruction{Command: "USER", Args: []string{User(c)}}
+}
+
+// CreateUserCommands returns the commands creating the non root user of the config
+func CreateUserCommands(c *config.Config) []string {
+	if c.RunAsRoot {
+		return nil
+	}
 	if c.Flavor == "alpine" {
-		line += "RUN addgroup 65532 && adduser -u 65532 -G 65532 -h /home/nonroot -D nonroot\n"
-	} else {
-		line += "RUN useradd --uid=65532 --user-group --home-dir=/home/nonroot --create-home nonroot\n"
+		return []string{fmt.Sprintf("addgroup -g %d %s", c.Gid, c.User), fmt.Sprintf("adduser -u %d -G %s -h %s -D %s", c.Uid, c.User, c.Home, c.User)}
 	}
-	line += "USER 65532:65532\n"
-	return line
+	return []string{fmt.Sprintf("groupadd --gid=%d %s", c.Gid, c.User), fmt.Sprintf("useradd --uid=%d --gid=%d --home-dir=%s --create-home %s", c.Uid, c.Gid, c.Home, c.User)}
 }
 
-func addEnvironmentVariables(envs map[string]string, placeholders map[string]string) string {
-	if len(envs) == 0 {
-		return ""
+func createNonRootUser(c *config.Config) Block {
+	if c.RunAsRoot {
+		return nil
 	}
-	lines := []string{"\n"}
-	for k, v := range envs {
-		v, err := shell.Expand(v, func(key string) string {
-			return placeholders[key]
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		lines = append(lines, fmt.Sprintf("ENV %s=%s", k, v))
+	return step("create user", Block{run(nil, CreateUserCommands(c)...), user(c)})
+}
+
+// ExpandPlaceholders expands the variables of a value using the placeholders
+func ExpandPlaceholders(value string, placeholders map[string]string) string {
+	v, err := shell.Expand(value, func(key string) string {
+		return placeholders[key]
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	return strings.Join(lines, "\n")
+	return v
 }
 
-func addLabels(labels map[string]string, placeholders map[string]string) string {
-	line := "\n"
-	for k, v := range labels {
-		v, err := shell.Expand(v, func(key string) string {
-			return placeholders[key]
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		line += fmt.Sprintf("LABEL %s=\"%s\"\n", k, v)
+func addEnvironmentVariables(envs map[string]string, placeholders map[string]string) Block {
+	var block Block
+	for _, k := range utils.SortedKeys(envs) {
+		block = append(block, keyValue("ENV", k, ExpandPlaceholders(envs[k], placeholders)))
+	}
+	return block
+}
+
+func addLabels(labels map[string]string, placeholders map[string]string) Block {
+	var block Block
+	for _, k := range utils.SortedKeys(labels) {
+		block = append(block, label(k, ExpandPlaceholders(labels[k], placeholders)))
 	}
-	return line
+	return block
 }
 
-func addAuthorsLabels(c *config.Config) string {
-	line := "\n"
+// metadataLabels returns the labels describing the project, in the order they are added
+func metadataLabels(c *config.Config) [][2]string {
+	if c.DisableMetadataLabels {
+		return nil
+	}
+	labels := [][2]string{
+		{"org.opencontainers.image.title", c.Name},
+		{"org.opencontainers.image.description", c.Description},
+		{"org.opencontainers.image.version", c.Version},
+		{"org.opencontainers.image.licenses", c.License},
+		{"org.opencontainers.image.url", projectUrl(c.Urls, "homepage", "home", "documentation")},
+		{"org.opencontainers.image.source", projectUrl(c.Urls, "source", "repository", "source code")},
+	}
 	if len(c.Authors) > 0 {
 		authors := make([]string, len(c.Authors))
 		for idx, author := range c.Authors {
@@ -120,57 +200,156 @@ func addAuthorsLabels(c *config.Config) string {
 				authors[idx] = author.Name
 			}
 		}
-		line += fmt.Sprintf("LABEL org.opencontainers.image.authors=\"%s\"", strings.Join(authors, ", "))
+		labels = append(labels, [2]string{"org.opencontainers.image.authors", strings.Join(authors, ", ")})
+	}
+	var filtered [][2]string
+	for _, l := range labels {
+		// Labels explicitly configured in the target have precedence
+		if _, ok := c.Labels[l[0]]; ok || l[1] == "" {
+			continue
+		}
+		filtered = append(filtered, l)
 	}
-	return line
+	return filtered
 }
 
-func copyFiles(c *config.Config) string {
-	line := "\n"
-	line += "COPY --from=builder /root/.local /home/nonroot/.local\n"
-	line += "ENV PATH=$PATH:/home/nonroot/.local/bin\n"
-	if len(c.CopyFiles) > 0 {
-		line += "\n"
-		for _, f := range c.CopyFiles {
-			if f.From != "" {
-				line += fmt.Sprintf("COPY --from=%s %s %s\n", f.From, f.Source, f.Destination)
-			} else {
-				line += fmt.Sprintf("COPY %s %s\n", f.Source, f.Destination)
-			}
-		}
+func addMetadataLabels(c *config.Config) Block {
+	var block Block
+	for _, l := range metadataLabels(c) {
+		block = append(block, label(l[0], l[1]))
 	}
-	return line
+	return block
 }
 
-func addFiles(c *config.Config) string {
-	line := "\n"
-	if len(c.AddFiles) > 0 {
-		line += "\n"
-		for _, f := range c.AddFiles {
-			if f.Checksum != "" {
-				line += fmt.Sprintf("ADD --checksum=%s %s %s\n", f.Checksum, f.Source, f.Destination)
+// projectUrl returns the first url found in the project urls under one of the given names.
+// Names are compared case insensitively, in the order of the sorted keys so that the same url is
+// used by every build when keys only differ by case.
+func projectUrl(urls map[string]string, names ...string) string {
+	keys := utils.SortedKeys(urls)
+	for _, name := range names {
+		for _, k := range keys {
+			if strings.EqualFold(k, name) {
+				return urls[k]
 			}
-			line += fmt.Sprintf("ADD %s %s\n", f.Source, f.Destination)
 		}
 	}
-	return line
+	return ""
 }
 
-func addEntrypointAndCommand(c *config.Config) string {
-	line := "\n"
-	if len(c.Entrypoint) > 0 {
-		entrypoint, err := json.Marshal(c.Entrypoint)
-		if err != nil {
-			log.Fatal(err)
-		}
-		line += fmt.Sprintf("ENTRYPOINT %s\n", entrypoint)
+// copyFiles copies the dependencies and the project into the prefix, the .local directory of the home
+// directory by default, using a COPY instruction each so that they are distinct layers, then copies
+// the files of the config
+func copyFiles(c *config.Config) Block {
+	block := Block{
+		{Command: "COPY", Flags: Flags{{Name: "from", Value: "builder"}}, Args: []string{DependenciesUserBase, c.Prefix}},
+		{Command: "COPY", Flags: Flags{{Name: "from", Value: "builder"}}, Args: []string{ProjectUserBase, c.Prefix}},
+		{Command: "ENV", Args: []string{fmt.Sprintf("PATH=$PATH:%s/bin", c.Prefix)}},
+	}
+	if c.Prefix != c.Home+"/.local" {
+		// Python looks up the user site-packages in the prefix rather than in the home directory
+		block = append(block, Instruction{Command: "ENV", Args: []string{"PYTHONUSERBASE=" + c.Prefix}})
+	}
+	if c.Optimize > 0 {
+		// The bytecode compiled at the same level in the build stage is used
+		block = append(block, Instruction{Command: "ENV", Args: []string{"PYTHONOPTIMIZE=" + strconv.Itoa(c.Optimize)}})
+	}
+	for _, f := range c.CopyFiles {
+		block = append(block, copyFile(c, f))
+	}
+	return step("copy files", block)
+}
+
+func addFiles(c *config.Config) Block {
+	var block Block
+	for _, f := range c.AddFiles {
+		block = append(block, addFile(c, f))
+	}
+	return step("add files", block)
+}
+
+// runRuntimeCommands runs the post install commands of the final stage as root
+func runRuntimeCommands(c *config.Config) Block {
+	if len(c.RuntimePostInstall) == 0 {
+		return nil
+	}
+	if c.RunAsRoot {
+		return runCommands(c.RuntimePostInstall)
+	}
+	block := Block{{Command: "USER", Args: []string{"root"}}}
+	block = append(block, runCommands(c.RuntimePostInstall)...)
+	return append(block, user(c))
+}
+
+func addVolumes(c *config.Config) Block {
+	if len(c.Volumes) == 0 {
+		return nil
+	}
+	return Block{execForm("VOLUME", c.Volumes)}
+}
+
+func addShell(c *config.Config) Block {
+	if len(c.Shell) == 0 {
+		return nil
+	}
+	return Block{execForm("SHELL", c.Shell)}
+}
+
+// Entrypoint returns the entrypoint of the final image, which is run by tini when init is enabled
+func Entrypoint(c *config.Config) []string {
+	if c.Init {
+		return append([]string{tiniPath(c), "--"}, c.Entrypoint...)
+	}
+	return c.Entrypoint
+}
+
+func addEntrypointAndCommand(c *config.Config) Block {
+	var block Block
+	if entrypoint := Entrypoint(c); len(entrypoint) > 0 {
+		block = append(block, execForm("ENTRYPOINT", entrypoint))
 	}
 	if len(c.Command) > 0 {
-		cmd, err := json.Marshal(c.Command)
-		if err != nil {
-			log.Fatal(err)
+		block = append(block, execForm("CMD", c.Command))
+	}
+	return block
+}
+
+// tiniPath returns the path where tini is installed by the package manager
+func tiniPath(c *config.Config) string {
+	if c.Flavor == "alpine" {
+		return "/sbin/tini"
+	}
+	return "/usr/bin/tini"
+}
+
+func addStopSignal(c *config.Config) Block {
+	if c.StopSignal == "" {
+		return nil
+	}
+	return Block{{Command: "STOPSIGNAL", Args: []string{c.StopSignal}}}
+}
+
+func addExpose(c *config.Config) Block {
+	if len(c.Expose) == 0 {
+		return nil
+	}
+	return Block{{Command: "EXPOSE", Args: c.Expose}}
+}
+
+// addHealthcheck returns the HEALTHCHECK instruction running the command of the healthcheck in exec form
+func addHealthcheck(c *config.Config) Block {
+	h := c.Healthcheck
+	if h == nil {
+		return nil
+	}
+	var flags Flags
+	for _, flag := range []Flag{{Name: "interval", Value: h.Interval}, {Name: "timeout", Value: h.Timeout}, {Name: "start-period", Value: h.StartPeriod}} {
+		if flag.Value != "" {
+			flags = append(flags, flag)
 		}
-		line += fmt.Sprintf("CMD %s\n", cmd)
 	}
-	return line
+	if h.Retries > 0 {
+		flags = append(flags, Flag{Name: "retries", Value: strconv.Itoa(h.Retries)})
+	}
+	command := execForm("CMD", h.Command)
+	return Block{{Command: "HEALTHCHECK", Flags: flags, Args: []string{command.String()}}}
 }
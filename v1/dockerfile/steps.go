@@ -0,0 +1,51 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Step is the step of a stage which generated an instruction of a Dockerfile
+type Step struct {
+	// Name of the stage, or stage-N for the unnamed Nth stage as named by buildkit
+	Stage string
+	// Name of the step, e.g. install dependencies
+	Name string
+}
+
+// Steps returns the steps which generated the instructions of a Dockerfile, by line number
+// starting at 1. The steps are read from the step comments of the generated Dockerfile, so
+// instructions which are not preceded by a step comment, such as raw instructions, are not returned.
+func Steps(dockerfile string) map[int]Step {
+	steps := map[int]Step{}
+	stage := ""
+	stages := 0
+	current := ""
+	heredoc := false
+	for i, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case heredoc:
+			// The lines of heredocs are not instructions
+			heredoc = line != heredocDelimiter
+		case line == "":
+			current = ""
+		case strings.HasPrefix(line, stepCommentPrefix):
+			current = strings.TrimPrefix(line, stepCommentPrefix)
+		case strings.HasPrefix(line, "#"):
+		default:
+			if fields := strings.Fields(line); strings.EqualFold(fields[0], "FROM") {
+				stage = fmt.Sprintf("stage-%d", stages)
+				if len(fields) >= 4 && strings.EqualFold(fields[len(fields)-2], "AS") {
+					stage = fields[len(fields)-1]
+				}
+				stages++
+			}
+			if current != "" {
+				steps[i+1] = Step{Stage: stage, Name: current}
+			}
+			heredoc = strings.HasSuffix(line, "<<"+heredocDelimiter)
+		}
+	}
+	return steps
+}
@@ -0,0 +1,93 @@
+package dockerfile
+
+import (
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/charbonats/microbuild/v1/config"
+)
+
+// Names of the templates used to generate the stages of the Dockerfile.
+// Each template can be overridden by a file of the same name in a templates directory.
+const (
+	BuildStageTemplate = "build_stage.tmpl"
+	RunStageTemplate   = "run_stage.tmpl"
+)
+
+// TemplateNames lists the templates which can be overridden, in the order of the generated stages
+var TemplateNames = []string{BuildStageTemplate, RunStageTemplate}
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// templateData is the data given to the stage templates
+type templateData struct {
+	Config       *config.Config
+	Placeholders map[string]string
+}
+
+// templateFuncs are the functions available in the stage templates.
+// Each function generates a part of a stage and can be used in overridden templates.
+var templateFuncs = template.FuncMap{
+	// Build stage
+	"fromBuilderStage":               fromBuilderStage,
+	"installBuildDeps":               installBuildDeps,
+	"addBuilderEnvironmentVariables": addBuilderEnvironmentVariables,
+	"installRustToolchain":           installRustToolchain,
+	"copyFilesBeforeBuild":           copyFilesBeforeBuild,
+	"addFilesBeforeBuild":            addFilesBeforeBuild,
+	"installPythonDeps":              installPythonDeps,
+	"installLocalDependencies":       installLocalDependencies,
+	"installProject":                 installProject,
+	"clearInstalledPythonLibs":       clearInstalledPythonLibs,
+	"compileBytecode":                compileBytecode,
+	// Final stage
+	"fromFinalStage":          fromFinalStage,
+	"installSystemDeps":       installSystemDeps,
+	"slimRuntime":             slimRuntime,
+	"createNonRootUser":       createNonRootUser,
+	"copyFiles":               copyFiles,
+	"addFiles":                addFiles,
+	"runRuntimeCommands":      runRuntimeCommands,
+	"addVolumes":              addVolumes,
+	"addShell":                addShell,
+	"addEntrypointAndCommand": addEntrypointAndCommand,
+	"addStopSignal":           addStopSignal,
+	"addExpose":               addExpose,
+	"addHealthcheck":          addHealthcheck,
+	"addEnvironmentVariables": addEnvironmentVariables,
+	"addImageLabels":          addImageLabels,
+	"addMetadataLabels":       addMetadataLabels,
+	// Helpers
+	"runCommands":     runCommands,
+	"addInstructions": addInstructions,
+	"cacheId":         CacheId,
+	"contextPath":     ContextPath,
+	"networkFlag":     networkFlag,
+	"secretMounts":    secretMounts,
+	"pipArgs":         pipArgs,
+}
+
+// renderTemplate renders a stage template. The default template is used unless
+// an override is provided for the template name.
+func renderTemplate(name string, overrides map[string]string, data *templateData) (string, error) {
+	text, ok := overrides[name]
+	if !ok {
+		content, err := defaultTemplates.ReadFile("templates/" + name)
+		if err != nil {
+			return "", err
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %w", name, err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", name, err)
+	}
+	return out.String(), nil
+}
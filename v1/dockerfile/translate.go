@@ -1,18 +1,126 @@
 package dockerfile
 
 import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
 	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/utils"
 )
 
-const pipCacheMount = " --mount=type=cache,target=/root/.cache"
+// Cache mounts use the cache id of the config (see CacheId) as prefix of their ids
+func pipCacheMount(c *config.Config) Flag {
+	return Flag{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-pip,target=/root/.cache", CacheId(c))}
+}
+
+// CcacheDir is the directory of the cache of ccache, mounted as a cache when native_build_cache is set
+const CcacheDir = "/root/.ccache"
+
+// nativeBuildCacheMounts returns the RUN flags mounting the cache of ccache, which is safe to share
+func nativeBuildCacheMounts(c *config.Config) Flags {
+	if !c.NativeBuildCache {
+		return nil
+	}
+	return Flags{{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-ccache,target=%s", CacheId(c), CcacheDir)}}
+}
+
+// The rust toolchain is installed at the locations used by the official rust images, and cargo
+// builds in a target directory mounted as a cache, so that crates are not compiled again
+const (
+	RustupHome     = "/usr/local/rustup"
+	CargoHome      = "/usr/local/cargo"
+	CargoTargetDir = "/root/.cargo-target"
+)
+
+// RustCaches returns the directories of cargo mounted as caches when dependencies are built,
+// by cache name. Cargo locks its directories, so that the caches can be shared.
+func RustCaches(c *config.Config) map[string]string {
+	if c.RustToolchain == "" {
+		return nil
+	}
+	return map[string]string{
+		"cargo-registry": CargoHome + "/registry",
+		"cargo-git":      CargoHome + "/git",
+		"cargo-target":   CargoTargetDir,
+	}
+}
 
-// Apt needs exclusive access to its data, so the caches use the option sharing=locked,
+// buildCacheMounts returns the RUN flags mounting the caches used to install python packages:
+// the cache of pip, and the caches of ccache and cargo when native extensions are built
+func buildCacheMounts(c *config.Config) Flags {
+	flags := append(Flags{pipCacheMount(c)}, nativeBuildCacheMounts(c)...)
+	caches := RustCaches(c)
+	for _, name := range utils.SortedKeys(caches) {
+		flags = append(flags, Flag{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-%s,target=%s", CacheId(c), name, caches[name])})
+	}
+	return flags
+}
+
+// nativeBuildCacheEnvs are the environment variables of the build stage wrapping the compilers with
+// ccache, for setuptools which reads CC and CXX as well as for cmake and meson based builds
+var nativeBuildCacheEnvs = map[string]string{
+	"CC":                          "ccache cc",
+	"CXX":                         "ccache c++",
+	"CMAKE_C_COMPILER_LAUNCHER":   "ccache",
+	"CMAKE_CXX_COMPILER_LAUNCHER": "ccache",
+	"CCACHE_DIR":                  CcacheDir,
+}
+
+// Apt needs exclusive access to its data, so the caches use the option sharing=locked by default,
 // which will make sure multiple parallel builds using the same cache mount will wait for
 // each other and not access the same cache files at the same time.
 // See https://github.com/moby/buildkit/blob/master/frontend/dockerfile/docs/reference.md#example-cache-apt-packages
-const aptCacheMount = " --mount=type=cache,target=/var/cache/apt,sharing=locked --mount=type=cache,target=/var/lib/apt,sharing=locked"
-const apkCacheMount = " --mount=type=cache,target=/var/cache/apk,sharing=locked"
-const sshMount = " --mount=type=ssh,required=true"
+func aptCacheMounts(c *config.Config) Flags {
+	return Flags{
+		{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-apt-cache,target=/var/cache/apt,sharing=%s", CacheId(c), c.PackageCacheSharing)},
+		{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-apt-lib,target=/var/lib/apt,sharing=%s", CacheId(c), c.PackageCacheSharing)},
+	}
+}
+
+func apkCacheMount(c *config.Config) Flag {
+	return Flag{Name: "mount", Value: fmt.Sprintf("type=cache,id=%s-apk,target=/var/cache/apk,sharing=%s", CacheId(c), c.PackageCacheSharing)}
+}
+
+// keepPackageCacheCommands returns the commands configuring the package manager of the flavor to
+// keep the downloaded packages in its cache mount. Debian images remove them after each install,
+// and apk only caches packages when /etc/apk/cache exists.
+func keepPackageCacheCommands(c *config.Config) []string {
+	if !c.KeepPackageCache {
+		return nil
+	}
+	if c.Flavor == "alpine" {
+		return []string{"ln -sf /var/cache/apk /etc/apk/cache"}
+	}
+	return []string{
+		"rm -f /etc/apt/apt.conf.d/docker-clean",
+		`echo 'Binary::apt::APT::Keep-Downloaded-Packages "true";' > /etc/apt/apt.conf.d/keep-cache`,
+	}
+}
+
+var sshMount = Flag{Name: "mount", Value: "type=ssh,required=true"}
+
+// Secret is a secret mounted by a RUN instruction. The secret is mounted
+// in /run/secrets when Target is empty.
+type Secret struct {
+	ID     string
+	Target string
+}
+
+// secretMountFlags returns the RUN flags used to mount secrets
+func secretMountFlags(secrets []Secret) Flags {
+	var flags Flags
+	for _, secret := range secrets {
+		if secret.Target == "" {
+			flags = append(flags, Flag{Name: "mount", Value: fmt.Sprintf("type=secret,id=%s", secret.ID)})
+		} else {
+			flags = append(flags, Flag{Name: "mount", Value: fmt.Sprintf("type=secret,id=%s,target=%s", secret.ID, secret.Target)})
+		}
+	}
+	return flags
+}
 
 var defaultEnvs = map[string]string{
 	"PIP_DISABLE_PIP_VERSION_CHECK": "1",
@@ -21,10 +129,227 @@ var defaultEnvs = map[string]string{
 	"PYTHONPYCACHEPREFIX":           "$HOME/.pycache",
 }
 
+// Label stamped on the images built by microb, whose value is the api version of the frontend
+const (
+	VersionLabel      = "microb.version"
+	VersionLabelValue = "v1"
+)
+
 var defaulLabels = map[string]string{
 	"org.opencontainers.image.description": "autogenerated by microb",
 	"moby.buildkit.frontend":               "microb",
-	"microb.version":                       "v1",
+	VersionLabel:                           VersionLabelValue,
+}
+
+// Proxy build arguments are predefined by docker. They are exported in the build stage
+// so that pip, apt and git use the proxy, but they are never exported in the final image.
+var proxyBuildArgs = map[string]bool{
+	"http_proxy":  true,
+	"https_proxy": true,
+	"ftp_proxy":   true,
+	"no_proxy":    true,
+	"all_proxy":   true,
+}
+
+// proxyEnvs returns the proxy environment variables found in the build arguments
+func proxyEnvs(buildArgs map[string]string) map[string]string {
+	envs := map[string]string{}
+	for k, v := range buildArgs {
+		if proxyBuildArgs[strings.ToLower(k)] {
+			envs[k] = v
+		}
+	}
+	return envs
+}
+
+var invalidCacheIdChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// CacheId returns the prefix of the ids of the cache mounts used by a config.
+// Unless overridden in the config, the prefix is unique for each project, target, flavor and python version,
+// so that unrelated builds running on a shared builder do not use the same caches.
+func CacheId(c *config.Config) string {
+	id := c.CacheId
+	if id == "" {
+		parts := []string{"microb"}
+		for _, part := range []string{c.Name, c.Target, c.Flavor, c.PythonVersion} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		id = strings.Join(parts, "-")
+	}
+	return invalidCacheIdChars.ReplaceAllString(id, "_")
+}
+
+// aptGet returns the apt-get command configured with the apt proxy of the config.
+// The proxy is given as an option rather than written in the apt configuration, so that
+// it is not kept in the final image.
+func aptGet(c *config.Config) string {
+	line := "apt-get"
+	if c.AptProxy != "" {
+		line += fmt.Sprintf(" -o Acquire::http::Proxy=%[1]s -o Acquire::https::Proxy=%[1]s", c.AptProxy)
+	}
+	if c.AptSnapshot != "" {
+		// Snapshots are signed once, their release files expire
+		line += " -o Acquire::Check-Valid-Until=false"
+	}
+	return line
+}
+
+// aptSources returns the commands used to replace the default debian mirror in apt sources,
+// either with the mirror or with the snapshot of the config
+func aptSources(c *config.Config) []string {
+	if c.AptSnapshot != "" {
+		return []string{fmt.Sprintf("find /etc/apt/ -name '*.list' -o -name '*.sources' | xargs -r sed -i -E 's#http://deb.debian.org/(debian|debian-security)( |$)#http://snapshot.debian.org/archive/\\1/%s\\2#g'", c.AptSnapshot)}
+	}
+	if c.AptMirror == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("find /etc/apt/ -name '*.list' -o -name '*.sources' | xargs -r sed -i 's|http://deb.debian.org|%s|g'", strings.TrimSuffix(c.AptMirror, "/"))}
+}
+
+// AptRepositoryKey returns the path of the key of an additional apt repository
+func AptRepositoryKey(i int) string {
+	return fmt.Sprintf("/etc/apt/keyrings/microb-%d.asc", i)
+}
+
+// addAptRepositoryKeys downloads the keys of the additional apt repositories
+func addAptRepositoryKeys(c *config.Config) []Instruction {
+	var instructions []Instruction
+	for i, repository := range c.AptRepositories {
+		if repository.KeyUrl != "" {
+			instructions = append(instructions, Instruction{Command: "ADD", Args: []string{repository.KeyUrl, AptRepositoryKey(i)}})
+		}
+	}
+	return instructions
+}
+
+// AptRepositorySecrets returns the keys of the additional apt repositories provided as secrets
+func AptRepositorySecrets(c *config.Config) []Secret {
+	var secrets []Secret
+	for i, repository := range c.AptRepositories {
+		if repository.KeySecret != "" {
+			secrets = append(secrets, Secret{ID: repository.KeySecret, Target: AptRepositoryKey(i)})
+		}
+	}
+	return secrets
+}
+
+// aptRepositories returns the commands used to add the additional apt repositories to apt sources
+func aptRepositories(c *config.Config) []string {
+	var commands []string
+	for i, repository := range c.AptRepositories {
+		options := ""
+		if repository.KeyUrl != "" || repository.KeySecret != "" {
+			options = fmt.Sprintf("[signed-by=%s] ", AptRepositoryKey(i))
+		}
+		source := strings.Join(append([]string{"deb", options + repository.Url, repository.Suite}, repository.Components...), " ")
+		commands = append(commands, fmt.Sprintf("echo '%s' > /etc/apt/sources.list.d/microb-%d.list", source, i))
+	}
+	return commands
+}
+
+// aptInstall returns the commands used to install system packages with apt, including
+// the commands configuring the mirror, the snapshot and the additional repositories
+func aptInstall(c *config.Config, deps []string) []string {
+	commands := append(aptSources(c), aptRepositories(c)...)
+	return append(commands,
+		command(aptGet(c), "update"),
+		command(aptGet(c), "install -y --no-install-recommends", systemPackages(deps)),
+	)
+}
+
+// apkRepositories returns the apk flags used to add the additional apk repositories
+func apkRepositories(c *config.Config) string {
+	args := make([]string, 0, len(c.ApkRepositories))
+	for _, repository := range c.ApkRepositories {
+		args = append(args, fmt.Sprintf("--repository %s", repository))
+	}
+	return strings.Join(args, " ")
+}
+
+// systemPackages returns the shell arguments of system packages.
+// Packages are quoted when they contain version constraints which would be interpreted by the shell.
+func systemPackages(deps []string) string {
+	args := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		if strings.ContainsAny(dep, "*<>~") {
+			dep = fmt.Sprintf("'%s'", dep)
+		}
+		args = append(args, dep)
+	}
+	return strings.Join(args, " ")
+}
+
+// ContextPath returns the path of a source file relative to the context directory of the config.
+// Sources which are not local paths, such as urls, are returned unchanged.
+func ContextPath(c *config.Config, src string) string {
+	if c.ContextDir == "" || strings.Contains(src, "://") {
+		return src
+	}
+	return path.Join(c.ContextDir, src)
+}
+
+// runCommands returns a RUN instruction for each shell command
+func runCommands(commands []string) Block {
+	var block Block
+	for _, command := range commands {
+		block = append(block, run(nil, command))
+	}
+	return step("run commands", block)
+}
+
+// addInstructions inserts raw Dockerfile instructions
+func addInstructions(instructions string) string {
+	instructions = strings.TrimSpace(instructions)
+	if instructions == "" {
+		return ""
+	}
+	return "\n" + instructions + "\n"
+}
+
+// copyFile returns the COPY instruction of a file copy operation
+func copyFile(c *config.Config, f config.Copy) Instruction {
+	var flags Flags
+	src := ContextPath(c, f.Source)
+	if f.From != "" {
+		flags = append(flags, Flag{Name: "from", Value: f.From})
+		src = f.Source
+	}
+	if f.Chown != "" {
+		flags = append(flags, Flag{Name: "chown", Value: f.Chown})
+	}
+	if f.Chmod != "" {
+		flags = append(flags, Flag{Name: "chmod", Value: f.Chmod})
+	}
+	if f.Link {
+		flags = append(flags, Flag{Name: "link"})
+	}
+	return Instruction{Command: "COPY", Flags: flags, Args: []string{src, f.Destination}}
+}
+
+// addFile returns the ADD instruction of a file add operation
+func addFile(c *config.Config, f config.Add) Instruction {
+	var flags Flags
+	if f.Checksum != "" {
+		flags = append(flags, Flag{Name: "checksum", Value: f.Checksum})
+	}
+	return Instruction{Command: "ADD", Flags: flags, Args: []string{ContextPath(c, f.Source), f.Destination}}
+}
+
+// syntaxDirective returns the syntax directive of the Dockerfile generated for a config, using
+// the oldest version of the Dockerfile syntax supporting the generated instructions.
+// Heredocs and COPY --link require the version 1.4, ADD --checksum requires the version 1.6.
+func syntaxDirective(c *config.Config) string {
+	version := "1.4"
+	for _, files := range [][]config.Add{c.AddFilesBeforeBuild, c.AddFiles} {
+		for _, f := range files {
+			if f.Checksum != "" {
+				version = "1.6"
+			}
+		}
+	}
+	return fmt.Sprintf("# syntax=docker/dockerfile:%s", version)
 }
 
 // Microb2Dockerfile translates a microb config into a Dockerfile.
@@ -32,7 +357,31 @@ func Microb2Dockerfile(
 	c *config.Config,
 	placeholders map[string]string,
 ) string {
-	dockerfile := buildStage(c, placeholders)
-	dockerfile += runStage(c, placeholders)
+	dockerfile, err := Microb2DockerfileWithTemplates(c, placeholders, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return dockerfile
 }
+
+// Microb2DockerfileWithTemplates translates a microb config into a Dockerfile,
+// using the given templates instead of the default templates of the same name.
+func Microb2DockerfileWithTemplates(
+	c *config.Config,
+	placeholders map[string]string,
+	templates map[string]string,
+) (string, error) {
+	data := &templateData{Config: c, Placeholders: placeholders}
+	var stages []string
+	for _, name := range TemplateNames {
+		stage, err := renderTemplate(name, templates, data)
+		if err != nil {
+			return "", err
+		}
+		// Stages are separated by a single empty line whatever the newlines of the templates
+		if stage = strings.Trim(stage, "\n"); stage != "" {
+			stages = append(stages, stage)
+		}
+	}
+	return syntaxDirective(c) + "\n" + strings.Join(stages, "\n\n") + "\n", nil
+}
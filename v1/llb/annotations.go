@@ -0,0 +1,23 @@
+package llb
+
+import (
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// addAnnotations adds the annotations of a config to the manifests of the images of a result,
+// with their placeholders expanded like labels.
+// Annotations are also added to the image index when the result is exported as an index, which
+// is the case of multi-platform builds and of builds with attestations: buildkit rejects index
+// annotations for single platform images.
+func addAnnotations(res *client.Result, c *config.Config, placeholders map[string]string, index bool) {
+	for k, v := range c.Annotations {
+		value := []byte(dockerfile.ExpandPlaceholders(v, placeholders))
+		res.AddMeta(exptypes.AnnotationManifestKey(nil, k), value)
+		if index {
+			res.AddMeta(exptypes.AnnotationIndexKey(k), value)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package llb
+
+import (
+	"context"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/attestations"
+	"github.com/moby/buildkit/frontend/attestations/sbom"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/result"
+	"github.com/pkg/errors"
+)
+
+// sbomScanner returns the scanner generating the SBOM attestations requested by the
+// attest:sbom option, or nil when no SBOM attestation is requested.
+// Provenance attestations are generated by buildkit itself, not by the frontend.
+func sbomScanner(ctx context.Context, c client.Client, attests map[string]map[string]string) (sbom.Scanner, error) {
+	attrs, ok := attests[attestations.KeyTypeSbom]
+	if !ok {
+		return nil, nil
+	}
+	src, ok := attrs["generator"]
+	if !ok {
+		return nil, errors.Errorf("sbom scanner cannot be empty")
+	}
+	ref, err := reference.ParseNormalizedNamed(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse sbom scanner %s", src)
+	}
+	return sbom.CreateSBOMScanner(ctx, c, reference.TagNameOnly(ref).String())
+}
+
+// addSBOMAttestations scans the image of each platform, and adds the SBOM attestations to the
+// result under the id of the platform, like the dockerfile frontend does even for a single platform
+func addSBOMAttestations(ctx context.Context, c client.Client, scanner sbom.Scanner, res *client.Result, results []*buildResult) error {
+	for _, br := range results {
+		var opts []llb.ConstraintsOpt
+		if br.SBOMTargets.IgnoreCache {
+			opts = append(opts, llb.IgnoreCache)
+		}
+		att, err := scanner(ctx, br.ExportPlatform.ID, br.SBOMTargets.Core, br.SBOMTargets.Extras, opts...)
+		if err != nil {
+			return err
+		}
+		attSolve, err := result.ConvertAttestation(&att, func(st llb.State) (client.Reference, error) {
+			def, err := st.Marshal(ctx)
+			if err != nil {
+				return nil, err
+			}
+			r, err := c.Solve(ctx, client.SolveRequest{Definition: def.ToPB()})
+			if err != nil {
+				return nil, err
+			}
+			return r.SingleRef()
+		})
+		if err != nil {
+			return err
+		}
+		res.AddAttestation(br.ExportPlatform.ID, *attSolve)
+	}
+	return nil
+}
@@ -3,8 +3,12 @@ package llb
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"net"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/charbonats/microbuild/v1/config"
@@ -13,8 +17,15 @@ import (
 	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/attestations"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/frontend/subrequests"
+	"github.com/moby/buildkit/frontend/subrequests/outline"
+	"github.com/moby/buildkit/frontend/subrequests/targets"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -27,8 +38,16 @@ const (
 	keyCacheFrom          = "cache-from"    // for registry only. deprecated in favor of keyCacheImports
 	keyCacheImports       = "cache-imports" // JSON representation of []CacheOptionsEntry
 	keyConfigPath         = "filename"
+	keyNoCache            = "no-cache"
+	keyForceNetwork       = "force-network-mode"
+	keyGlobalAddHosts     = "add-hosts"
+	keyShmSize            = "shm-size"
+	keyUlimit             = "ulimit"
 	keyTargetPlatform     = "platform"
 	dockerignoreFilename  = ".dockerignore"
+	keyContextKeepGitDir  = "build-arg:BUILDKIT_CONTEXT_KEEP_GIT_DIR"
+	keyDebugOnFailure     = "debug-on-failure"
+	keyAllTargets         = "all-targets"
 
 	// Support the dockerfile frontend's build-arg: options which include, but
 	// are not limited to, setting proxies.
@@ -39,12 +58,40 @@ const (
 	labelPrefix = "label:"
 )
 
+// ImageNameKey is the key of the result metadata holding the name of the image, see config.ImageName
+const ImageNameKey = "microb.image.name"
+
 // Build builds an image by first reading the pyproject.toml file from the local
-// context and then translating it into a Dockerfile. The Dockerfile is then
-// compiled to an LLB state and solved to produce a build result.
+// context and then building the LLB state of the image from the configuration.
+// The state is then solved to produce a build result. Configurations using templates
+// or extra instructions are translated into a Dockerfile compiled to an LLB state instead.
 func Build(ctx context.Context, c client.Client) (*client.Result, error) {
+	return build(ctx, c, nil)
+}
+
+// build builds an image, opening the debug shell in the failing RUN instruction
+// when the debug-on-failure option is set
+func build(ctx context.Context, c client.Client, shell *DebugShell) (*client.Result, error) {
+	return buildTarget(ctx, c, shell, "")
+}
+
+// buildTarget builds the image of a target, which is selected by the microb_target build argument
+// unless a target is given. All the targets are built when the all-targets option is set and no
+// target is given.
+func buildTarget(ctx context.Context, c client.Client, shell *DebugShell, selected string) (*client.Result, error) {
 	buildOpts := c.BuildOpts()
 	opts := buildOpts.Opts
+	if err := validateCaps(opts[keyFrontendCaps]); err != nil {
+		return nil, err
+	}
+	requestID := opts[keyRequestID]
+	switch requestID {
+	case "", outline.RequestSubrequestsOutline, targets.RequestTargets, requestSubrequestsLint:
+	case subrequests.RequestSubrequestsDescribe:
+		return describeSubrequests()
+	default:
+		return nil, errdefs.NewUnsupportedSubrequestError(requestID)
+	}
 	filename := opts[keyConfigPath]
 	if filename == "" {
 		filename = defaultDockerfileName
@@ -52,34 +99,105 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 	buildargs := utils.Filter(opts, buildArgPrefix)
 	labels := utils.Filter(opts, labelPrefix)
 	target := ""
+	contextDir := ""
+	templatesDir := ""
+	output := ""
+	var pythonVersions []string
 	for k, v := range buildargs {
-		if strings.ToLower(k) == "microb_target" {
+		switch strings.ToLower(k) {
+		case "microb_target":
 			target = v
-			break
+		case "microb_context_dir":
+			contextDir = v
+		case "microb_templates_dir":
+			templatesDir = v
+		case "microb_output":
+			output = v
+		case "microb_python_versions":
+			pythonVersions = strings.Split(v, ",")
 		}
 	}
+	allTargets, _ := strconv.ParseBool(opts[keyAllTargets])
+	if selected != "" {
+		target = selected
+		allTargets = false
+	}
+	// The wheelhouse output exports the wheels of the dependencies instead of the image
+	stageTarget := ""
+	switch output {
+	case "", "image":
+	case "wheelhouse":
+		stageTarget = dockerfile.WheelhouseStageName
+	default:
+		return nil, errors.Errorf("invalid microb_output %s, must be image or wheelhouse", output)
+	}
+	// The build context is either the local context or a remote git repository
+	keepGit, _ := strconv.ParseBool(opts[keyContextKeepGitDir])
+	buildContext, _ := gitContext(opts[localNameContext], keepGit)
 	options := &config.Options{
-		Filename:  filename,
-		Target:    target,
-		BuildArgs: buildargs,
-		ReadPythonVersion: func() string {
-			return readPythonVersion(ctx, c)
+		Filename:   filename,
+		Target:     target,
+		ContextDir: contextDir,
+		BuildArgs:  buildargs,
+		// Python versions given as build argument override the ones of pyproject.toml
+		PythonVersions: pythonVersions,
+		ReadPythonVersion: func(dir string) string {
+			return readPythonVersion(ctx, c, buildContext, dir)
 		},
 		ReadRequirements: func(name string) ([]string, error) {
-			return readRequirementsTxt(ctx, c, name)
+			return readRequirementsTxt(ctx, c, buildContext, name)
+		},
+		PathExists: func(name string) bool {
+			return pathExistsInContext(ctx, c, buildContext, name)
 		},
+		ReadFile: func(name string) ([]byte, error) {
+			return readFileFromContext(ctx, c, buildContext, name, true)
+		},
+	}
+	microbConfig, pyproject, err := readMicrobConfig(ctx, c, buildContext, options)
+	if requestID == requestSubrequestsLint && pyproject != nil {
+		return lintSubrequest(pyproject, filename, options)
 	}
-	microbConfig, err := readMicrobConfig(ctx, c, options)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get pyproject.toml")
 	}
-	dockerfile := dockerfile.Microb2Dockerfile(microbConfig, options.BuildArgs)
+	if requestID == targets.RequestTargets {
+		return targetsSubrequest(pyproject)
+	}
+	if allTargets && requestID == "" {
+		return buildAllTargets(ctx, c, shell, pyproject)
+	}
+	if err := checkClientExports(microbConfig, opts); err != nil {
+		return nil, err
+	}
+	templates, err := readTemplates(ctx, c, buildContext, templatesDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read templates")
+	}
+	// The Dockerfile is only generated when the image cannot be built natively,
+	// or to describe the build in the outline
+	generated := ""
+	if !NativeSupported(microbConfig, templates) || requestID == outline.RequestSubrequestsOutline {
+		generated, err = dockerfile.Microb2DockerfileWithTemplates(microbConfig, options.BuildArgs, templates)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate Dockerfile")
+		}
+		if stageTarget == dockerfile.WheelhouseStageName {
+			generated += "\n" + dockerfile.WheelhouseStages(microbConfig)
+		}
+		if err := ValidateDockerfile(generated); err != nil {
+			return nil, err
+		}
+	}
+	labels = utils.Union(gitLabels(ctx, c, buildContext, buildargs, labels), labels)
 
-	excludes, err := readDockerIgnoreFile(ctx, c)
+	ignoreFilename, required := dockerIgnoreFilename(ctx, c, buildContext, microbConfig)
+	excludes, err := readDockerIgnoreFile(ctx, c, buildContext, ignoreFilename, required)
 
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(`failed to read "%s"`, dockerignoreFilename))
+		return nil, errors.Wrap(err, fmt.Sprintf(`failed to read "%s"`, ignoreFilename))
 	}
+	excludes = append(excludes, sourceExcludes(microbConfig)...)
 
 	// Parse cache imports
 	cacheImports, err := parseCacheOptions(opts)
@@ -88,6 +206,39 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		return nil, errors.Wrap(err, "failed to parse cache import options")
 	}
 
+	// Parse stages which should not use build cache
+	ignoreCache := parseNoCache(opts)
+
+	// Parse the network mode used by default for RUN instructions
+	netMode, err := parseNetMode(opts[keyForceNetwork])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse network mode")
+	}
+
+	// Parse the options applied to all RUN instructions
+	extraHosts, err := parseExtraHosts(opts[keyGlobalAddHosts])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse additional hosts")
+	}
+
+	shmSize, err := parseShmSize(opts[keyShmSize])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse shm size")
+	}
+
+	ulimit, err := parseUlimits(opts[keyUlimit])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse ulimit")
+	}
+
+	// Parse whether a shell is opened in the failing RUN instruction
+	debugOnFailure, _ := strconv.ParseBool(opts[keyDebugOnFailure])
+	if !debugOnFailure {
+		shell = nil
+	} else if shell == nil {
+		return nil, errors.New("debug-on-failure requires an interactive terminal, use microb build --debug-on-failure")
+	}
+
 	// Default the build platform to the buildkit host's os/arch
 	defaultBuildPlatform := platforms.DefaultSpec()
 
@@ -109,28 +260,67 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		}
 	}
 
+	if requestID == outline.RequestSubrequestsOutline {
+		return outlineSubrequest(ctx, microbConfig, pyproject, generated, dockerfile2llb.ConvertOpt{
+			MetaResolver:   c,
+			BuildContext:   buildContext,
+			SessionID:      buildOpts.SessionID,
+			BuildArgs:      buildargs,
+			Labels:         labels,
+			ContextByName:  contextByNameFunc(c),
+			BuildPlatforms: buildPlatforms,
+			TargetPlatform: targetPlatforms[0],
+			Target:         stageTarget,
+		})
+	}
+
+	if err := checkPythonImages(ctx, c, microbConfig, defaultBuildPlatform, targetPlatforms[0]); err != nil {
+		return nil, err
+	}
+
+	// Parse the attestations requested by the client, and create the SBOM scanner if needed
+	attests, err := attestations.Parse(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse attestations")
+	}
+	scanner, err := sbomScanner(ctx, c, attests)
+	if err != nil {
+		return nil, err
+	}
+
+	llbCaps := buildOpts.LLBCaps
 	isMultiPlatform := len(targetPlatforms) > 1
 	exportPlatforms := &exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(targetPlatforms)),
 	}
+	results := make([]*buildResult, len(targetPlatforms))
 	finalResult := client.NewResult()
 
-	eg, ctx := errgroup.WithContext(ctx)
+	eg, egCtx := errgroup.WithContext(ctx)
 
 	// Solve for all target platforms in parallel
 	for i, tp := range targetPlatforms {
 		func(i int, platform *ocispecs.Platform) {
 			eg.Go(func() (err error) {
-				result, err := buildImage(ctx, c, dockerfile, dockerfile2llb.ConvertOpt{
+				result, err := buildImage(egCtx, c, microbConfig, generated, dockerfile2llb.ConvertOpt{
 					MetaResolver:   c,
+					LLBCaps:        &llbCaps,
+					BuildContext:   buildContext,
 					SessionID:      buildOpts.SessionID,
 					BuildArgs:      buildargs,
 					Labels:         labels,
 					Excludes:       excludes,
+					IgnoreCache:    ignoreCache,
+					ForceNetMode:   netMode,
+					ExtraHosts:     extraHosts,
+					ShmSize:        shmSize,
+					Ulimit:         ulimit,
+					ContextByName:  contextByNameFunc(c),
 					BuildPlatforms: buildPlatforms,
 					TargetPlatform: platform,
 					PrefixPlatform: isMultiPlatform,
-				}, cacheImports)
+					Target:         stageTarget,
+				}, target, cacheImports, shell)
 
 				if err != nil {
 					return errors.Wrap(err, "failed to build image")
@@ -138,6 +328,7 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 
 				result.AddToClientResult(finalResult)
 				exportPlatforms.Platforms[i] = result.ExportPlatform
+				results[i] = result
 
 				return nil
 			})
@@ -148,14 +339,97 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		return nil, err
 	}
 
-	if isMultiPlatform {
-		dt, err := json.Marshal(exportPlatforms)
+	// Attestations are attached to the images of each platform
+	if scanner != nil {
+		if err := addSBOMAttestations(ctx, c, scanner, finalResult, results); err != nil {
+			return nil, errors.Wrap(err, "failed to generate SBOM attestations")
+		}
+	}
+
+	// Images are exported as an index when several platforms are built or when attestations are requested
+	addAnnotations(finalResult, microbConfig, buildargs, isMultiPlatform || len(attests) > 0)
+
+	// The name of the image is given to clients, so that they can tag the exported image
+	if microbConfig.Image != "" {
+		name, err := config.ImageName(microbConfig, labels[labelRevision])
 		if err != nil {
 			return nil, err
 		}
-		finalResult.AddMeta(exptypes.ExporterPlatformsKey, dt)
+		finalResult.AddMeta(ImageNameKey, []byte(name))
 	}
 
+	// The platforms are always given, so that the exporter can find the images of attestations
+	dt, err := json.Marshal(exportPlatforms)
+	if err != nil {
+		return nil, err
+	}
+	finalResult.AddMeta(exptypes.ExporterPlatformsKey, dt)
+
+	return finalResult, nil
+}
+
+// buildAllTargets builds the images of all the targets of a pyproject.toml file concurrently, in a
+// single solve sharing the build context. The result holds the references and the image configs of
+// each target under the name of the target, e.g. api or api/linux/amd64 for multi-platform builds,
+// which identifies the images in the platforms mapping read by exporters, and the other metadata of
+// each target prefixed by the name of the target.
+func buildAllTargets(ctx context.Context, c client.Client, shell *DebugShell, pyproject []byte) (*client.Result, error) {
+	names, err := config.Targets(pyproject)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list targets")
+	}
+	if len(names) == 0 {
+		return nil, errors.New("all-targets requires targets declared in [tool.microb.target]")
+	}
+	results := make([]*client.Result, len(names))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, name := range names {
+		func(i int, name string) {
+			eg.Go(func() error {
+				result, err := buildTarget(egCtx, c, shell, name)
+				if err != nil {
+					return errors.Wrapf(err, "failed to build target %s", name)
+				}
+				results[i] = result
+				return nil
+			})
+		}(i, name)
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	finalResult := client.NewResult()
+	exportPlatforms := &exptypes.Platforms{}
+	for i, result := range results {
+		// The images of the targets are given to the exporter as the images of platforms identified
+		// by the names of the targets, so that they are exported together
+		var targetPlatforms exptypes.Platforms
+		if err := json.Unmarshal(result.Metadata[exptypes.ExporterPlatformsKey], &targetPlatforms); err != nil {
+			return nil, errors.Wrapf(err, "failed to read the platforms of target %s", names[i])
+		}
+		for _, p := range targetPlatforms.Platforms {
+			ref, imageConfig := result.Ref, result.Metadata[exptypes.ExporterImageConfigKey]
+			id := names[i]
+			if ref == nil {
+				ref, imageConfig = result.Refs[p.ID], result.Metadata[exptypes.ExporterImageConfigKey+"/"+p.ID]
+				id += "/" + p.ID
+			}
+			finalResult.AddRef(id, ref)
+			finalResult.AddMeta(exptypes.ExporterImageConfigKey+"/"+id, imageConfig)
+			exportPlatforms.Platforms = append(exportPlatforms.Platforms, exptypes.Platform{ID: id, Platform: p.Platform})
+		}
+		for k, v := range result.Metadata {
+			if k == exptypes.ExporterPlatformsKey || k == exptypes.ExporterImageConfigKey || strings.HasPrefix(k, exptypes.ExporterImageConfigKey+"/") {
+				continue
+			}
+			finalResult.AddMeta(names[i]+"/"+k, v)
+		}
+	}
+	dt, err := json.Marshal(exportPlatforms)
+	if err != nil {
+		return nil, err
+	}
+	finalResult.AddMeta(exptypes.ExporterPlatformsKey, dt)
 	return finalResult, nil
 }
 
@@ -167,8 +441,8 @@ type buildResult struct {
 	// Image configuration
 	ImageConfig []byte
 
-	// Extra build info
-	BuildInfo []byte
+	// States scanned to generate the SBOM attestation of the image
+	SBOMTargets *dockerfile2llb.SBOMTargets
 
 	// Target platform
 	Platform *ocispecs.Platform
@@ -187,51 +461,79 @@ func (br *buildResult) AddToClientResult(cr *client.Result) {
 			fmt.Sprintf("%s/%s", exptypes.ExporterImageConfigKey, br.ExportPlatform.ID),
 			br.ImageConfig,
 		)
-		cr.AddMeta(
-			fmt.Sprintf("%s/%s", exptypes.ExporterBuildInfo, br.ExportPlatform.ID),
-			br.BuildInfo,
-		)
 		cr.AddRef(br.ExportPlatform.ID, br.Reference)
 	} else {
 		cr.AddMeta(exptypes.ExporterImageConfigKey, br.ImageConfig)
-		cr.AddMeta(exptypes.ExporterBuildInfo, br.BuildInfo)
 		cr.SetRef(br.Reference)
 	}
 }
 
-// buildImage compiles a Dockerfile to an LLB state and solves it to produce a build result
-func buildImage(ctx context.Context, c client.Client, dockerfile string, convertOpts dockerfile2llb.ConvertOpt, cacheImports []client.CacheOptionsEntry) (*buildResult, error) {
+// buildImage builds the LLB state of an image and solves it to produce a build result.
+// The state is built natively from the config, unless a generated Dockerfile is given,
+// in which case the Dockerfile is compiled to the state.
+// When a debug shell is given, the state is evaluated so that the shell can be opened
+// in the failing step.
+func buildImage(ctx context.Context, c client.Client, microbConfig *config.Config, generated string, convertOpts dockerfile2llb.ConvertOpt, target string, cacheImports []client.CacheOptionsEntry, shell *DebugShell) (*buildResult, error) {
 	result := buildResult{
 		Platform:      convertOpts.TargetPlatform,
 		MultiPlatform: convertOpts.PrefixPlatform,
 	}
 
-	state, image, bi, err := dockerfile2llb.Dockerfile2LLB(ctx, []byte(dockerfile), convertOpts)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to compile to LLB state")
+	var platform *ocispecs.Platform
+	if convertOpts.PrefixPlatform {
+		platform = convertOpts.TargetPlatform
 	}
 
-	result.ImageConfig, err = json.Marshal(image)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal image config")
-	}
-
-	def, err := state.Marshal(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal definition")
+	var def *llb.Definition
+	if generated == "" {
+		build := Microb2LLB
+		if convertOpts.Target == dockerfile.WheelhouseStageName {
+			build = Wheelhouse2LLB
+		}
+		state, image, err := build(ctx, microbConfig, target, convertOpts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to build LLB state")
+		}
+		result.ImageConfig, err = json.Marshal(image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal image config")
+		}
+		result.SBOMTargets = &dockerfile2llb.SBOMTargets{
+			Core:        *state,
+			IgnoreCache: ignoreCache(convertOpts.IgnoreCache, finalStageName),
+		}
+		def, err = state.Marshal(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal definition")
+		}
+	} else {
+		convertOpts.SourceMap = NewSourceMap(generated)
+		state, image, sbomTargets, err := dockerfile2llb.Dockerfile2LLB(ctx, []byte(generated), convertOpts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to compile to LLB state")
+		}
+		result.ImageConfig, err = json.Marshal(image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal image config")
+		}
+		result.SBOMTargets = sbomTargets
+		def, err = state.Marshal(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal definition")
+		}
+		NameSteps(def, generated, target, platform)
 	}
 
 	res, err := c.Solve(ctx, client.SolveRequest{
 		Definition:   def.ToPB(),
 		CacheImports: cacheImports,
+		Evaluate:     shell != nil,
 	})
 
 	if err != nil {
+		if shell != nil {
+			err = shell.open(ctx, c, err)
+		}
 		return nil, errors.Wrap(err, "failed to solve")
 	}
 
@@ -240,11 +542,6 @@ func buildImage(ctx context.Context, c client.Client, dockerfile string, convert
 		return nil, err
 	}
 
-	result.BuildInfo, err = json.Marshal(bi)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal build info")
-	}
-
 	// Add platform-specific export info for the result that can later be used
 	// in multi-platform results
 	result.ExportPlatform = exptypes.Platform{
@@ -260,11 +557,13 @@ func buildImage(ctx context.Context, c client.Client, dockerfile string, convert
 	return &result, nil
 }
 
-// readMicrobConfig reads the pyproject.toml file from the local context and
-// returns a config.Config
-func readMicrobConfig(ctx context.Context, c client.Client, options *config.Options) (*config.Config, error) {
+// readMicrobConfig reads the pyproject.toml file from the local context, or
+// from the build context when it is a remote git repository, and
+// returns a config.Config along with the content of the file.
+// The content is returned when the configuration is invalid, so that it can be linted.
+func readMicrobConfig(ctx context.Context, c client.Client, buildContext *llb.State, options *config.Options) (*config.Config, []byte, error) {
 
-	name := "load definition"
+	name := "resolve config"
 	if options.Filename != defaultDockerfileName {
 		name += " from " + options.Filename
 	}
@@ -274,38 +573,141 @@ func readMicrobConfig(ctx context.Context, c client.Client, options *config.Opti
 		llb.IncludePatterns([]string{options.Filename}),
 		llb.SessionID(c.BuildOpts().SessionID),
 		llb.SharedKeyHint(defaultDockerfileName),
-		dockerfile2llb.WithInternalName(name),
+		withProgressName(name),
 	)
+	filename := options.Filename
+	if buildContext != nil {
+		// The definition of a remote context is located in the context directory
+		src = *buildContext
+		filename = path.Join(options.ContextDir, filename)
+	}
 
 	def, err := src.Marshal(context.TODO())
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to marshal local source")
+		return nil, nil, errors.Wrapf(err, "failed to marshal local source")
 	}
 
 	res, err := c.Solve(ctx, client.SolveRequest{
 		Definition: def.ToPB(),
 	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create solve request")
+		return nil, nil, errors.Wrapf(err, "failed to create solve request")
 	}
 
 	ref, err := res.SingleRef()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var pyprojectContent []byte
 	pyprojectContent, err = ref.ReadFile(ctx, client.ReadRequest{
-		Filename: options.Filename,
+		Filename: filename,
 	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read pyproject.toml")
+		return nil, nil, errors.Wrapf(err, "failed to read pyproject.toml")
 	}
 	cfg, err := config.NewConfigFromBytes(pyprojectContent, options)
 	if err != nil {
-		return nil, errors.Wrap(err, "error on getting parsing config")
+		return nil, pyprojectContent, errors.Wrap(err, "error on getting parsing config")
+	}
+	warnFindings(ctx, c, def, filename, pyprojectContent, cfg, options)
+	return cfg, pyprojectContent, nil
+}
+
+// parseNoCache parses the no-cache option into the names of the stages which
+// should not use build cache.
+// An empty value means all stages, which is represented by an empty non-nil slice.
+func parseNoCache(opts map[string]string) []string {
+	v, ok := opts[keyNoCache]
+	if !ok {
+		return nil
+	}
+	if v == "" {
+		return []string{}
+	}
+	return strings.Split(v, ",")
+}
+
+// parseNetMode parses the force-network-mode option
+func parseNetMode(v string) (pb.NetMode, error) {
+	switch v {
+	case "", "sandbox":
+		return llb.NetModeSandbox, nil
+	case "none":
+		return llb.NetModeNone, nil
+	case "host":
+		return llb.NetModeHost, nil
+	default:
+		return 0, errors.Errorf("invalid network mode %s", v)
+	}
+}
+
+// parseExtraHosts parses a comma-separated list of host=ip pairs
+func parseExtraHosts(v string) ([]llb.HostIP, error) {
+	if v == "" {
+		return nil, nil
+	}
+	fields, err := csv.NewReader(strings.NewReader(v)).Read()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []llb.HostIP
+	for _, field := range fields {
+		host, ip, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid key-value pair %s", field)
+		}
+		parsed := net.ParseIP(strings.ToLower(ip))
+		if parsed == nil {
+			return nil, errors.Errorf("failed to parse IP %s", ip)
+		}
+		hosts = append(hosts, llb.HostIP{Host: strings.ToLower(host), IP: parsed})
 	}
-	return cfg, nil
+	return hosts, nil
+}
+
+// parseShmSize parses the size of /dev/shm expressed in kilobytes
+func parseShmSize(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// parseUlimits parses a comma-separated list of ulimits.
+// Each ulimit is formatted as name=soft[:hard], for instance nofile=1024:2048.
+func parseUlimits(v string) ([]pb.Ulimit, error) {
+	if v == "" {
+		return nil, nil
+	}
+	fields, err := csv.NewReader(strings.NewReader(v)).Read()
+	if err != nil {
+		return nil, err
+	}
+	var ulimits []pb.Ulimit
+	for _, field := range fields {
+		name, limits, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid ulimit %s", field)
+		}
+		softLimit, hardLimit, hasHard := strings.Cut(limits, ":")
+		soft, err := strconv.ParseInt(softLimit, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid soft limit in ulimit %s", field)
+		}
+		hard := soft
+		if hasHard {
+			hard, err = strconv.ParseInt(hardLimit, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid hard limit in ulimit %s", field)
+			}
+		}
+		if soft > hard {
+			return nil, errors.Errorf("soft limit %d is greater than hard limit %d in ulimit %s", soft, hard, field)
+		}
+		ulimits = append(ulimits, pb.Ulimit{Name: name, Soft: soft, Hard: hard})
+	}
+	return ulimits, nil
 }
 
 // parsePlatforms parses a comma-separated list of platforms into a slice of
@@ -329,8 +731,53 @@ func readFileFromLocal(ctx context.Context, c client.Client, localCtx string, fi
 		llb.SessionID(c.BuildOpts().SessionID),
 		llb.FollowPaths([]string{filepath}),
 		llb.SharedKeyHint(filepath),
+		withProgressName("read "+filepath),
 	)
+	return readFileFromState(ctx, c, st, filepath, required)
+}
+
+// readFileFromContext reads a file from the build context, which is the
+// local context unless a remote build context is given
+func readFileFromContext(ctx context.Context, c client.Client, buildContext *llb.State, filepath string, required bool) ([]byte, error) {
+	if buildContext != nil {
+		return readFileFromState(ctx, c, *buildContext, filepath, required)
+	}
+	return readFileFromLocal(ctx, c, localNameContext, filepath, required)
+}
 
+// pathExistsInContext checks whether a file or directory exists in the build context
+func pathExistsInContext(ctx context.Context, c client.Client, buildContext *llb.State, filepath string) bool {
+	st := llb.Local(localNameContext,
+		llb.SessionID(c.BuildOpts().SessionID),
+		llb.FollowPaths([]string{filepath}),
+		llb.SharedKeyHint(filepath),
+		withProgressName("check "+filepath),
+	)
+	if buildContext != nil {
+		st = *buildContext
+	}
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return false
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: def.ToPB(),
+	})
+	if err != nil {
+		return false
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return false
+	}
+	_, err = ref.StatFile(ctx, client.StatRequest{
+		Path: filepath,
+	})
+	return err == nil
+}
+
+// readFileFromState reads a file from an LLB state
+func readFileFromState(ctx context.Context, c client.Client, st llb.State, filepath string, required bool) ([]byte, error) {
 	def, err := st.Marshal(ctx)
 	if err != nil {
 		return nil, err
@@ -372,41 +819,79 @@ func readFileFromLocal(ctx context.Context, c client.Client, localCtx string, fi
 	return fileBytes, nil
 }
 
-// readDockerIgnoreFile reads the .dockerignore file from the local context
-func readDockerIgnoreFile(ctx context.Context, c client.Client) ([]string, error) {
-	dockerignoreBytes, err := readFileFromLocal(ctx, c, localNameContext, dockerignoreFilename, false)
-	if err != nil {
-		return nil, err
+// sourceExcludes returns the exclude patterns of the project sources relative to the build context
+func sourceExcludes(c *config.Config) []string {
+	var excludes []string
+	for _, pattern := range c.SrcExclude {
+		// Patterns are relative to the context directory, even with a leading slash
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			excludes = append(excludes, "!"+strings.TrimPrefix(path.Join(c.ContextDir, negated), "/"))
+		} else {
+			excludes = append(excludes, strings.TrimPrefix(path.Join(c.ContextDir, pattern), "/"))
+		}
 	}
+	return excludes
+}
 
-	// Split []byte slice by new line
-	strSlice := bytes.Split(dockerignoreBytes, []byte("\n"))
+// dockerIgnoreFilename returns the path of the ignore file used for the target and whether
+// the file is required. The ignore_file option of the target is used when set, otherwise
+// a .dockerignore.<target> file is used if it exists, and defaults to the .dockerignore file.
+func dockerIgnoreFilename(ctx context.Context, c client.Client, buildContext *llb.State, cfg *config.Config) (string, bool) {
+	if cfg.IgnoreFile != "" {
+		return cfg.IgnoreFile, true
+	}
+	if cfg.Target != "" {
+		targetFilename := dockerignoreFilename + "." + cfg.Target
+		if pathExistsInContext(ctx, c, buildContext, targetFilename) {
+			return targetFilename, true
+		}
+	}
+	return dockerignoreFilename, false
+}
 
-	// Convert []byte slice to []string slice
-	var excludes []string
-	for _, b := range strSlice {
-		excludes = append(excludes, string(b))
+// readDockerIgnoreFile reads an ignore file from the build context
+func readDockerIgnoreFile(ctx context.Context, c client.Client, buildContext *llb.State, filename string, required bool) ([]string, error) {
+	dockerignoreBytes, err := readFileFromContext(ctx, c, buildContext, filename, required)
+	if err != nil {
+		return nil, err
 	}
 
-	return excludes, nil
+	// Parse the patterns the same way docker build does, so that comments,
+	// blank lines, negations and leading slashes are handled correctly
+	return dockerignore.ReadAll(bytes.NewReader(dockerignoreBytes))
 }
 
-// readPythonVersion reads the .python-version file from the local context
-func readPythonVersion(ctx context.Context, c client.Client) string {
-	content, err := readFileFromLocal(ctx, c, localNameContext, ".python-version", false)
-	if err != nil {
-		return ""
+// readTemplates reads the templates overriding the default stage templates from a
+// directory of the build context. Templates which are not found are not overridden.
+func readTemplates(ctx context.Context, c client.Client, buildContext *llb.State, dir string) (map[string]string, error) {
+	if dir == "" {
+		return nil, nil
 	}
-	if len(content) == 0 {
-		return ""
+	templates := map[string]string{}
+	for _, name := range dockerfile.TemplateNames {
+		content, err := readFileFromContext(ctx, c, buildContext, path.Join(dir, name), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > 0 {
+			templates[name] = string(content)
+		}
 	}
-	return string(content)
+	return templates, nil
+}
+
+// readPythonVersion reads the python version from the version files found in a directory of the
+// build context, see config.PythonVersionFiles
+func readPythonVersion(ctx context.Context, c client.Client, buildContext *llb.State, dir string) string {
+	return config.ReadPythonVersion(func(name string) ([]byte, error) {
+		return readFileFromContext(ctx, c, buildContext, path.Join(dir, name), false)
+	})
 }
 
-// readRequirementsTxt reads the requirements.txt file from the local context
+// readRequirementsTxt reads the requirements.txt file from the build context
 // and returns a slice of strings (each line in the file is a string in the slice)
-func readRequirementsTxt(ctx context.Context, c client.Client, filename string) ([]string, error) {
-	content, err := readFileFromLocal(ctx, c, localNameContext, filename, true)
+func readRequirementsTxt(ctx context.Context, c client.Client, buildContext *llb.State, filename string) ([]string, error) {
+	content, err := readFileFromContext(ctx, c, buildContext, filename, true)
 	if err != nil {
 		return nil, err
 	}
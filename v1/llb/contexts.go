@@ -0,0 +1,224 @@
+package llb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/util/gitutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Support named contexts provided using `docker buildx build --build-context name=value`
+	// or `buildctl build --opt context:name=value`.
+	// See https://docs.docker.com/reference/cli/docker/buildx/build/#build-context
+	contextPrefix       = "context:"
+	inputMetadataPrefix = "input-metadata:"
+)
+
+// contextByNameFunc returns a function used by dockerfile2llb to resolve the
+// named contexts referenced in the Dockerfile, either as base image or as
+// source of a COPY instruction.
+// This function is adapted from the dockerfile frontend.
+func contextByNameFunc(c client.Client) func(context.Context, string, string, *ocispecs.Platform) (*llb.State, *dockerfile2llb.Image, error) {
+	return func(ctx context.Context, name, resolveMode string, p *ocispecs.Platform) (*llb.State, *dockerfile2llb.Image, error) {
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid context name %s", name)
+		}
+		name = strings.TrimSuffix(reference.FamiliarString(named), ":latest")
+
+		if p == nil {
+			pp := platforms.Normalize(platforms.DefaultSpec())
+			p = &pp
+		}
+		// Contexts can be provided for a specific platform
+		pname := name + "::" + platforms.Format(platforms.Normalize(*p))
+		st, img, err := contextByName(ctx, c, name, pname, p, resolveMode)
+		if err != nil {
+			return nil, nil, err
+		}
+		if st != nil {
+			return st, img, nil
+		}
+		return contextByName(ctx, c, name, name, p, resolveMode)
+	}
+}
+
+// contextByName returns the state of the named context, or a nil state when
+// no context was provided with this name
+func contextByName(ctx context.Context, c client.Client, name string, pname string, platform *ocispecs.Platform, resolveMode string) (*llb.State, *dockerfile2llb.Image, error) {
+	opts := c.BuildOpts().Opts
+	v, ok := opts[contextPrefix+pname]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	kind, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return nil, nil, errors.Errorf("invalid context specifier %s for %s", v, pname)
+	}
+	// Allow git@ without protocol for SSH URLs
+	if strings.HasPrefix(kind, "git@") {
+		kind = "git"
+	}
+	switch kind {
+	case "docker-image":
+		ref := strings.TrimPrefix(value, "//")
+		if ref == "scratch" {
+			st := llb.Scratch()
+			return &st, nil, nil
+		}
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		named = reference.TagNameOnly(named)
+
+		_, data, err := c.ResolveImageConfig(ctx, named.String(), llb.ResolveImageConfigOpt{
+			Platform:     platform,
+			ResolveMode:  resolveMode,
+			LogName:      fmt.Sprintf("[context %s] load metadata for %s", pname, ref),
+			ResolverType: llb.ResolverTypeRegistry,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		var img dockerfile2llb.Image
+		if err := json.Unmarshal(data, &img); err != nil {
+			return nil, nil, err
+		}
+		img.Created = nil
+
+		imgOpt := []llb.ImageOption{
+			llb.WithCustomName("[context " + pname + "] " + ref),
+		}
+		if platform != nil {
+			imgOpt = append(imgOpt, llb.Platform(*platform))
+		}
+		st, err := llb.Image(ref, imgOpt...).WithImageConfig(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &st, &img, nil
+	case "git":
+		st, ok := gitContext(v, true)
+		if !ok {
+			return nil, nil, errors.Errorf("invalid git context %s", v)
+		}
+		return st, nil, nil
+	case "http", "https":
+		st, ok := gitContext(v, true)
+		if !ok {
+			httpst := llb.HTTP(v, llb.WithCustomName("[context "+pname+"] "+v))
+			st = &httpst
+		}
+		return st, nil, nil
+	case "local":
+		excludes, err := readNamedContextDockerIgnore(ctx, c, pname, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		st := llb.Local(value,
+			llb.WithCustomName("[context "+pname+"] load from client"),
+			llb.SessionID(c.BuildOpts().SessionID),
+			llb.SharedKeyHint("context:"+pname),
+			llb.ExcludePatterns(excludes),
+		)
+		return &st, nil, nil
+	case "input":
+		inputs, err := c.Inputs(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		st, ok := inputs[value]
+		if !ok {
+			return nil, nil, errors.Errorf("invalid input %s for %s", value, pname)
+		}
+		md, ok := opts[inputMetadataPrefix+value]
+		if !ok {
+			return &st, nil, nil
+		}
+		m := make(map[string][]byte)
+		if err := json.Unmarshal([]byte(md), &m); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse input metadata %s", md)
+		}
+		var img *dockerfile2llb.Image
+		if dtic, ok := m[exptypes.ExporterImageConfigKey]; ok {
+			st, err = st.WithImageConfig(dtic)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := json.Unmarshal(dtic, &img); err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to parse image config for %s", pname)
+			}
+		}
+		return &st, img, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported context source %s for %s", kind, pname)
+	}
+}
+
+// gitContext returns the state of a git repository when ref is a valid git reference.
+// The .git directory is only kept in the state when keepGit is true.
+func gitContext(ref string, keepGit bool) (*llb.State, bool) {
+	g, err := gitutil.ParseGitRef(ref)
+	if err != nil {
+		return nil, false
+	}
+	commit := g.Commit
+	if g.SubDir != "" {
+		commit += ":" + g.SubDir
+	}
+	gitOpts := []llb.GitOption{dockerfile2llb.WithInternalName("load git source " + ref)}
+	if keepGit {
+		gitOpts = append(gitOpts, llb.KeepGitDir())
+	}
+	st := llb.Git(g.Remote, commit, gitOpts...)
+	return &st, true
+}
+
+// readNamedContextDockerIgnore reads the .dockerignore file of a local named context
+func readNamedContextDockerIgnore(ctx context.Context, c client.Client, pname string, localName string) ([]string, error) {
+	st := llb.Local(localName,
+		llb.SessionID(c.BuildOpts().SessionID),
+		llb.FollowPaths([]string{dockerignoreFilename}),
+		llb.SharedKeyHint("context:"+pname+"-"+dockerignoreFilename),
+		llb.WithCustomName("[context "+pname+"] load "+dockerignoreFilename),
+		llb.Differ(llb.DiffNone, false),
+	)
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Evaluate:   true,
+		Definition: def.ToPB(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	// The .dockerignore file is optional
+	dt, _ := ref.ReadFile(ctx, client.ReadRequest{
+		Filename: dockerignoreFilename,
+	})
+	if len(dt) == 0 {
+		return nil, nil
+	}
+	return dockerignore.ReadAll(bytes.NewBuffer(dt))
+}
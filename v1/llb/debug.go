@@ -0,0 +1,104 @@
+package llb
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/pkg/errors"
+)
+
+// DebugShell is an interactive shell opened in the state of a failed RUN instruction.
+// It requires the frontend to run in the process of the cli, which provides the terminal.
+type DebugShell struct {
+	// Command run in the failed step, /bin/sh by default
+	Args   []string
+	Stdin  io.ReadCloser
+	Stdout io.WriteCloser
+	Stderr io.WriteCloser
+	// Terminal set to raw mode while the shell runs, if any
+	Console console.Console
+
+	// Steps of different platforms can fail at the same time
+	mu sync.Mutex
+}
+
+// BuildWithDebugShell returns a build function which opens the shell in the failing step
+// when the debug-on-failure option is set
+func BuildWithDebugShell(shell *DebugShell) client.BuildFunc {
+	return func(ctx context.Context, c client.Client) (*client.Result, error) {
+		return build(ctx, c, shell)
+	}
+}
+
+// open opens the shell in the state of the step which failed with the given error.
+// The error is returned once the shell exits, or wrapped when the shell can not be opened.
+// Errors which are not caused by a RUN instruction are returned as is.
+func (s *DebugShell) open(ctx context.Context, c client.Client, err error) error {
+	var solveErr *errdefs.SolveError
+	if !errors.As(err, &solveErr) {
+		return err
+	}
+	exec := solveErr.Op.GetExec()
+	if exec == nil || len(solveErr.MountIDs) < len(exec.Mounts) {
+		return err
+	}
+	// Mounts are opened in their state at the time of the failure
+	mounts := make([]client.Mount, 0, len(exec.Mounts))
+	for i, mount := range exec.Mounts {
+		mounts = append(mounts, client.Mount{
+			Selector:  mount.Selector,
+			Dest:      mount.Dest,
+			ResultID:  solveErr.MountIDs[i],
+			Readonly:  mount.Readonly,
+			MountType: mount.MountType,
+			CacheOpt:  mount.CacheOpt,
+			SecretOpt: mount.SecretOpt,
+			SSHOpt:    mount.SSHOpt,
+		})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctr, cerr := c.NewContainer(ctx, client.NewContainerRequest{
+		Mounts:      mounts,
+		NetMode:     exec.Network,
+		Platform:    solveErr.Op.Platform,
+		Constraints: solveErr.Op.Constraints,
+	})
+	if cerr != nil {
+		return errors.Wrapf(err, "failed to open debug shell: %v", cerr)
+	}
+	defer ctr.Release(ctx)
+	args := s.Args
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+	if s.Console != nil {
+		if cerr := s.Console.SetRaw(); cerr == nil {
+			defer s.Console.Reset()
+		}
+	}
+	proc, cerr := ctr.Start(ctx, client.StartRequest{
+		Args:   args,
+		Env:    exec.Meta.Env,
+		User:   exec.Meta.User,
+		Cwd:    exec.Meta.Cwd,
+		Tty:    s.Console != nil,
+		Stdin:  s.Stdin,
+		Stdout: s.Stdout,
+		Stderr: s.Stderr,
+	})
+	if cerr != nil {
+		return errors.Wrapf(err, "failed to start debug shell: %v", cerr)
+	}
+	if s.Console != nil {
+		if size, cerr := s.Console.Size(); cerr == nil {
+			proc.Resize(ctx, client.WinSize{Rows: uint32(size.Height), Cols: uint32(size.Width)})
+		}
+	}
+	proc.Wait()
+	return err
+}
@@ -0,0 +1,64 @@
+package llb
+
+import (
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/utils"
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+)
+
+// ClientExportsKey is the frontend option set by clients which apply the exporter attributes and
+// the cache exports of the config themselves, such as the compression of the layers
+const ClientExportsKey = "client-exports"
+
+const (
+	keyCompression      = "compression"
+	keyForceCompression = "force-compression"
+	keyOCIMediatypes    = "oci-mediatypes"
+	keyInlineCacheArg   = "buildkit_inline_cache"
+)
+
+// ExporterAttrs returns the image exporter attributes requested by a config.
+// Exporter attributes are chosen by the buildkit client, not by the frontend,
+// so they must be provided when creating the solve request.
+func ExporterAttrs(c *config.Config) map[string]string {
+	attrs := map[string]string{}
+	if c.Compression != "" {
+		attrs[keyCompression] = c.Compression
+		attrs[keyForceCompression] = "true"
+	}
+	// zstd and estargz compressions require OCI media types
+	if c.OciMediatypes || c.Compression == "zstd" || c.Compression == "estargz" {
+		attrs[keyOCIMediatypes] = "true"
+	}
+	return attrs
+}
+
+// checkClientExports returns an error when a config requests exporter attributes or cache exports,
+// which can not be applied by the frontend, unless the client declares that it applies them
+func checkClientExports(c *config.Config, opts map[string]string) error {
+	if opts[ClientExportsKey] == "true" {
+		return nil
+	}
+	if len(ExporterAttrs(c)) > 0 {
+		return errors.Errorf("compression and oci_mediatypes are applied by the client, set them in the output of the build and set the %s frontend option", ClientExportsKey)
+	}
+	if c.InlineCache {
+		return errors.Errorf("inline_cache is applied by the client, export an inline cache or set the BUILDKIT_INLINE_CACHE build argument and set the %s frontend option", ClientExportsKey)
+	}
+	return nil
+}
+
+// CacheExports returns the cache exports requested by a config or by the
+// BUILDKIT_INLINE_CACHE build argument.
+// Like exporter attributes, cache exports are chosen by the buildkit client.
+func CacheExports(c *config.Config, buildargs map[string]string) []client.CacheOptionsEntry {
+	inline := c.InlineCache
+	if v := lookupBuildArg(buildargs, keyInlineCacheArg); v != "" {
+		inline = utils.IsTruthy(v)
+	}
+	if !inline {
+		return nil
+	}
+	return []client.CacheOptionsEntry{{Type: "inline"}}
+}
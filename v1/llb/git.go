@@ -0,0 +1,161 @@
+package llb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	labelRevision = "org.opencontainers.image.revision"
+	labelRefName  = "org.opencontainers.image.ref.name"
+	labelCreated  = "org.opencontainers.image.created"
+)
+
+// Build arguments commonly provided by CI systems which can be used instead of
+// reading the .git directory from the build context
+var (
+	revisionBuildArgs = []string{"git_commit", "github_sha", "ci_commit_sha"}
+	refNameBuildArgs  = []string{"git_branch", "github_ref_name", "ci_commit_ref_name"}
+)
+
+// gitLabels returns the labels describing the git revision the image is built from.
+// Labels already present in the given labels are never overwritten.
+func gitLabels(ctx context.Context, c client.Client, buildContext *llb.State, buildargs map[string]string, labels map[string]string) map[string]string {
+	revision := lookupBuildArg(buildargs, revisionBuildArgs...)
+	refName := lookupBuildArg(buildargs, refNameBuildArgs...)
+	if revision == "" {
+		revision, refName = readGitHead(ctx, c, buildContext)
+	}
+	gitLabels := map[string]string{}
+	if revision == "" {
+		return gitLabels
+	}
+	candidates := map[string]string{
+		labelRevision: revision,
+		labelRefName:  refName,
+		labelCreated:  createdAt(ctx, c, buildargs, revision),
+	}
+	for k, v := range candidates {
+		if _, ok := labels[k]; ok || v == "" {
+			continue
+		}
+		gitLabels[k] = v
+	}
+	return gitLabels
+}
+
+// lookupBuildArg returns the value of the first build argument found among names.
+// Build arguments names are compared case insensitively.
+func lookupBuildArg(buildargs map[string]string, names ...string) string {
+	for _, name := range names {
+		for k, v := range buildargs {
+			if strings.ToLower(k) == name && v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// createdAt returns the creation date of the image formatted according to RFC 3339.
+// SOURCE_DATE_EPOCH build argument is used when provided, otherwise the commit date of the revision,
+// so that the label does not change the image config of every build. An empty string is returned
+// when the commit date is unknown.
+func createdAt(ctx context.Context, c client.Client, buildargs map[string]string, revision string) string {
+	if epoch := lookupBuildArg(buildargs, "source_date_epoch"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	committed, ok := readCommitTime(ctx, c, revision)
+	if !ok {
+		return ""
+	}
+	return committed.UTC().Format(time.RFC3339)
+}
+
+// readCommitTime reads the committer date of a revision from the loose objects of the .git directory
+// found in the local context. Commits stored in pack files are not read.
+func readCommitTime(ctx context.Context, c client.Client, revision string) (time.Time, bool) {
+	if len(revision) != 40 || strings.Trim(revision, "0123456789abcdef") != "" {
+		return time.Time{}, false
+	}
+	compressed, err := readFileFromLocal(ctx, c, localNameContext, ".git/objects/"+revision[:2]+"/"+revision[2:], false)
+	if err != nil || len(compressed) == 0 {
+		return time.Time{}, false
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer r.Close()
+	object, err := io.ReadAll(r)
+	if err != nil {
+		return time.Time{}, false
+	}
+	header, commit, ok := bytes.Cut(object, []byte{0})
+	if !ok || !bytes.HasPrefix(header, []byte("commit ")) {
+		return time.Time{}, false
+	}
+	// The committer line ends with the timestamp and the timezone of the commit
+	for _, line := range strings.Split(string(commit), "\n") {
+		if line == "" {
+			// The headers of the commit end with an empty line
+			break
+		}
+		committer, ok := strings.CutPrefix(line, "committer ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(committer)
+		if len(fields) < 2 {
+			break
+		}
+		seconds, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			break
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// readGitHead reads the current revision and ref name from the .git directory found in the build context.
+// Empty strings are returned when the build context is not a git repository.
+func readGitHead(ctx context.Context, c client.Client, buildContext *llb.State) (string, string) {
+	head, err := readFileFromContext(ctx, c, buildContext, ".git/HEAD", false)
+	if err != nil || len(head) == 0 {
+		return "", ""
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	// HEAD is detached and contains the revision directly
+	if !ok {
+		return ref, ""
+	}
+	refName := strings.TrimPrefix(ref, "refs/heads/")
+	revision, err := readFileFromContext(ctx, c, buildContext, ".git/"+ref, false)
+	if err == nil && len(revision) > 0 {
+		return strings.TrimSpace(string(revision)), refName
+	}
+	// The ref may have been packed by git
+	packedRefs, err := readFileFromContext(ctx, c, buildContext, ".git/packed-refs", false)
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range strings.Split(string(packedRefs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], refName
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,116 @@
+package llb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/frontend/subrequests"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// The lint subrequest is not available in buildkit v0.11, its definition and results
+// mirror the ones of the lint subrequest of later versions so that `docker buildx build --call=lint`
+// can display them.
+const requestSubrequestsLint = "frontend.lint"
+
+var subrequestsLintDefinition = subrequests.Request{
+	Name:        requestSubrequestsLint,
+	Version:     "1.0.0",
+	Type:        subrequests.TypeRPC,
+	Description: "Lint the microb configuration of pyproject.toml",
+	Opts:        []subrequests.Named{},
+	Metadata: []subrequests.Named{
+		{Name: "result.json"},
+		{Name: "result.txt"},
+		{Name: "result.statuscode"},
+	},
+}
+
+// lintWarning is a finding of the config linter
+type lintWarning struct {
+	RuleName    string      `json:"ruleName"`
+	Description string      `json:"description,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Detail      string      `json:"detail,omitempty"`
+	Location    pb.Location `json:"location,omitempty"`
+}
+
+// lintError is an error which prevents a target from being linted
+type lintError struct {
+	Message  string      `json:"message"`
+	Location pb.Location `json:"location"`
+}
+
+// lintResults are the results of the lint subrequest
+type lintResults struct {
+	Warnings []lintWarning    `json:"warnings"`
+	Sources  []*pb.SourceInfo `json:"sources"`
+	Error    *lintError       `json:"buildError,omitempty"`
+}
+
+// lintSubrequest lints the targets of pyproject.toml, or the selected target only.
+// Invalid configurations are reported as the error of the results instead of failing the request.
+func lintSubrequest(pyproject []byte, filename string, options *config.Options) (*client.Result, error) {
+	results := lintResults{
+		Warnings: []lintWarning{},
+		Sources:  []*pb.SourceInfo{{Filename: filename, Data: pyproject}},
+	}
+	var text bytes.Buffer
+	targets := []string{options.Target}
+	if options.Target == "" {
+		names, err := config.Targets(pyproject)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			targets = names
+		}
+	}
+	for _, target := range targets {
+		targetOptions := *options
+		targetOptions.Target = target
+		findings, err := config.Lint(pyproject, &targetOptions)
+		if err != nil {
+			results.Error = &lintError{Message: err.Error()}
+			location := filename
+			if position, ok := config.ErrorPosition(pyproject, err); ok {
+				results.Error.Location = lineLocation(position.Line)
+				location = fmt.Sprintf("%s:%d:%d", filename, position.Line, position.Column)
+			}
+			fmt.Fprintf(&text, "%s: %v\n", location, err)
+			break
+		}
+		for _, finding := range findings {
+			warning := lintWarning{RuleName: finding.Rule, Description: finding.Message, Detail: "target " + finding.Target}
+			location := filename
+			if finding.Line > 0 {
+				warning.Location = lineLocation(finding.Line)
+				location = fmt.Sprintf("%s:%d:%d", filename, finding.Line, finding.Column)
+			}
+			results.Warnings = append(results.Warnings, warning)
+			fmt.Fprintf(&text, "%s: %s: %s\n", location, finding.Rule, finding.Message)
+		}
+	}
+	dt, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	status := 0
+	if len(results.Warnings) > 0 || results.Error != nil {
+		status = 1
+	}
+	res := client.NewResult()
+	res.AddMeta("result.json", dt)
+	res.AddMeta("result.txt", text.Bytes())
+	res.AddMeta("result.statuscode", []byte(fmt.Sprintf("%d", status)))
+	res.AddMeta("version", []byte(subrequestsLintDefinition.Version))
+	return res, nil
+}
+
+// lineLocation returns the location of a line of pyproject.toml, which is the first source
+func lineLocation(line int) pb.Location {
+	return pb.Location{Ranges: []*pb.Range{{Start: pb.Position{Line: int32(line)}, End: pb.Position{Line: int32(line)}}}}
+}
@@ -0,0 +1,782 @@
+package llb
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/charbonats/microbuild/v1/utils"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/client/llb/imagemetaresolver"
+	"github.com/moby/buildkit/exporter/containerimage/image"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/apicaps"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Stages are named like the stages of the generated Dockerfile, so that
+	// steps have the same progress names whatever the builder
+	builderStageName = "builder"
+	finalStageName   = "stage-1"
+	// Comment of the history entries of the layers built natively
+	historyComment = "microb"
+)
+
+// NativeSupported returns whether the image of a config can be built natively.
+// Templates and extra instructions are made of Dockerfile instructions, so the
+// configs using them are built from the generated Dockerfile.
+func NativeSupported(c *config.Config, templates map[string]string) bool {
+	return len(templates) == 0 &&
+		strings.TrimSpace(c.ExtraBuildInstructions) == "" &&
+		strings.TrimSpace(c.ExtraRuntimeInstructions) == ""
+}
+
+// Microb2LLB builds the LLB state of the image of a config, and its image config, without
+// generating a Dockerfile. The options are the ones given to dockerfile2llb, the build
+// arguments being the placeholders of the config. Options which only apply to Dockerfiles,
+// such as the source map, are ignored.
+// Vertices are named after the steps of the generated Dockerfile, e.g. [builder target=api] install dependencies,
+// the target being omitted when empty, see NameSteps.
+func Microb2LLB(ctx context.Context, c *config.Config, target string, opt dockerfile2llb.ConvertOpt) (*llb.State, *dockerfile2llb.Image, error) {
+	b := newNativeBuilder(c, target, opt)
+	builder, err := b.buildStage(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to build the build stage")
+	}
+	final, err := b.finalStage(ctx, builder)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to build the final stage")
+	}
+	return &final.state, &final.image, nil
+}
+
+// nativeBuilder builds the stages of a config
+type nativeBuilder struct {
+	config        *config.Config
+	target        string
+	opt           dockerfile2llb.ConvertOpt
+	platform      ocispecs.Platform
+	buildPlatform ocispecs.Platform
+	buildContext  llb.State
+	metaResolver  llb.ImageMetaResolver
+}
+
+// nativeStage is a stage being built for a platform, along with the config of its image
+type nativeStage struct {
+	name        string
+	platform    ocispecs.Platform
+	state       llb.State
+	image       dockerfile2llb.Image
+	ignoreCache bool
+}
+
+func newNativeBuilder(c *config.Config, target string, opt dockerfile2llb.ConvertOpt) *nativeBuilder {
+	b := &nativeBuilder{
+		config:       c,
+		target:       target,
+		opt:          opt,
+		platform:     platforms.DefaultSpec(),
+		metaResolver: opt.MetaResolver,
+	}
+	// Both stages are built for the target platform, which defaults to the build platform,
+	// unless the build stage is cross compiled
+	if len(opt.BuildPlatforms) > 0 {
+		b.platform = opt.BuildPlatforms[0]
+	}
+	b.buildPlatform = b.platform
+	if opt.TargetPlatform != nil {
+		b.platform = *opt.TargetPlatform
+	}
+	if b.metaResolver == nil {
+		b.metaResolver = imagemetaresolver.Default()
+	}
+	if opt.BuildContext != nil {
+		b.buildContext = *opt.BuildContext
+	} else {
+		b.buildContext = llb.Local(localNameContext,
+			llb.SessionID(opt.SessionID),
+			llb.ExcludePatterns(opt.Excludes),
+			llb.SharedKeyHint(localNameContext),
+			llb.WithCustomName("[internal] load build context"),
+		)
+	}
+	return b
+}
+
+// buildStage builds the stage where the python dependencies and the project are installed,
+// in /root/.local and /root/.app respectively
+func (b *nativeBuilder) buildStage(ctx context.Context) (*nativeStage, error) {
+	c := b.config
+	platform := b.platform
+	if c.CrossCompile {
+		platform = b.buildPlatform
+	}
+	s, err := b.from(ctx, builderStageName, dockerfile.BuilderImage(c), platform)
+	if err != nil {
+		return nil, err
+	}
+	if commands := dockerfile.BuildDepsCommands(c); len(commands) > 0 {
+		step := "install build dependencies"
+		var opts []llb.RunOption
+		if c.Flavor == "alpine" {
+			opts = append(opts, b.cacheMount("apk", "/var/cache/apk", packageCacheSharing(c)))
+		} else {
+			if err := b.addAptRepositoryKeys(ctx, s, step); err != nil {
+				return nil, err
+			}
+			// Apt needs exclusive access to its data unless configured otherwise, see the cache mounts
+			// of the generated Dockerfile
+			opts = append(opts,
+				b.cacheMount("apt-cache", "/var/cache/apt", packageCacheSharing(c)),
+				b.cacheMount("apt-lib", "/var/lib/apt", packageCacheSharing(c)),
+			)
+			opts = append(opts, secretMounts(dockerfile.AptRepositorySecrets(c))...)
+		}
+		b.run(s, step, commands, opts...)
+	}
+	envs := dockerfile.BuilderEnvs(c, b.opt.BuildArgs)
+	for _, k := range utils.SortedKeys(envs) {
+		s.addEnv(k, dockerfile.ExpandPlaceholders(envs[k], b.opt.BuildArgs))
+	}
+	if commands := dockerfile.InstallRustToolchainCommands(c); len(commands) > 0 {
+		envPath, _, err := s.state.GetEnv(ctx, "PATH")
+		if err != nil {
+			return nil, err
+		}
+		s.addEnv("PATH", dockerfile.RustPath+":"+envPath)
+		b.run(s, "install rust toolchain", commands)
+	}
+	for _, f := range c.CopyFilesBeforeBuild {
+		if err := b.copyFile(ctx, s, "copy files", f, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range c.AddFilesBeforeBuild {
+		if err := b.addFile(ctx, s, "add files", f); err != nil {
+			return nil, err
+		}
+	}
+	b.runCommands(s, c.PreInstall)
+	if err := b.installDependencies(ctx, s); err != nil {
+		return nil, err
+	}
+	if err := b.installLocalDependencies(ctx, s); err != nil {
+		return nil, err
+	}
+	if err := b.installProject(ctx, s); err != nil {
+		return nil, err
+	}
+	b.runCommands(s, c.PostInstall)
+	if commands := dockerfile.ClearInstalledPythonLibsCommands(c); len(commands) > 0 {
+		b.run(s, "clean up installed packages", commands)
+	}
+	if commands := dockerfile.CompileBytecodeCommands(c); len(commands) > 0 {
+		b.run(s, "compile bytecode", commands)
+	}
+	return s, nil
+}
+
+// installDependencies installs the python dependencies either from the requirements file or from pyproject.toml
+func (b *nativeBuilder) installDependencies(ctx context.Context, s *nativeStage) error {
+	c := b.config
+	step := "install dependencies"
+	if c.Requirements == "" && len(c.Dependencies) == 0 {
+		return nil
+	}
+	if c.Requirements != "" {
+		for _, f := range dockerfile.RequirementsFiles(c) {
+			if err := b.copy(ctx, s, step, b.buildContext, contextSource(c, f), dockerfile.RequirementsPath(f), localCopyInfo(nil), "", false); err != nil {
+				return err
+			}
+		}
+		b.run(s, step, []string{dockerfile.RemoveEditableRequirementsCommand(c)})
+	}
+	opts, err := b.dependenciesRunOptions(ctx, s)
+	if err != nil {
+		return err
+	}
+	b.run(s, step, dockerfile.InstallDependenciesCommands(c), opts...)
+	return nil
+}
+
+// installLocalDependencies copies the local dependencies from the build context and installs them
+func (b *nativeBuilder) installLocalDependencies(ctx context.Context, s *nativeStage) error {
+	c := b.config
+	step := "install local dependencies"
+	if len(c.LocalDependencies) == 0 {
+		return nil
+	}
+	for _, d := range c.LocalDependencies {
+		if err := b.copy(ctx, s, step, b.buildContext, path.Join("/", d.Path), dockerfile.LocalDependencyPath(d.Path), localCopyInfo(nil), "", false); err != nil {
+			return err
+		}
+	}
+	opts := b.pipRunOptions(true, false)
+	wheelhouse, err := b.wheelhouseMount(ctx, s)
+	if err != nil {
+		return err
+	}
+	b.run(s, step, dockerfile.InstallLocalDependenciesCommands(c), append(opts, wheelhouse...)...)
+	return nil
+}
+
+// dependenciesRunOptions returns the options of the pip commands fetching the python dependencies
+func (b *nativeBuilder) dependenciesRunOptions(ctx context.Context, s *nativeStage) ([]llb.RunOption, error) {
+	c := b.config
+	opts := b.pipRunOptions(true, dockerfile.DependenciesUseSsh(c))
+	wheelhouse, err := b.wheelhouseMount(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, wheelhouse...)
+	if c.CrossCompile {
+		// Same as the platform build arguments declared in the build stage of the generated Dockerfile
+		opts = append(opts, llb.AddEnv("TARGETARCH", b.platform.Architecture), llb.AddEnv("TARGETVARIANT", b.platform.Variant))
+	}
+	return opts, nil
+}
+
+// installProject installs the project from its sources, which are either copied or bind mounted.
+// Bind mounts are writable so that build artifacts can be written into the project directory,
+// but changes are discarded once the project is installed.
+func (b *nativeBuilder) installProject(ctx context.Context, s *nativeStage) error {
+	c := b.config
+	step := "install project"
+	opts := b.pipRunOptions(false, false)
+	wheelhouse, err := b.wheelhouseMount(ctx, s)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, wheelhouse...)
+	for _, src := range dockerfile.ProjectSources(c) {
+		if c.ProjectBindMount {
+			opts = append(opts, llb.AddMount(dockerfile.ProjectPath(src), b.buildContext, llb.SourcePath(contextSource(c, src)), llb.ForceNoOutput))
+			continue
+		}
+		if err := b.copy(ctx, s, step, b.buildContext, contextSource(c, src), dockerfile.ProjectPath(src), localCopyInfo(nil), "", false); err != nil {
+			return err
+		}
+	}
+	b.run(s, step, dockerfile.InstallProjectCommands(c), opts...)
+	return nil
+}
+
+// finalStage builds the stage of the image, where the dependencies and the project are copied from
+// the build stage into the home directory of the user, in distinct layers
+func (b *nativeBuilder) finalStage(ctx context.Context, builder *nativeStage) (*nativeStage, error) {
+	c := b.config
+	s, err := b.from(ctx, finalStageName, dockerfile.FinalImage(c), b.platform)
+	if err != nil {
+		return nil, err
+	}
+	if commands := dockerfile.SystemDepsCommands(c); len(commands) > 0 {
+		step := "install system dependencies"
+		var opts []llb.RunOption
+		if c.Flavor != "alpine" {
+			if err := b.addAptRepositoryKeys(ctx, s, step); err != nil {
+				return nil, err
+			}
+			opts = append(opts, secretMounts(dockerfile.AptRepositorySecrets(c))...)
+		}
+		b.run(s, step, commands, opts...)
+	}
+	if commands := dockerfile.SlimRuntimeCommands(c); len(commands) > 0 {
+		b.run(s, "remove package managers", commands)
+	}
+	if commands := dockerfile.CreateUserCommands(c); len(commands) > 0 {
+		b.run(s, "create user", commands)
+		s.setUser(dockerfile.User(c))
+	}
+	step := "copy files"
+	for _, userBase := range []string{dockerfile.DependenciesUserBase, dockerfile.ProjectUserBase} {
+		if err := b.copy(ctx, s, step, builder.state, userBase, c.Prefix, localCopyInfo(nil), "", false); err != nil {
+			return nil, err
+		}
+	}
+	envPath, _, err := s.state.GetEnv(ctx, "PATH")
+	if err != nil {
+		return nil, err
+	}
+	s.addEnv("PATH", envPath+":"+c.Prefix+"/bin")
+	if c.Prefix != c.Home+"/.local" {
+		s.addEnv("PYTHONUSERBASE", c.Prefix)
+	}
+	if c.Optimize > 0 {
+		s.addEnv("PYTHONOPTIMIZE", strconv.Itoa(c.Optimize))
+	}
+	stages := map[string]*nativeStage{builderStageName: builder}
+	for _, f := range c.CopyFiles {
+		if err := b.copyFile(ctx, s, step, f, stages); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range c.AddFiles {
+		if err := b.addFile(ctx, s, "add files", f); err != nil {
+			return nil, err
+		}
+	}
+	// Post install commands run as root, without changing the user of the image
+	var opts []llb.RunOption
+	if !c.RunAsRoot {
+		opts = append(opts, llb.User("root"))
+	}
+	b.runCommands(s, c.RuntimePostInstall, opts...)
+	b.configureImage(s)
+	return s, nil
+}
+
+// configureImage sets the metadata of the final image, which does not change its filesystem
+func (b *nativeBuilder) configureImage(s *nativeStage) {
+	c := b.config
+	img := &s.image.Config
+	if len(c.Volumes) > 0 {
+		if img.Volumes == nil {
+			img.Volumes = map[string]struct{}{}
+		}
+		for _, volume := range c.Volumes {
+			img.Volumes[volume] = struct{}{}
+		}
+	}
+	if len(c.Shell) > 0 {
+		img.Shell = c.Shell
+	}
+	// Like the ENTRYPOINT instruction, setting the entrypoint resets the command of the base image
+	if entrypoint := dockerfile.Entrypoint(c); len(entrypoint) > 0 {
+		img.Entrypoint = entrypoint
+		img.Cmd = nil
+	}
+	if len(c.Command) > 0 {
+		img.Cmd = c.Command
+	}
+	if c.StopSignal != "" {
+		img.StopSignal = c.StopSignal
+	}
+	if len(c.Expose) > 0 {
+		if img.ExposedPorts == nil {
+			img.ExposedPorts = map[string]struct{}{}
+		}
+		// Like the EXPOSE instruction, ports use the tcp protocol by default
+		for _, port := range c.Expose {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			img.ExposedPorts[port] = struct{}{}
+		}
+	}
+	if h := c.Healthcheck; h != nil {
+		// Durations are validated with the configuration
+		interval, timeout, startPeriod, _ := h.Durations()
+		img.Healthcheck = &image.HealthConfig{
+			Test:        append([]string{"CMD"}, h.Command...),
+			Interval:    interval,
+			Timeout:     timeout,
+			StartPeriod: startPeriod,
+			Retries:     h.Retries,
+		}
+	}
+	for _, k := range utils.SortedKeys(c.Env) {
+		s.addEnv(k, dockerfile.ExpandPlaceholders(c.Env[k], b.opt.BuildArgs))
+	}
+	if img.Labels == nil {
+		img.Labels = map[string]string{}
+	}
+	for k, v := range dockerfile.ImageLabels(c, b.opt.BuildArgs) {
+		img.Labels[k] = v
+	}
+	// Labels given as frontend options have precedence, like with dockerfile2llb
+	for k, v := range b.opt.Labels {
+		img.Labels[k] = v
+	}
+}
+
+// from starts a stage for a platform from a base image, or from the named context replacing the base image
+func (b *nativeBuilder) from(ctx context.Context, name string, ref string, platform ocispecs.Platform) (*nativeStage, error) {
+	s := &nativeStage{name: name, platform: platform, ignoreCache: ignoreCache(b.opt.IgnoreCache, name)}
+	st, img, err := b.resolveImage(ctx, s, ref)
+	if err != nil {
+		return nil, err
+	}
+	if img.OS == "" {
+		img.OS = platform.OS
+		img.Architecture = platform.Architecture
+		img.Variant = platform.Variant
+	}
+	if img.RootFS.Type == "" {
+		img.RootFS.Type = "layers"
+	}
+	s.image = img
+	s.state = st.Platform(platform).Network(b.opt.ForceNetMode)
+	for _, env := range img.Config.Env {
+		k, v, _ := strings.Cut(env, "=")
+		s.state = s.state.AddEnv(k, v)
+	}
+	if img.Config.WorkingDir != "" {
+		s.state = s.state.Dir(img.Config.WorkingDir)
+	}
+	if img.Config.User != "" {
+		s.state = s.state.User(img.Config.User)
+	}
+	return s, nil
+}
+
+// resolveImage returns the state and the config of an image, which is either a named
+// context or an image resolved for the platform of the stage
+func (b *nativeBuilder) resolveImage(ctx context.Context, s *nativeStage, ref string) (llb.State, dockerfile2llb.Image, error) {
+	var img dockerfile2llb.Image
+	if b.opt.ContextByName != nil {
+		st, named, err := b.opt.ContextByName(ctx, ref, b.opt.ImageResolveMode.String(), &s.platform)
+		if err != nil {
+			return llb.State{}, img, err
+		}
+		if st != nil {
+			if named != nil {
+				img = *named
+			}
+			return *st, img, nil
+		}
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return llb.State{}, img, errors.Wrapf(err, "failed to parse image %s", ref)
+	}
+	named = reference.TagNameOnly(named)
+	dgst, dt, err := b.metaResolver.ResolveImageConfig(ctx, named.String(), llb.ResolveImageConfigOpt{
+		Platform:    &s.platform,
+		ResolveMode: b.opt.ImageResolveMode.String(),
+		LogName:     b.stepName(s, "load metadata for "+ref),
+	})
+	if err != nil {
+		return llb.State{}, img, errors.Wrapf(err, "failed to resolve image %s", ref)
+	}
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return llb.State{}, img, errors.Wrapf(err, "failed to parse the config of image %s", ref)
+	}
+	// The image is pinned to the resolved digest, so that its config matches its content
+	imageRef := named.String()
+	if pinned, err := reference.WithDigest(named, dgst); err == nil {
+		imageRef = pinned.String()
+	}
+	st := llb.Image(imageRef,
+		llb.Platform(s.platform),
+		b.opt.ImageResolveMode,
+		llb.WithCustomName(b.stepName(s, "pull "+ref)),
+	)
+	return st, img, nil
+}
+
+// addAptRepositoryKeys downloads the keys of the additional apt repositories
+func (b *nativeBuilder) addAptRepositoryKeys(ctx context.Context, s *nativeStage, step string) error {
+	for i, repository := range b.config.AptRepositories {
+		if repository.KeyUrl == "" {
+			continue
+		}
+		if err := b.addFile(ctx, s, step, config.Add{Source: repository.KeyUrl, Destination: dockerfile.AptRepositoryKey(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file into a stage, from the build context or from the source of the copy,
+// which is either a stage, a named context or an image
+func (b *nativeBuilder) copyFile(ctx context.Context, s *nativeStage, step string, f config.Copy, stages map[string]*nativeStage) error {
+	mode, err := parseChmod(f.Chmod)
+	if err != nil {
+		return err
+	}
+	if f.From == "" {
+		return b.copy(ctx, s, step, b.buildContext, contextSource(b.config, f.Source), f.Destination, localCopyInfo(mode), f.Chown, f.Link)
+	}
+	source := llb.Scratch()
+	if stage, ok := stages[f.From]; ok {
+		source = stage.state
+	} else if source, _, err = b.resolveImage(ctx, s, f.From); err != nil {
+		return err
+	}
+	return b.copy(ctx, s, step, source, path.Join("/", f.Source), f.Destination, localCopyInfo(mode), f.Chown, f.Link)
+}
+
+// addFile adds a file into a stage, like the ADD instruction: remote files are downloaded
+// and checked against their checksum, local archives are extracted
+func (b *nativeBuilder) addFile(ctx context.Context, s *nativeStage, step string, f config.Add) error {
+	if !strings.HasPrefix(f.Source, "http://") && !strings.HasPrefix(f.Source, "https://") {
+		info := localCopyInfo(nil)
+		info.AttemptUnpack = true
+		return b.copy(ctx, s, step, b.buildContext, contextSource(b.config, f.Source), f.Destination, info, "", false)
+	}
+	filename := "__unnamed__"
+	if u, err := url.Parse(f.Source); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			filename = base
+		}
+	}
+	opts := []llb.HTTPOption{llb.Filename(filename), llb.WithCustomName(b.stepName(s, step))}
+	if f.Checksum != "" {
+		opts = append(opts, llb.Checksum(digest.Digest(f.Checksum)))
+	}
+	return b.copy(ctx, s, step, llb.HTTP(f.Source, opts...), filename, f.Destination, &llb.CopyInfo{CreateDestPath: true}, "", false)
+}
+
+// copy copies a path of a source state into a stage, with the semantics of the COPY instruction:
+// relative destinations are relative to the working directory, and a trailing slash copies into
+// the destination directory. Linked files are copied into a layer of their own, which does not
+// depend on the previous layers of the stage.
+func (b *nativeBuilder) copy(ctx context.Context, s *nativeStage, step string, source llb.State, src string, dest string, info *llb.CopyInfo, chown string, link bool) error {
+	destination := dest
+	if !path.IsAbs(dest) {
+		dir, err := s.state.GetDir(ctx)
+		if err != nil {
+			return err
+		}
+		destination = path.Join(dir, dest)
+	}
+	destination = path.Join("/", destination)
+	if dest == "." || dest == "" || strings.HasSuffix(dest, "/") {
+		destination += "/"
+	}
+	opts := []llb.CopyOption{info}
+	if chown != "" {
+		opts = append(opts, llb.WithUser(chown))
+	}
+	action := llb.Copy(source, src, destination, opts...)
+	constraints := b.constraints(s, step)
+	if link && info.Mode == nil && b.supports(pb.CapMergeOp) {
+		merged := llb.Merge([]llb.State{s.state, llb.Scratch().File(action, constraints...)}, constraints...)
+		s.state = s.state.WithOutput(merged.Output())
+	} else {
+		s.state = s.state.File(action, constraints...)
+	}
+	s.commit(step)
+	return nil
+}
+
+// runCommands runs each command in its own step, like the RUN instructions of pre and post install commands
+func (b *nativeBuilder) runCommands(s *nativeStage, commands []string, opts ...llb.RunOption) {
+	for _, command := range commands {
+		b.run(s, "run commands", []string{command}, opts...)
+	}
+}
+
+// run runs shell commands in a stage, using the shell of the image. Several commands are
+// run as a single script which stops at the first failing command.
+func (b *nativeBuilder) run(s *nativeStage, step string, commands []string, opts ...llb.RunOption) {
+	script := commands[0]
+	if len(commands) > 1 {
+		script = strings.Join(append([]string{"set -e"}, commands...), "\n")
+	}
+	shell := []string{"/bin/sh", "-c"}
+	if len(s.image.Config.Shell) > 0 {
+		shell = s.image.Config.Shell
+	}
+	runOpts := []llb.RunOption{llb.Args(append(append([]string{}, shell...), script))}
+	for _, constraint := range b.constraints(s, step) {
+		runOpts = append(runOpts, constraint)
+	}
+	runOpts = append(runOpts, b.runOptions()...)
+	runOpts = append(runOpts, opts...)
+	s.state = s.state.Run(runOpts...).Root()
+	s.commit(step)
+}
+
+// runOptions returns the options applied to all commands, which are given as frontend options
+func (b *nativeBuilder) runOptions() []llb.RunOption {
+	var opts []llb.RunOption
+	for _, host := range b.opt.ExtraHosts {
+		opts = append(opts, llb.AddExtraHost(host.Host, host.IP))
+	}
+	if b.supports(pb.CapExecMetaUlimit) {
+		for _, ulimit := range b.opt.Ulimit {
+			opts = append(opts, llb.AddUlimit(llb.UlimitName(ulimit.Name), ulimit.Soft, ulimit.Hard))
+		}
+	}
+	if b.opt.ShmSize > 0 && b.supports(pb.CapExecMountTmpfsSize) {
+		opts = append(opts, llb.AddMount("/dev/shm", llb.Scratch(), llb.Tmpfs(llb.TmpfsSize(b.opt.ShmSize))))
+	}
+	return opts
+}
+
+// pipRunOptions returns the options of the pip install commands, which mount the pip cache,
+// the caches of ccache and cargo and the secrets of the config, and use the network mode of the config.
+// The credentials of the indices and the ssh agent are only mounted to install dependencies.
+func (b *nativeBuilder) pipRunOptions(withIndices bool, useSsh bool) []llb.RunOption {
+	c := b.config
+	opts := []llb.RunOption{b.cacheMount("pip", "/root/.cache", llb.CacheMountShared)}
+	if c.NativeBuildCache {
+		opts = append(opts, b.cacheMount("ccache", dockerfile.CcacheDir, llb.CacheMountShared))
+	}
+	caches := dockerfile.RustCaches(c)
+	for _, name := range utils.SortedKeys(caches) {
+		opts = append(opts, b.cacheMount(name, caches[name], llb.CacheMountShared))
+	}
+	switch c.Network {
+	case "none":
+		opts = append(opts, llb.Network(llb.NetModeNone))
+	case "host":
+		opts = append(opts, llb.Network(llb.NetModeHost))
+	}
+	opts = append(opts, secretMounts(dockerfile.PipSecrets(c))...)
+	if withIndices {
+		opts = append(opts, secretMounts(dockerfile.IndexSecrets(c))...)
+	}
+	if useSsh {
+		opts = append(opts, llb.AddSSHSocket())
+	}
+	return opts
+}
+
+// wheelhouseMount returns the option bind mounting the wheelhouse, which is read from the
+// build context unless it is read from a named context or an image
+func (b *nativeBuilder) wheelhouseMount(ctx context.Context, s *nativeStage) ([]llb.RunOption, error) {
+	c := b.config
+	if c.Wheelhouse == "" {
+		return nil, nil
+	}
+	source := b.buildContext
+	if c.WheelhouseFrom != "" {
+		st, _, err := b.resolveImage(ctx, s, c.WheelhouseFrom)
+		if err != nil {
+			return nil, err
+		}
+		source = st
+	}
+	return []llb.RunOption{llb.AddMount(dockerfile.WheelhousePath, source, llb.SourcePath(path.Join("/", dockerfile.WheelhouseSource(c))), llb.Readonly)}, nil
+}
+
+// packageCacheSharing returns the sharing mode of the cache mounts of apt and apk
+func packageCacheSharing(c *config.Config) llb.CacheMountSharingMode {
+	switch c.PackageCacheSharing {
+	case "shared":
+		return llb.CacheMountShared
+	case "private":
+		return llb.CacheMountPrivate
+	default:
+		return llb.CacheMountLocked
+	}
+}
+
+// cacheMount returns the option mounting a cache, whose id is prefixed by the cache id of the config
+func (b *nativeBuilder) cacheMount(name string, target string, sharing llb.CacheMountSharingMode) llb.RunOption {
+	return llb.AddMount(target, llb.Scratch(), llb.AsPersistentCacheDir(dockerfile.CacheId(b.config)+"-"+name, sharing))
+}
+
+// constraints returns the constraints of the vertices of a step
+func (b *nativeBuilder) constraints(s *nativeStage, step string) []llb.ConstraintsOpt {
+	opts := []llb.ConstraintsOpt{llb.WithCustomName(b.stepName(s, step))}
+	if s.ignoreCache {
+		opts = append(opts, llb.IgnoreCache)
+	}
+	return opts
+}
+
+// stepName returns the progress name of a step of a stage
+func (b *nativeBuilder) stepName(s *nativeStage, step string) string {
+	var platform *ocispecs.Platform
+	if b.opt.PrefixPlatform {
+		platform = &b.platform
+	}
+	return stepName(dockerfile.Step{Stage: s.name, Name: step}, b.target, platform)
+}
+
+// ignoreCache returns whether a stage should not use build cache, see parseNoCache
+func ignoreCache(stages []string, stage string) bool {
+	if stages == nil {
+		return false
+	}
+	if len(stages) == 0 {
+		return true
+	}
+	for _, name := range stages {
+		if strings.EqualFold(name, stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// supports returns whether buildkit supports an LLB capability
+func (b *nativeBuilder) supports(capability apicaps.CapID) bool {
+	return b.opt.LLBCaps != nil && b.opt.LLBCaps.Supports(capability) == nil
+}
+
+// addEnv sets an environment variable of the stage and of its image
+func (s *nativeStage) addEnv(key string, value string) {
+	s.state = s.state.AddEnv(key, value)
+	for i, env := range s.image.Config.Env {
+		if k, _, _ := strings.Cut(env, "="); k == key {
+			s.image.Config.Env[i] = key + "=" + value
+			return
+		}
+	}
+	s.image.Config.Env = append(s.image.Config.Env, key+"="+value)
+}
+
+// setUser sets the user running the next commands of the stage and the user of its image
+func (s *nativeStage) setUser(user string) {
+	s.state = s.state.User(user)
+	s.image.Config.User = user
+}
+
+// commit records a step which added a layer in the history of the image
+func (s *nativeStage) commit(step string) {
+	s.image.History = append(s.image.History, ocispecs.History{
+		CreatedBy: step,
+		Comment:   historyComment,
+	})
+}
+
+// secretMounts returns the options mounting secrets. Like the secret mounts of the
+// generated Dockerfile, secrets are optional and mounted in /run/secrets by default.
+func secretMounts(secrets []dockerfile.Secret) []llb.RunOption {
+	var opts []llb.RunOption
+	for _, secret := range secrets {
+		target := secret.Target
+		if target == "" {
+			target = path.Join("/run/secrets", secret.ID)
+		}
+		opts = append(opts, llb.AddSecret(target, llb.SecretID(secret.ID), llb.SecretOptional))
+	}
+	return opts
+}
+
+// localCopyInfo returns the options of copies from the build context or from another state:
+// the content of directories is copied, and wildcards are allowed
+func localCopyInfo(mode *os.FileMode) *llb.CopyInfo {
+	return &llb.CopyInfo{
+		Mode:                mode,
+		FollowSymlinks:      true,
+		CopyDirContentsOnly: true,
+		CreateDestPath:      true,
+		AllowWildcard:       true,
+		AllowEmptyWildcard:  true,
+	}
+}
+
+// contextSource returns the path of a source in the build context
+func contextSource(c *config.Config, src string) string {
+	return path.Join("/", dockerfile.ContextPath(c, src))
+}
+
+// parseChmod parses the octal permissions of a copied file
+func parseChmod(chmod string) (*os.FileMode, error) {
+	if chmod == "" {
+		return nil, nil
+	}
+	perm, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid chmod %s", chmod)
+	}
+	mode := os.FileMode(perm)
+	return &mode, nil
+}
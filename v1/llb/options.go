@@ -0,0 +1,29 @@
+package llb
+
+import "sort"
+
+// FrontendOptions returns the options of the frontend supported by Build, sorted by name.
+// Options ending with a colon are prefixes, e.g. build-arg: for build-arg:name=value.
+func FrontendOptions() []string {
+	options := []string{
+		keyCacheFrom,
+		keyCacheImports,
+		keyConfigPath,
+		keyNoCache,
+		keyForceNetwork,
+		keyGlobalAddHosts,
+		keyShmSize,
+		keyUlimit,
+		keyTargetPlatform,
+		keyDebugOnFailure,
+		keyAllTargets,
+		keyRequestID,
+		keyFrontendCaps,
+		buildArgPrefix,
+		labelPrefix,
+		contextPrefix,
+		inputMetadataPrefix,
+	}
+	sort.Strings(options)
+	return options
+}
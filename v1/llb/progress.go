@@ -0,0 +1,74 @@
+package llb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Name of the generated Dockerfile in the source map of the definition
+	dockerfileSourceName = "Dockerfile"
+	// Key of the metadata holding the progress name of a vertex
+	keyCustomName = "llb.customname"
+)
+
+// withProgressName names the vertex of an internal solve of the frontend in the progress output
+func withProgressName(name string) llb.ConstraintsOpt {
+	return llb.WithCustomName("[microb] " + name)
+}
+
+// NewSourceMap returns the source map of a generated Dockerfile. It must be given to
+// dockerfile2llb so that the vertices can be named after their steps by NameSteps.
+func NewSourceMap(generated string) *llb.SourceMap {
+	return llb.NewSourceMap(nil, dockerfileSourceName, []byte(generated))
+}
+
+// NameSteps names the vertices of a definition compiled from a generated Dockerfile after
+// the steps which generated them, e.g. [builder target=api] install dependencies, instead of
+// the text of their instruction. The platform prefixes the names of multi-platform builds.
+// Vertices of instructions which are not generated by a step keep their name.
+func NameSteps(def *llb.Definition, generated string, target string, platform *ocispecs.Platform) {
+	if def.Source == nil {
+		return
+	}
+	steps := dockerfile.Steps(generated)
+	for dgst, metadata := range def.Metadata {
+		locations, ok := def.Source.Locations[dgst.String()]
+		if !ok {
+			continue
+		}
+		for _, location := range locations.Locations {
+			index := int(location.SourceIndex)
+			if index >= len(def.Source.Infos) || def.Source.Infos[index].Filename != dockerfileSourceName || len(location.Ranges) == 0 {
+				continue
+			}
+			step, ok := steps[int(location.Ranges[0].Start.Line)]
+			if !ok {
+				continue
+			}
+			if metadata.Description == nil {
+				metadata.Description = map[string]string{}
+			}
+			metadata.Description[keyCustomName] = stepName(step, target, platform)
+			def.Metadata[dgst] = metadata
+			break
+		}
+	}
+}
+
+// stepName returns the progress name of a step
+func stepName(step dockerfile.Step, target string, platform *ocispecs.Platform) string {
+	prefix := []string{step.Stage}
+	if platform != nil {
+		prefix = append([]string{platforms.Format(*platform)}, prefix...)
+	}
+	if target != "" {
+		prefix = append(prefix, "target="+target)
+	}
+	return fmt.Sprintf("[%s] %s", strings.Join(prefix, " "), step.Name)
+}
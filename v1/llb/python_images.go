@@ -0,0 +1,55 @@
+package llb
+
+import (
+	"context"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// checkPythonImages makes sure that the base images of a python version pinned to a patch release,
+// e.g. 3.11.9, are published for the flavor of the config, so that a missing tag fails the build
+// with an explicit error before anything is built. Images replaced by named contexts are not checked.
+func checkPythonImages(ctx context.Context, c client.Client, microbConfig *config.Config, buildPlatform ocispecs.Platform, targetPlatform *ocispecs.Platform) error {
+	if !config.PatchPythonVersion(microbConfig.PythonVersion) {
+		return nil
+	}
+	builderPlatform := targetPlatform
+	if microbConfig.CrossCompile {
+		builderPlatform = &buildPlatform
+	}
+	images := []struct {
+		ref      string
+		platform *ocispecs.Platform
+	}{
+		{dockerfile.BuilderImage(microbConfig), builderPlatform},
+		{dockerfile.FinalImage(microbConfig), targetPlatform},
+	}
+	byName := contextByNameFunc(c)
+	for _, image := range images {
+		st, _, err := byName(ctx, image.ref, "", image.platform)
+		if err != nil {
+			return err
+		}
+		if st != nil {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(image.ref)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse image %s", image.ref)
+		}
+		_, _, err = c.ResolveImageConfig(ctx, reference.TagNameOnly(named).String(), llb.ResolveImageConfigOpt{
+			Platform: image.platform,
+			LogName:  "[internal] check python image " + image.ref,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "python %s is not available for flavor %s: failed to resolve image %s", microbConfig.PythonVersion, microbConfig.Flavor, image.ref)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package llb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/frontend/subrequests"
+	"github.com/moby/buildkit/frontend/subrequests/outline"
+	"github.com/moby/buildkit/frontend/subrequests/targets"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+const (
+	// Support subrequests such as `docker buildx build --call=outline`.
+	// See https://github.com/moby/buildkit/blob/master/frontend/subrequests
+	keyRequestID    = "requestid"
+	keyFrontendCaps = "frontend.caps"
+)
+
+// Capabilities of the frontend which can be requested by clients
+var frontendCaps = map[string]bool{
+	"moby.buildkit.frontend.inputs":      true,
+	"moby.buildkit.frontend.subrequests": true,
+	"moby.buildkit.frontend.contexts":    true,
+}
+
+// validateCaps returns an error when a capability requested by the client is not supported,
+// unless the client accepts the request to be forwarded to another frontend
+func validateCaps(requested string) error {
+	if requested == "" {
+		return nil
+	}
+	for _, capability := range strings.Split(requested, ",") {
+		name, options, _ := strings.Cut(capability, "+")
+		if !frontendCaps[name] && options != "forward" {
+			return errdefs.NewUnsupportedFrontendCapError(name)
+		}
+	}
+	return nil
+}
+
+// describeSubrequests returns the result of the describe subrequest, which lists the
+// subrequests supported by the frontend
+func describeSubrequests() (*client.Result, error) {
+	all := []subrequests.Request{
+		outline.SubrequestsOutlineDefinition,
+		targets.SubrequestsTargetsDefinition,
+		subrequestsLintDefinition,
+		subrequests.SubrequestsDescribeDefinition,
+	}
+	dt, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(nil)
+	if err := subrequests.PrintDescribe(dt, b); err != nil {
+		return nil, err
+	}
+	res := client.NewResult()
+	res.AddMeta("result.json", dt)
+	res.AddMeta("result.txt", b.Bytes())
+	res.AddMeta("version", []byte(subrequests.SubrequestsDescribeDefinition.Version))
+	return res, nil
+}
+
+// outlineSubrequest returns the outline of the build of a target: the build arguments accepted
+// by the frontend, and the secrets and ssh agents required by the generated Dockerfile
+func outlineSubrequest(ctx context.Context, c *config.Config, pyproject []byte, generated string, convertOpts dockerfile2llb.ConvertOpt) (*client.Result, error) {
+	o, err := dockerfile2llb.Dockefile2Outline(ctx, []byte(generated), convertOpts)
+	if err != nil {
+		return nil, err
+	}
+	o.Name = c.Target
+	o.Description = config.TargetDescription(pyproject, c.Target)
+	if o.Description == "" {
+		o.Description = c.Description
+	}
+	// The targets are read from pyproject.toml, which is added to the sources of the outline
+	names, err := config.Targets(pyproject)
+	if err != nil {
+		return nil, err
+	}
+	targetArg := outline.Arg{
+		Name:        "microb_target",
+		Description: "Target of pyproject.toml to build, the first target by default",
+		Value:       c.Target,
+	}
+	if len(names) > 0 {
+		targetArg.Description += fmt.Sprintf(" (%s)", strings.Join(names, ", "))
+		targetArg.Location = keyLocation(pyproject, len(o.Sources), toml.Key{"tool", "microb", "target", c.Target})
+	}
+	o.Sources = append(o.Sources, pyproject)
+	o.Args = append([]outline.Arg{
+		targetArg,
+		{Name: "microb_context_dir", Description: "Directory of the build context used as project root", Value: c.ContextDir},
+		{Name: "microb_templates_dir", Description: "Directory of the templates overriding the stage templates"},
+		{Name: "microb_python_versions", Description: "Comma separated python versions resolved from requires-python, overriding python_versions of [tool.microb]"},
+		{Name: "microb_output", Description: "Output of the build, image or wheelhouse to export the wheels of the dependencies", Value: "image"},
+	}, o.Args...)
+	return o.ToResult()
+}
+
+// targetsSubrequest returns the targets declared in pyproject.toml, the first one being the default.
+// Targets are described by the comments preceding their declaration.
+func targetsSubrequest(pyproject []byte) (*client.Result, error) {
+	names, err := config.Targets(pyproject)
+	if err != nil {
+		return nil, err
+	}
+	list := targets.List{Sources: [][]byte{pyproject}}
+	for i, name := range names {
+		list.Targets = append(list.Targets, targets.Target{
+			Name:        name,
+			Default:     i == 0,
+			Description: config.TargetDescription(pyproject, name),
+			Location:    keyLocation(pyproject, 0, toml.Key{"tool", "microb", "target", name}),
+		})
+	}
+	return list.ToResult()
+}
+
+// keyLocation returns the location of a key of pyproject.toml, which is the source of the given index
+func keyLocation(pyproject []byte, index int, key toml.Key) *pb.Location {
+	position, ok := config.KeyPosition(pyproject, key)
+	if !ok {
+		return nil
+	}
+	line := int32(position.Line)
+	return &pb.Location{
+		SourceIndex: int32(index),
+		Ranges:      []*pb.Range{{Start: pb.Position{Line: line}, End: pb.Position{Line: line}}},
+	}
+}
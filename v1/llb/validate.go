@@ -0,0 +1,31 @@
+package llb
+
+import (
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// ValidateDockerfile parses a generated Dockerfile with the buildkit Dockerfile parser.
+// Errors are reported with the offending line of the Dockerfile, since an invalid
+// Dockerfile is a bug of microb or of the templates rather than of the project.
+func ValidateDockerfile(dockerfile string) error {
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	if err == nil {
+		_, _, err = instructions.Parse(result.AST)
+	}
+	if err == nil {
+		return nil
+	}
+	var location *parser.ErrorLocation
+	if errors.As(err, &location) && len(location.Location) > 0 {
+		line := location.Location[0].Start.Line
+		lines := strings.Split(dockerfile, "\n")
+		if line > 0 && line <= len(lines) {
+			return errors.Wrapf(err, "internal error: invalid generated Dockerfile at line %d: %s", line, lines[line-1])
+		}
+	}
+	return errors.Wrap(err, "internal error: invalid generated Dockerfile")
+}
@@ -0,0 +1,46 @@
+package llb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	gwpb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// warnFindings reports the risky patterns found in the configuration as warnings of the
+// vertex which loaded pyproject.toml, so that they are shown by docker build.
+// Warnings are not reported when buildkit does not support them.
+func warnFindings(ctx context.Context, c client.Client, def *llb.Definition, filename string, data []byte, cfg *config.Config, options *config.Options) {
+	caps := c.BuildOpts().Caps
+	if caps.Supports(gwpb.CapGatewayWarnings) != nil {
+		return
+	}
+	findings, err := config.LintConfig(cfg, data, options)
+	if err != nil {
+		return
+	}
+	dgst, err := def.Head()
+	if err != nil {
+		return
+	}
+	for _, finding := range findings {
+		opts := client.WarnOpts{Level: 1}
+		if finding.Line > 0 {
+			opts.SourceInfo = &pb.SourceInfo{
+				Filename:   filename,
+				Data:       data,
+				Definition: def.ToPB(),
+			}
+			opts.Range = []*pb.Range{{
+				Start: pb.Position{Line: int32(finding.Line), Character: int32(finding.Column)},
+				End:   pb.Position{Line: int32(finding.Line), Character: int32(finding.Column)},
+			}}
+		}
+		// Warnings are best effort, they never fail the build
+		_ = c.Warn(ctx, dgst, fmt.Sprintf("%s: %s", finding.Rule, finding.Message), opts)
+	}
+}
@@ -0,0 +1,49 @@
+package llb
+
+import (
+	"context"
+
+	"github.com/charbonats/microbuild/v1/config"
+	"github.com/charbonats/microbuild/v1/dockerfile"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/pkg/errors"
+)
+
+// Wheelhouse2LLB builds the LLB state of the wheelhouse of a config, which only contains the wheels
+// of the python dependencies, like the wheelhouse stage appended to the generated Dockerfile,
+// see dockerfile.WheelhouseStages. The options are the same as the options of Microb2LLB.
+func Wheelhouse2LLB(ctx context.Context, c *config.Config, target string, opt dockerfile2llb.ConvertOpt) (*llb.State, *dockerfile2llb.Image, error) {
+	b := newNativeBuilder(c, target, opt)
+	builder, err := b.buildStage(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to build the build stage")
+	}
+	wheels := &nativeStage{
+		name:        dockerfile.WheelsStageName,
+		platform:    builder.platform,
+		state:       builder.state,
+		image:       builder.image,
+		ignoreCache: ignoreCache(opt.IgnoreCache, dockerfile.WheelsStageName),
+	}
+	opts, err := b.dependenciesRunOptions(ctx, wheels)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to build the wheels stage")
+	}
+	b.run(wheels, "build wheels", dockerfile.BuildWheelsCommands(c), opts...)
+
+	s := &nativeStage{
+		name:        dockerfile.WheelhouseStageName,
+		platform:    b.platform,
+		state:       llb.Scratch().Platform(b.platform),
+		ignoreCache: ignoreCache(opt.IgnoreCache, dockerfile.WheelhouseStageName),
+	}
+	s.image.OS = b.platform.OS
+	s.image.Architecture = b.platform.Architecture
+	s.image.Variant = b.platform.Variant
+	s.image.RootFS.Type = "layers"
+	step := "export wheels"
+	s.state = s.state.File(llb.Copy(wheels.state, dockerfile.WheelsPath+"/", "/", localCopyInfo(nil)), b.constraints(s, step)...)
+	s.commit(step)
+	return &s.state, &s.image, nil
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 // Get a union of two maps.
 // Items present both in map1 and map2 will be overwritten by map2.
@@ -32,15 +35,37 @@ func Filter(mapping map[string]string, prefix string) map[string]string {
 	return filtered
 }
 
-// Unique returns a new slice containing only the unique elements of the given slice
+// Unique returns a new slice containing only the unique elements of the given slice.
+// Elements are kept in the order of their first occurrence.
 func Unique(slice []string) []string {
 	keys := make(map[string]struct{})
+	uniqueKeys := make([]string, 0, len(slice))
 	for _, entry := range slice {
+		if _, ok := keys[entry]; ok {
+			continue
+		}
 		keys[entry] = struct{}{}
-	}
-	uniqueKeys := make([]string, 0, len(keys))
-	for key := range keys {
-		uniqueKeys = append(uniqueKeys, key)
+		uniqueKeys = append(uniqueKeys, entry)
 	}
 	return uniqueKeys
 }
+
+// SortedKeys returns the keys of the given map sorted in increasing order
+func SortedKeys(mapping map[string]string) []string {
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsTruthy returns true when the given string represents a true boolean value
+func IsTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}